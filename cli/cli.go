@@ -2,67 +2,381 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"strconv"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"go-to-do-app/to-do-lib/apiclient"
+	todoerrors "go-to-do-app/to-do-lib/errors"
 	"go-to-do-app/to-do-lib/logging"
 	"go-to-do-app/to-do-lib/models"
+	"go-to-do-app/to-do-lib/offline"
+
+	"github.com/google/uuid"
 )
 
+// Global flags, given before the command.
 var (
-	post     = flag.Bool("post", false, "Add new Todo")
-	put      = flag.Bool("put", false, "updateTodo")
-	get      = flag.Bool("get", false, "Get existing Todo")
-	id       = flag.String("id", "", "UUID of ToDo item")
-	userId   = flag.String("user-id", "", "UUID representing user id")
-	title    = flag.String("title", "", "Title of ToDo item")
-	priority = flag.String("priority", "", "Priority of ToDo item")
-	complete = flag.Bool("complete", false, "Completion status of ToDo item")
-	version  = flag.String("version", "", "version of the api to use")
+	userId  = flag.String("user-id", os.Getenv("TODO_USER"), "User whose ToDos to work with (default $TODO_USER)")
+	version = flag.String("version", apiclient.DefaultVersion, "version of the api to use")
+	baseURL = flag.String("server", envOr("TODO_SERVER", "http://localhost:8081/"), "URL of the ToDo server (default $TODO_SERVER)")
+	timeout = flag.Duration("timeout", apiclient.DefaultTimeout, "How long to wait for each request")
+	apiKey  = flag.String("api-key", os.Getenv("TODO_API_KEY"), "API key to send with every request (default $TODO_API_KEY)")
+	token   = flag.String("token", os.Getenv("TODO_TOKEN"), "Bearer token to send with every request (default $TODO_TOKEN)")
+	cache   = flag.String("cache", envOr("TODO_CACHE", defaultCachePath()), "File that keeps ToDos and queued changes while the server cannot be reached (default $TODO_CACHE)")
+)
+
+// Exit codes. Flag errors exit with exitUsage too, as the flag package does.
+const (
+	exitFailure = 1
+	exitUsage   = 2
 )
 
-func cliParse() {
-	flag.Parse()
-	fmt.Println(*post)
-	todoflags := map[string]string{
-		"user-id":  *userId,
-		"id":       *id,
-		"title":    *title,
-		"priority": *priority,
-		"complete": strconv.FormatBool(*complete),
-		"version":  *version,
-	}
-	fmt.Println(todoflags)
-	var item models.ToDo
+// app is what commands run against: the server, through the offline cache
+// where a command can work without it.
+type app struct {
+	client *apiclient.APIClient
+	local  *offline.Client
+}
+
+// command is a subcommand of the CLI.
+type command struct {
+	name string
+	// args is the synopsis of the positional arguments.
+	args    string
+	summary string
+	// minArgs and maxArgs bound the number of positional arguments; a
+	// negative maxArgs means any number.
+	minArgs, maxArgs int
+	// flagsFirst stops flags being read after the first positional argument,
+	// for arguments that may start with '-' themselves.
+	flagsFirst bool
+	// setup adds the command's flags to fs and returns the function that
+	// runs it with the positional arguments.
+	setup func(fs *flag.FlagSet) func(ctx context.Context, a *app, args []string) error
+}
+
+// usageError is a command used the wrong way. Its usage is printed with it.
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &usageError{message: fmt.Sprintf(format, args...)}
+}
+
+func progName() string {
+	return filepath.Base(os.Args[0])
+}
+
+func findCommand(name string) *command {
+	i := slices.IndexFunc(commands, func(cmd command) bool { return cmd.name == name })
+	if i < 0 {
+		return nil
+	}
+	return &commands[i]
+}
+
+// flagSet returns the flags of cmd and the function that runs it.
+func (cmd *command) flagSet() (*flag.FlagSet, func(context.Context, *app, []string) error) {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	run := cmd.setup(fs)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s [global flags] %s [flags] %s\n\n%s\n", progName(), cmd.name, cmd.args, cmd.summary)
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(out, "\nFlags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs, run
+}
+
+// parse reads the flags of cmd from args and returns its positional
+// arguments. Flags may come before, between or after them, unless cmd takes
+// its flags first; "--" ends the flags either way.
+func (cmd *command) parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if n := len(args) - len(rest); cmd.flagsFirst || len(rest) == 0 || n > 0 && args[n-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [global flags] <command> [flags] [args]\n\nCommands:\n", progName())
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	fmt.Fprintf(w, "  help <command>\tShow the flags of a command\n")
+	w.Flush()
+	fmt.Fprintf(out, "\nGlobal flags:\n")
+	flag.PrintDefaults()
+}
+
+// cliParse runs the command given by the command line arguments args, without
+// the program name, and returns the exit code.
+func cliParse(args []string) int {
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+	name, args := flag.Arg(0), flag.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	switch name {
+	case "":
+		usage()
+		return exitUsage
+	case "help":
+		if len(args) == 0 {
+			flag.CommandLine.SetOutput(os.Stdout)
+			usage()
+			return 0
+		}
+		cmd := findCommand(args[0])
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "%s: unknown command %q; see %s help\n", progName(), args[0], progName())
+			return exitUsage
+		}
+		fs, _ := cmd.flagSet()
+		fs.SetOutput(os.Stdout)
+		fs.Usage()
+		return 0
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "%s: unknown command %q; see %s help\n", progName(), name, progName())
+		return exitUsage
+	}
+	fs, run := cmd.flagSet()
+	args, err := cmd.parse(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return exitUsage
+	}
+	switch {
+	case len(args) < cmd.minArgs:
+		return usageFailure(fs, usageErrorf("%s needs %s", cmd.name, cmd.args))
+	case cmd.maxArgs >= 0 && len(args) > cmd.maxArgs:
+		return usageFailure(fs, usageErrorf("too many arguments to %s: %s", cmd.name, strings.Join(args, " ")))
+	}
+
 	ctx := logging.AddTraceID(context.Background())
-	client := apiclient.NewAPIClient("http://localhost:8081/")
-	// if serverup, err := client.PingServer(); !serverup || err != nil {
-	// 	// logging.LogWithTrace(ctx, todoflags, "failed to ping server. check server is alive.")
-	// }
-	if *post || *put {
-		var err error
-		item, err = models.NewToDo(userId, id, title, priority, complete)
-		if err != nil {
-			// logging.LogWithTrace(ctx, todoflags, err.Error())
+	client := apiclient.NewAPIClient(*baseURL)
+	client.Version = *version
+	client.APIKey = *apiKey
+	client.Token = *token
+	client.HTTPClient.Timeout = *timeout
+	local, err := offline.Open(&client, *cache)
+	if err != nil {
+		return failure(err)
+	}
+	err = run(ctx, &app{client: &client, local: local}, args)
+	var usageErr *usageError
+	if errors.As(err, &usageErr) {
+		return usageFailure(fs, err)
+	}
+	if err != nil {
+		return failure(err)
+	}
+	return 0
+}
+
+func usageFailure(fs *flag.FlagSet, err error) int {
+	fmt.Fprintf(os.Stderr, "%s: %s\n\n", progName(), err)
+	fs.Usage()
+	return exitUsage
+}
+
+func failure(err error) int {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", progName(), err)
+	return exitFailure
+}
+
+// resolveId reads the id of a ToDo given as an argument. Besides a whole
+// UUID it takes the start of the id of a ToDo in the cache, as list prints
+// them.
+func (a *app) resolveId(arg string) (uuid.UUID, error) {
+	if id, err := uuid.Parse(arg); err == nil {
+		return id, nil
+	}
+	prefix := strings.ToLower(arg)
+	var matches []uuid.UUID
+	for _, item := range a.local.Cache().Items {
+		if item.UserId == *userId && strings.HasPrefix(item.Id.String(), prefix) {
+			matches = append(matches, item.Id)
+		}
+	}
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		return uuid.Nil, &todoerrors.NotFoundError{Message: fmt.Sprintf("no ToDo id starts with %q; run list to see them", arg)}
+	default:
+		return uuid.Nil, &todoerrors.ValidationError{Field: "id", Err: fmt.Errorf("%q is the start of %d ToDo ids; give more of it", arg, len(matches))}
+	}
+}
+
+// shortId is the start of id that list prints and resolveId takes.
+func shortId(id uuid.UUID) string {
+	return id.String()[:8]
+}
+
+// describe names a ToDo in messages.
+func describe(item models.ToDo) string {
+	return fmt.Sprintf("%s %q", shortId(item.Id), item.Title)
+}
+
+func formatDue(due *time.Time) string {
+	if due == nil {
+		return ""
+	}
+	if due.Hour() == 0 && due.Minute() == 0 {
+		return due.Format(time.DateOnly)
+	}
+	return due.Format("2006-01-02 15:04 MST")
+}
+
+// printTable prints ToDos one to a line, under a header.
+func printTable(items []models.ToDo) {
+	if len(items) == 0 {
+		fmt.Println("No ToDos.")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPRIORITY\tSTATUS\tDUE\tTITLE")
+	for _, item := range items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s", shortId(item.Id), item.Priority, item.EffectiveStatus(), formatDue(item.DueDate), item.Title)
+		if len(item.Tags) > 0 {
+			fmt.Fprintf(w, "  #%s", strings.Join(item.Tags, " #"))
+		}
+		if item.Progress != nil {
+			fmt.Fprintf(w, "  %d%%", *item.Progress)
+		}
+		if len(item.BlockedBy) > 0 {
+			fmt.Fprintf(w, "  blocked by %d", len(item.BlockedBy))
+		}
+		if item.Recurrence != nil {
+			fmt.Fprintf(w, "  repeats")
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+// printDetails prints every field of a ToDo that is set, one to a line.
+func printDetails(item models.ToDo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	field := func(name string, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%s:\t%s\n", name, value)
 		}
-		err = item.Validate(*version)
-		if err != nil {
-			// logging.LogWithTrace(ctx, todoflags, err.Error())
+	}
+	field("Title", item.Title)
+	field("ID", item.Id.String())
+	field("Priority", item.Priority)
+	field("Status", item.EffectiveStatus())
+	field("Due", formatDue(item.DueDate))
+	if len(item.Tags) > 0 {
+		field("Tags", "#"+strings.Join(item.Tags, " #"))
+	}
+	if item.Progress != nil {
+		field("Progress", fmt.Sprintf("%d%% of subtasks done", *item.Progress))
+	}
+	if item.ParentId != nil {
+		field("Subtask of", item.ParentId.String())
+	}
+	if item.ListId != uuid.Nil {
+		field("List", item.ListId.String())
+	}
+	if len(item.BlockedBy) > 0 {
+		blockers := make([]string, len(item.BlockedBy))
+		for i, blocker := range item.BlockedBy {
+			blockers[i] = blocker.String()
 		}
+		field("Blocked by", strings.Join(blockers, ", "))
 	}
-	if *post {
-		client.Req(ctx, "POST", item, todoflags)
+	if item.Recurrence != nil {
+		field("Repeats", item.Recurrence.String())
 	}
-	if *put {
-		client.Req(ctx, "PUT", item, todoflags)
+	if !item.CreatedAt.IsZero() {
+		field("Created", item.CreatedAt.Local().Format(time.DateTime))
+		field("Updated", item.UpdatedAt.Local().Format(time.DateTime))
+	}
+	if item.CompletedAt != nil {
+		field("Completed", item.CompletedAt.Local().Format(time.DateTime))
+	}
+	w.Flush()
+	if item.Description != "" {
+		fmt.Printf("\n%s\n", item.Description)
+	}
+}
+
+// printReport prints what a sync did, and the server's side of each conflict.
+func printReport(report offline.Report) {
+	fmt.Printf("Pushed %d, pulled %d, conflicts %d\n", len(report.Pushed), report.Pulled, len(report.Conflicts))
+	for _, conflict := range report.Conflicts {
+		fmt.Printf("Conflict: %s %s: %s\n", conflict.Change.Op, describe(conflict.Change.Item), conflict.Err)
+		if conflict.Server != nil {
+			fmt.Printf("  server has: %s, %s, %s\n", describe(*conflict.Server), conflict.Server.Priority, conflict.Server.EffectiveStatus())
+		} else {
+			fmt.Println("  server has: nothing, it was deleted")
+		}
 	}
-	if *get {
-		client.Req(ctx, "GET", item, todoflags)
+}
+
+func noteQueued(queued bool) {
+	if queued {
+		fmt.Fprintln(os.Stderr, "The server cannot be reached; the change is queued until sync.")
+	}
+}
+
+func noteStale(stale bool) {
+	if stale {
+		fmt.Fprintln(os.Stderr, "The server cannot be reached; showing the offline cache.")
+	}
+}
+
+// defaultCachePath is the cache in the user's cache directory, or in the
+// working directory if there is none.
+func defaultCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "todo-cache.json"
+	}
+	return filepath.Join(dir, "todo", "cache.json")
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
 	}
+	return fallback
 }
 
 func main() {
-	cliParse()
+	os.Exit(cliParse(os.Args[1:]))
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"go-to-do-app/to-do-lib/datastores"
+	"go-to-do-app/to-do-lib/models"
+	"go-to-do-app/to-do-server/server"
+
+	"github.com/google/uuid"
+)
+
+func TestCommandParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		command    string
+		args       []string
+		positional []string
+		flags      map[string]string
+		err        bool
+	}{
+		{name: "no arguments", command: "add", args: []string{}, positional: nil},
+		{name: "flags first", command: "add", args: []string{"-priority", "High", "buy", "milk"}, positional: []string{"buy", "milk"}, flags: map[string]string{"priority": "High"}},
+		{name: "flags between", command: "add", args: []string{"buy", "-priority=Low", "milk", "-tags", "home"}, positional: []string{"buy", "milk"}, flags: map[string]string{"priority": "Low", "tags": "home"}},
+		{name: "flags last", command: "edit", args: []string{"1234", "-title", "new"}, positional: []string{"1234"}, flags: map[string]string{"title": "new"}},
+		{name: "double dash", command: "add", args: []string{"-priority", "Low", "--", "-5", "degrees", "-priority"}, positional: []string{"-5", "degrees", "-priority"}, flags: map[string]string{"priority": "Low"}},
+		{name: "double dash after positional", command: "add", args: []string{"note", "--", "-tags", "x"}, positional: []string{"note", "-tags", "x"}, flags: map[string]string{"tags": ""}},
+		{name: "flagsFirst stops at the first positional", command: "list", args: []string{"-parent", "abcd", "priority:high", "-complete"}, positional: []string{"priority:high", "-complete"}, flags: map[string]string{"parent": "abcd"}},
+		{name: "flagsFirst with double dash", command: "list", args: []string{"--", "-complete"}, positional: []string{"-complete"}},
+		{name: "unknown flag", command: "add", args: []string{"buy", "-nope"}, err: true},
+		{name: "missing flag value", command: "edit", args: []string{"1234", "-title"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := findCommand(tt.command)
+			fs, _ := cmd.flagSet()
+			fs.SetOutput(io.Discard)
+			positional, err := cmd.parse(fs, tt.args)
+			if (err != nil) != tt.err {
+				t.Fatalf("Expected error: %t, Got: %v", tt.err, err)
+			}
+			if tt.err {
+				return
+			}
+			if !reflect.DeepEqual(positional, tt.positional) {
+				t.Errorf("Expected: %q, Got: %q", tt.positional, positional)
+			}
+			for name, value := range tt.flags {
+				if got := fs.Lookup(name).Value.String(); got != value {
+					t.Errorf("-%s Expected: %q, Got: %q", name, value, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCliParseExitCodes(t *testing.T) {
+	srv := server.NewToDoServer(":0", make(chan bool), datastores.NewInMemDataStore())
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	global := []string{"-server", ts.URL, "-user-id", "alice", "-cache", filepath.Join(t.TempDir(), "cache.json")}
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{name: "no command", args: []string{}, code: exitUsage},
+		{name: "help", args: []string{"help"}, code: 0},
+		{name: "help for a command", args: []string{"help", "add"}, code: 0},
+		{name: "help for an unknown command", args: []string{"help", "nope"}, code: exitUsage},
+		{name: "unknown command", args: []string{"nope"}, code: exitUsage},
+		{name: "command help flag", args: []string{"add", "-h"}, code: 0},
+		{name: "unknown flag", args: []string{"add", "milk", "-nope"}, code: exitUsage},
+		{name: "too few arguments", args: []string{"add"}, code: exitUsage},
+		{name: "too many arguments", args: []string{"get", "a", "b"}, code: exitUsage},
+		{name: "no arguments allowed", args: []string{"sync", "now"}, code: exitUsage},
+		{name: "usage error from the command", args: []string{"edit", uuid.NewString()}, code: exitUsage},
+		{name: "success", args: []string{"add", "-priority", "High", "buy", "milk"}, code: 0},
+		{name: "any number of arguments", args: []string{"list"}, code: 0},
+		{name: "failure", args: []string{"get", uuid.NewString()}, code: exitFailure},
+		{name: "unknown id", args: []string{"done", "ffffffff"}, code: exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := cliParse(append(append([]string{}, global...), tt.args...)); code != tt.code {
+				t.Errorf("Expected: %d, Got: %d", tt.code, code)
+			}
+		})
+	}
+}
+
+func TestDoneAndEditPatchOnlyTheirFields(t *testing.T) {
+	ds := datastores.NewInMemDataStore()
+	srv := server.NewToDoServer(":0", make(chan bool), ds)
+	var mu sync.Mutex
+	var patches []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			body, _ := io.ReadAll(r.Body)
+			var patch map[string]interface{}
+			json.Unmarshal(body, &patch)
+			mu.Lock()
+			patches = append(patches, patch)
+			mu.Unlock()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		srv.Handler().ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	global := []string{"-server", ts.URL, "-user-id", "alice", "-cache", filepath.Join(t.TempDir(), "cache.json")}
+	run := func(args ...string) int {
+		return cliParse(append(append([]string{}, global...), args...))
+	}
+
+	item, _ := ds.AddItem(models.ToDo{UserId: "alice", Title: "Pay rent", Priority: "Low"})
+	if code := run("get", item.Id.String()); code != 0 {
+		t.Fatalf("Expected get to cache the item, Got: %d", code)
+	}
+	// Someone else changes the item after it was read.
+	ds.ModifyItem("alice", item.Id, func(current models.ToDo) (models.ToDo, error) {
+		current.Title = "Pay the rent"
+		return current, nil
+	})
+
+	if code := run("done", item.Id.String()); code != 0 {
+		t.Fatalf("Expected done to succeed, Got: %d", code)
+	}
+	if code := run("edit", item.Id.String(), "-priority", "High", "-description", ""); code != 0 {
+		t.Fatalf("Expected edit to succeed, Got: %d", code)
+	}
+	expected := []map[string]interface{}{
+		{"status": "done", "complete": true},
+		{"priority": "High", "description": nil},
+	}
+	if !reflect.DeepEqual(patches, expected) {
+		t.Errorf("Expected: %v, Got: %v", expected, patches)
+	}
+	stored, _ := ds.GetItem("alice", item.Id)
+	if stored.Title != "Pay the rent" || stored.Status != models.StatusDone || stored.Priority != "High" {
+		t.Errorf("Expected the other change to be kept, Got: %+v", stored)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"go-to-do-app/to-do-lib/apiclient"
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+var commands = []command{
+	{name: "add", args: "<title>...", summary: "Add a ToDo with the words given as its title", minArgs: 1, maxArgs: -1, setup: setupAdd},
+	{name: "get", args: "<id>", summary: "Show every field of a ToDo", minArgs: 1, maxArgs: 1, setup: setupGet},
+	{name: "list", args: "[query]...", summary: `List ToDos, all of them or those matching a search query, e.g. priority:high -complete title:"release notes". Put "--" before a query that starts with '-'`, maxArgs: -1, flagsFirst: true, setup: setupList},
+	{name: "edit", args: "<id>", summary: "Change the fields of a ToDo given as flags; an empty value clears an optional field", minArgs: 1, maxArgs: 1, setup: setupEdit},
+	{name: "done", args: "<id>...", summary: "Mark ToDos done", minArgs: 1, maxArgs: -1, setup: setupDone},
+	{name: "rm", args: "<id>...", summary: "Delete ToDos", minArgs: 1, maxArgs: -1, setup: setupRm},
+	{name: "next", summary: "List open ToDos in the order they can be done, blockers first (v3)", setup: setupNext},
+	{name: "lists", summary: "List the user's lists (v3)", setup: setupLists},
+	{name: "sync", summary: "Send the changes queued while offline to the server and refresh the cache", setup: setupSync},
+	{name: "issue-key", args: "<user-id>", summary: "Issue an API key for a user, with an admin -api-key", minArgs: 1, maxArgs: 1, setup: setupIssueKey},
+	{name: "revoke-key", args: "<key-id>", summary: "Revoke an API key, with an admin -api-key", minArgs: 1, maxArgs: 1, setup: setupRevokeKey},
+}
+
+// itemFlags are the flags that set the fields of a ToDo, shared by add and
+// edit.
+type itemFlags struct {
+	fs          *flag.FlagSet
+	priority    *string
+	status      *string
+	description *string
+	due         *string
+	tz          *string
+	tags        *string
+	parent      *string
+	listId      *string
+	blockedBy   *string
+	repeat      *string
+}
+
+func newItemFlags(fs *flag.FlagSet, priority string) *itemFlags {
+	return &itemFlags{
+		fs:          fs,
+		priority:    fs.String("priority", priority, "Priority: Low, Medium or High"),
+		status:      fs.String("status", "", "Status: todo, in-progress, blocked, done or cancelled (v3)"),
+		description: fs.String("description", "", "Description (v3)"),
+		due:         fs.String("due", "", "Due date as RFC 3339, YYYY-MM-DDTHH:MM or YYYY-MM-DD (v3)"),
+		tz:          fs.String("tz", "Local", "IANA time zone of -due when it has no offset"),
+		tags:        fs.String("tags", "", "Comma separated tags (v3)"),
+		parent:      fs.String("parent", "", "Id of the ToDo this one is a subtask of (v3)"),
+		listId:      fs.String("list-id", "", "UUID of the list the ToDo is in (v3)"),
+		blockedBy:   fs.String("blocked-by", "", "Comma separated ids of the ToDos that block this one (v3)"),
+		repeat:      fs.String("repeat", "", "Recurrence rule, e.g. FREQ=WEEKLY;BYDAY=MO,TH;UNTIL=2025-12-31 (v3)"),
+	}
+}
+
+// apply sets the fields of item whose flags were given. Older API versions
+// ignore the v3 fields.
+func (f *itemFlags) apply(a *app, item *models.ToDo) error {
+	var err error
+	f.fs.Visit(func(fl *flag.Flag) {
+		if err != nil {
+			return
+		}
+		switch fl.Name {
+		case "priority":
+			item.Priority = *f.priority
+		case "status":
+			item.Status = *f.status
+		case "description":
+			item.Description = *f.description
+		case "due":
+			item.DueDate, err = models.ParseDueDate(*f.due, *f.tz)
+		case "tags":
+			item.Tags = models.ParseTags(*f.tags)
+		case "parent":
+			item.ParentId = nil
+			if *f.parent != "" {
+				var parentId uuid.UUID
+				if parentId, err = a.resolveId(*f.parent); err == nil {
+					item.ParentId = &parentId
+				}
+			}
+		case "list-id":
+			item.ListId = uuid.Nil
+			if *f.listId != "" {
+				if item.ListId, err = uuid.Parse(*f.listId); err != nil {
+					err = &todoerrors.ValidationError{Field: "list-id", Err: err}
+				}
+			}
+		case "blocked-by":
+			item.BlockedBy = nil
+			for _, blocker := range models.ParseTags(*f.blockedBy) {
+				var blockerId uuid.UUID
+				if blockerId, err = a.resolveId(strings.TrimSpace(blocker)); err != nil {
+					return
+				}
+				item.BlockedBy = append(item.BlockedBy, blockerId)
+			}
+		case "repeat":
+			item.Recurrence, err = models.ParseRecurrence(*f.repeat)
+		}
+	})
+	return err
+}
+
+// patchKeys maps the flags that set a field to the field's name in a patch.
+var patchKeys = map[string]string{
+	"priority":    "priority",
+	"status":      "status",
+	"description": "description",
+	"due":         "due_date",
+	"tags":        "tags",
+	"parent":      "parent_id",
+	"list-id":     "list_id",
+	"blocked-by":  "blocked_by",
+	"repeat":      "recurrence",
+}
+
+// patch adds the fields whose flags were given to patch, set as apply sets
+// them. Cleared fields are null, which removes them.
+func (f *itemFlags) patch(a *app, patch map[string]interface{}) error {
+	var item models.ToDo
+	if err := f.apply(a, &item); err != nil {
+		return err
+	}
+	fields, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(fields, &values); err != nil {
+		return err
+	}
+	f.fs.Visit(func(fl *flag.Flag) {
+		if key, ok := patchKeys[fl.Name]; ok {
+			patch[key] = values[key]
+		}
+	})
+	return nil
+}
+
+// change changes the fields of a ToDo in patch, leaving the others as they are
+// on the server. v1 cannot patch, so there the whole ToDo is read, changed by
+// apply and written back.
+func (a *app) change(ctx context.Context, id uuid.UUID, patch map[string]interface{}, apply func(item *models.ToDo) error) (models.ToDo, bool, error) {
+	if a.client.Version != "v1" {
+		return a.local.Patch(ctx, *userId, id, patch)
+	}
+	item, _, err := a.local.Get(ctx, *userId, id)
+	if err != nil {
+		return models.ToDo{}, false, err
+	}
+	if err := apply(&item); err != nil {
+		return models.ToDo{}, false, err
+	}
+	return a.local.Update(ctx, item)
+}
+
+func setupAdd(fs *flag.FlagSet) func(context.Context, *app, []string) error {
+	fields := newItemFlags(fs, models.PriorityMedium)
+	return func(ctx context.Context, a *app, args []string) error {
+		item := models.ToDo{UserId: *userId, Title: strings.Join(args, " "), Priority: *fields.priority}
+		if err := fields.apply(a, &item); err != nil {
+			return err
+		}
+		saved, queued, err := a.local.Create(ctx, item)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added %s\n", describe(saved))
+		noteQueued(queued)
+		return nil
+	}
+}
+
+func setupGet(fs *flag.FlagSet) func(context.Context, *app, []string) error {
+	return func(ctx context.Context, a *app, args []string) error {
+		id, err := a.resolveId(args[0])
+		if err != nil {
+			return err
+		}
+		item, stale, err := a.local.Get(ctx, *userId, id)
+		if err != nil {
+			return err
+		}
+		printDetails(item)
+		noteStale(stale)
+		return nil
+	}
+}
+
+func setupList(fs *flag.FlagSet) func(context.Context, *app, []string) error {
+	parent := fs.String("parent", "", "List only the subtasks of this ToDo (v3)")
+	listId := fs.String("list-id", "", "List only the ToDos in the list with this UUID (v3)")
+	return func(ctx context.Context, a *app, args []string) error {
+		opts := apiclient.ListOptions{Query: strings.Join(args, " ")}
+		if *parent != "" {
+			parentId, err := a.resolveId(*parent)
+			if err != nil {
+				return err
+			}
+			opts.ParentId = &parentId
+		}
+		if *listId != "" {
+			inList, err := uuid.Parse(*listId)
+			if err != nil {
+				return &todoerrors.ValidationError{Field: "list-id", Err: err}
+			}
+			opts.ListId = &inList
+		}
+		var all []models.ToDo
+		for {
+			items, cursor, stale, err := a.local.List(ctx, *userId, opts)
+			if err != nil {
+				return err
+			}
+			all = append(all, items...)
+			if cursor == "" {
+				printTable(all)
+				noteStale(stale)
+				return nil
+			}
+			opts.Cursor = cursor
+		}
+	}
+}
+
+func setupEdit(fs *flag.FlagSet) func(context.Context, *app, []string) error {
+	title := fs.String("title", "", "Title")
+	fields := newItemFlags(fs, "")
+	return func(ctx context.Context, a *app, args []string) error {
+		if fs.NFlag() == 0 {
+			return usageErrorf("edit needs at least one field to change")
+		}
+		id, err := a.resolveId(args[0])
+		if err != nil {
+			return err
+		}
+		patch := make(map[string]interface{})
+		fs.Visit(func(fl *flag.Flag) {
+			if fl.Name == "title" {
+				patch["title"] = *title
+			}
+		})
+		if err := fields.patch(a, patch); err != nil {
+			return err
+		}
+		saved, queued, err := a.change(ctx, id, patch, func(item *models.ToDo) error {
+			if _, ok := patch["title"]; ok {
+				item.Title = *title
+			}
+			return fields.apply(a, item)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Updated %s\n", describe(saved))
+		noteQueued(queued)
+		return nil
+	}
+}
+
+func setupDone(fs *flag.FlagSet) func(context.Context, *app, []string) error {
+	return func(ctx context.Context, a *app, args []string) error {
+		return eachId(a, args, func(id uuid.UUID) error {
+			patch := map[string]interface{}{"status": models.StatusDone, "complete": true}
+			saved, queued, err := a.change(ctx, id, patch, func(item *models.ToDo) error {
+				item.Status = models.StatusDone
+				item.Complete = true
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Done %s\n", describe(saved))
+			noteQueued(queued)
+			return nil
+		})
+	}
+}
+
+func setupRm(fs *flag.FlagSet) func(context.Context, *app, []string) error {
+	return func(ctx context.Context, a *app, args []string) error {
+		return eachId(a, args, func(id uuid.UUID) error {
+			item, ok := a.local.Cache().Get(*userId, id)
+			if !ok {
+				item = models.ToDo{Id: id}
+			}
+			queued, err := a.local.Delete(ctx, *userId, id)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Deleted %s\n", describe(item))
+			noteQueued(queued)
+			return nil
+		})
+	}
+}
+
+// eachId runs do for the ToDo of each argument, carrying on past failures.
+// It returns them all.
+func eachId(a *app, args []string, do func(id uuid.UUID) error) error {
+	var errs []error
+	for _, arg := range args {
+		id, err := a.resolveId(arg)
+		if err == nil {
+			err = do(id)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", arg, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func setupNext(fs *flag.FlagSet) func(context.Context, *app, []string) error {
+	limit := fs.Int("limit", 0, "List at most this many ToDos; 0 lists them all")
+	return func(ctx context.Context, a *app, args []string) error {
+		items, err := a.client.Next(ctx, *userId, *limit)
+		if err != nil {
+			return err
+		}
+		printTable(items)
+		return nil
+	}
+}
+
+func setupLists(fs *flag.FlagSet) func(context.Context, *app, []string) error {
+	return func(ctx context.Context, a *app, args []string) error {
+		userLists, err := a.client.Lists(ctx, *userId)
+		if err != nil {
+			return err
+		}
+		if len(userLists) == 0 {
+			fmt.Println("No lists.")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME")
+		for _, l := range userLists {
+			fmt.Fprintf(w, "%s\t%s\n", l.Id, l.Name)
+		}
+		return w.Flush()
+	}
+}
+
+func setupSync(fs *flag.FlagSet) func(context.Context, *app, []string) error {
+	return func(ctx context.Context, a *app, args []string) error {
+		report, err := a.local.Sync(ctx, *userId)
+		printReport(report)
+		if err != nil {
+			return err
+		}
+		if len(report.Conflicts) > 0 {
+			return fmt.Errorf("%d of the queued changes conflicted with the server and were dropped", len(report.Conflicts))
+		}
+		return nil
+	}
+}
+
+func setupIssueKey(fs *flag.FlagSet) func(context.Context, *app, []string) error {
+	admin := fs.Bool("admin", false, "Issue an admin key")
+	return func(ctx context.Context, a *app, args []string) error {
+		keyId, secret, err := a.client.IssueKey(ctx, args[0], *admin)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("id:  %s\nkey: %s\n", keyId, secret)
+		return nil
+	}
+}
+
+func setupRevokeKey(fs *flag.FlagSet) func(context.Context, *app, []string) error {
+	return func(ctx context.Context, a *app, args []string) error {
+		if err := a.client.RevokeKey(ctx, args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked key %s\n", args[0])
+		return nil
+	}
+}
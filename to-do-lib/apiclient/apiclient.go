@@ -4,63 +4,405 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"go-to-do-app/to-do-lib/auth"
+	"go-to-do-app/to-do-lib/datastores"
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/mergepatch"
 	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
 )
 
+// DefaultVersion is the API version a client uses when Version is empty.
+const DefaultVersion = "v3"
+
+// DefaultTimeout bounds each request of a client made by NewAPIClient.
+const DefaultTimeout = 30 * time.Second
+
 type APIClient struct {
-	BaseURL    string
-	httpClient *http.Client
-}
-
-func (c *APIClient) Req(
-	ctx context.Context,
-	m string,
-	initem models.ToDo, args map[string]string) (models.ToDo, error) {
-
-	var apiURL string
-	var req *http.Request
-	var itemIn models.ToDo
-	var buffer []byte
-	var err error
-	userid := args["user-id"]
-	itemid := args["id"]
-	version := args["version"]
-	title := args["title"]
-	priority := args["priority"]
-	complete := args["complete"] == "true"
-	fmt.Println(complete, m)
-	if m == http.MethodGet {
-		apiURL = fmt.Sprintf("http://localhost:8081/%s/todo?user_id=%s&id=%s",
-			version, userid, itemid)
-	}
-	if m == http.MethodPut || m == http.MethodPost {
-		apiURL = fmt.Sprintf("http://localhost:8081/%s/todo", args["version"])
-		itemIn, err = models.NewToDo(&userid, &itemid, &title, &priority, &complete)
-		fmt.Println(itemIn)
-		if err != nil {
-			return models.ToDo{}, err
-		}
-		buffer, err = json.Marshal(itemIn)
-		if err != nil {
-			return models.ToDo{}, err
-		}
+	// BaseURL is where the server is, e.g. http://localhost:8081/.
+	BaseURL string
+	// Version is the API version of the ToDo methods, DefaultVersion if
+	// empty. v1 ToDos belong to no user, so their userId is ignored.
+	Version string
+	// APIKey is sent with every request when it is set. Servers started
+	// with -keys refuse requests without one.
+	APIKey string
+	// Token is sent as a bearer token with every request when it is set,
+	// for servers started with -jwks.
+	Token string
+	// HTTPClient sends the requests. Its Timeout bounds each request and its
+	// Transport, if set, replaces http.DefaultTransport.
+	HTTPClient *http.Client
+	// Retry says how requests that are safe to repeat are retried.
+	Retry RetryPolicy
+}
+
+// IdempotencyKeyHeader names a POST, so the server can tell a retry of it
+// from a new request.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// RetryPolicy retries GETs, HEADs and requests with an Idempotency-Key when
+// the server cannot be reached or answers that it is unavailable, with
+// exponential backoff: before retry n the client waits a random time of up to
+// BaseDelay * 2^(n-1), capped at MaxDelay, or longer if the server asks to with
+// Retry-After.
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt too. 0 and 1 disable retries.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy is the policy of clients made by NewAPIClient.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 4, BaseDelay: 250 * time.Millisecond, MaxDelay: 5 * time.Second}
+
+type idempotencyKeyContextKey struct{}
+
+// WithIdempotencyKey makes Create send key as its Idempotency-Key instead of
+// a new random one, so a create repeated later, e.g. by another run of a
+// program, still happens only once.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+// ListOptions narrows and pages List. Zero values are left out.
+type ListOptions struct {
+	// Query is a search query, e.g. priority:high -complete.
+	Query    string
+	Cursor   string
+	Limit    int
+	ParentId *uuid.UUID
+	ListId   *uuid.UUID
+}
+
+// StatusError is an error response whose status has no todoerrors type.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func NewAPIClient(baseURL string) APIClient {
+	return APIClient{BaseURL: baseURL, HTTPClient: &http.Client{Timeout: DefaultTimeout}, Retry: DefaultRetryPolicy}
+}
+
+// Create adds item for item.UserId. The server assigns its id. The request
+// carries an Idempotency-Key, so retrying it never adds the item twice.
+func (c *APIClient) Create(ctx context.Context, item models.ToDo) (models.ToDo, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, c.version()+"/todo", nil, item)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	key, _ := ctx.Value(idempotencyKeyContextKey{}).(string)
+	if key == "" {
+		key = uuid.NewString()
+	}
+	req.Header.Set(IdempotencyKeyHeader, key)
+	var created models.ToDo
+	return created, c.send(req, &created)
+}
+
+func (c *APIClient) Get(ctx context.Context, userId string, id uuid.UUID) (models.ToDo, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, c.version()+"/todo", c.itemParams(userId, id), nil)
+	if err != nil {
+		return models.ToDo{}, err
 	}
-	req, err = http.NewRequest(m, apiURL, bytes.NewBuffer(buffer))
 	var item models.ToDo
-	resp, err := c.httpClient.Do(req)
+	return item, c.send(req, &item)
+}
+
+// Update replaces the stored item with item. When item.Revision is set the
+// update only succeeds if the stored item is still at that revision, and
+// fails with a ConflictError otherwise.
+func (c *APIClient) Update(ctx context.Context, item models.ToDo) (models.ToDo, error) {
+	req, err := c.newRequest(ctx, http.MethodPut, c.version()+"/todo", nil, item)
 	if err != nil {
 		return models.ToDo{}, err
 	}
-	defer resp.Body.Close()
-	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+	if item.Revision != 0 {
+		req.Header.Set("If-Match", strconv.Quote(strconv.Itoa(item.Revision)))
+	}
+	var updated models.ToDo
+	return updated, c.send(req, &updated)
+}
+
+func (c *APIClient) Delete(ctx context.Context, userId string, id uuid.UUID) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, c.version()+"/todo", c.itemParams(userId, id), nil)
+	if err != nil {
+		return err
+	}
+	return c.send(req, nil)
+}
+
+// List returns a page of the user's ToDos. Pass the page's NextCursor in
+// opts.Cursor to get the next one.
+func (c *APIClient) List(ctx context.Context, userId string, opts ListOptions) (datastores.ItemPage, error) {
+	params := url.Values{"user_id": {userId}}
+	if opts.Query != "" {
+		params.Set("q", opts.Query)
+	}
+	if opts.Cursor != "" {
+		params.Set("cursor", opts.Cursor)
+	}
+	if opts.Limit > 0 {
+		params.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.ParentId != nil {
+		params.Set("parent_id", opts.ParentId.String())
+	}
+	if opts.ListId != nil {
+		params.Set("list_id", opts.ListId.String())
+	}
+	var page datastores.ItemPage
+	req, err := c.newRequest(ctx, http.MethodGet, c.version()+"/todos", params, nil)
+	if err != nil {
+		return page, err
+	}
+	return page, c.send(req, &page)
+}
+
+// Next returns the user's open ToDos in the order they can be worked on. A
+// positive limit cuts the list short.
+func (c *APIClient) Next(ctx context.Context, userId string, limit int) ([]models.ToDo, error) {
+	params := url.Values{"user_id": {userId}}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, c.version()+"/todos/next", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	var page datastores.ItemPage
+	return page.Items, c.send(req, &page)
+}
+
+// Lists returns the user's lists, the default list first.
+func (c *APIClient) Lists(ctx context.Context, userId string) ([]models.List, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, c.version()+"/lists", url.Values{"user_id": {userId}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var lists struct {
+		Items []models.List `json:"items"`
+	}
+	return lists.Items, c.send(req, &lists)
+}
+
+// Patch changes only the fields present in patch, leaving the rest of the
+// ToDo as stored on the server. A nil value clears a field.
+func (c *APIClient) Patch(ctx context.Context, userId string, id uuid.UUID, patch map[string]interface{}) (models.ToDo, error) {
+	req, err := c.newRequest(ctx, http.MethodPatch, c.version()+"/todo", c.itemParams(userId, id), patch)
+	if err != nil {
 		return models.ToDo{}, err
 	}
-	return item, nil
+	req.Header.Set("Content-Type", mergepatch.ContentType)
+	var item models.ToDo
+	return item, c.send(req, &item)
 }
 
-func NewAPIClient(baseURL string) APIClient {
-	return APIClient{BaseURL: baseURL, httpClient: &http.Client{}}
+// IssueKey asks the server for a new API key for userId. The client's own key
+// must be an admin key. The returned secret is not shown again.
+func (c *APIClient) IssueKey(ctx context.Context, userId string, admin bool) (id string, secret string, err error) {
+	req, err := c.newRequest(ctx, http.MethodPost, "admin/keys", nil, map[string]interface{}{"user_id": userId, "admin": admin})
+	if err != nil {
+		return "", "", err
+	}
+	var key struct {
+		Id  string `json:"id"`
+		Key string `json:"key"`
+	}
+	err = c.send(req, &key)
+	return key.Id, key.Key, err
+}
+
+// RevokeKey revokes the API key with the given id. The client's own key must
+// be an admin key.
+func (c *APIClient) RevokeKey(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "admin/keys", url.Values{"id": {id}}, nil)
+	if err != nil {
+		return err
+	}
+	return c.send(req, nil)
+}
+
+func (c *APIClient) version() string {
+	if c.Version == "" {
+		return DefaultVersion
+	}
+	return c.Version
+}
+
+// itemParams names one ToDo in a query string.
+func (c *APIClient) itemParams(userId string, id uuid.UUID) url.Values {
+	params := url.Values{"id": {id.String()}}
+	if c.version() != "v1" {
+		params.Set("user_id", userId)
+	}
+	return params
+}
+
+// newRequest makes a request for path under BaseURL, with body encoded as
+// JSON unless it is nil.
+func (c *APIClient) newRequest(ctx context.Context, method string, path string, params url.Values, body interface{}) (*http.Request, error) {
+	apiURL := strings.TrimSuffix(c.BaseURL, "/") + "/" + path
+	if len(params) > 0 {
+		apiURL += "?" + params.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// send sends req and decodes a successful response into out, unless it is
+// nil. Error responses are returned as todoerrors types.
+func (c *APIClient) send(req *http.Request, out interface{}) error {
+	if c.APIKey != "" {
+		req.Header.Set(auth.APIKeyHeader, c.APIKey)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errorFromResponse(resp)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return err
+	}
+	// v1 and v2 ToDos only carry their revision in the ETag.
+	if item, ok := out.(*models.ToDo); ok && item.Revision == 0 {
+		item.Revision, _ = strconv.Atoi(strings.Trim(resp.Header.Get("ETag"), `"`))
+	}
+	return nil
+}
+
+// do sends req, retrying it as c.Retry says if it is safe to repeat.
+func (c *APIClient) do(req *http.Request) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	idempotent := req.Header.Get(IdempotencyKeyHeader) != ""
+	repeatable := req.Method == http.MethodGet || req.Method == http.MethodHead || idempotent
+	for attempt := 1; ; attempt++ {
+		resp, err := httpClient.Do(req)
+		if !repeatable || attempt >= c.Retry.MaxAttempts || req.Context().Err() != nil || !shouldRetry(resp, err, idempotent) {
+			return resp, err
+		}
+		wait := c.Retry.backoff(attempt)
+		if resp != nil {
+			if after, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(after)*time.Second > wait {
+				wait = min(time.Duration(after)*time.Second, c.Retry.MaxDelay)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// shouldRetry reports whether a request failed in a way that may pass when
+// repeated: the server could not be reached or was unavailable, or, for a
+// request with an Idempotency-Key, is still handling an earlier attempt.
+func shouldRetry(resp *http.Response, err error, idempotent bool) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusConflict:
+		return idempotent
+	}
+	return false
+}
+
+// backoff returns how long to wait before retrying after attempt failed.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	limit := p.MaxDelay
+	if shift := attempt - 1; shift < 32 && p.BaseDelay<<shift > 0 && p.BaseDelay<<shift < limit {
+		limit = p.BaseDelay << shift
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return rand.N(limit) + 1
+}
+
+// errorFromResponse turns an error response, whose body is {"error": ...},
+// into the todoerrors type the server reported it as.
+func errorFromResponse(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+		body.Error = resp.Status
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return &todoerrors.NotFoundError{Message: body.Error}
+	case http.StatusBadRequest:
+		// Validation errors read "Validation error on field <field>: <error>",
+		// after "Invalid body: " when the body was at fault.
+		message := strings.TrimPrefix(body.Error, "Invalid body: ")
+		if rest, ok := strings.CutPrefix(message, "Validation error on field "); ok {
+			if field, message, ok := strings.Cut(rest, ": "); ok {
+				return &todoerrors.ValidationError{Field: field, Err: errors.New(message)}
+			}
+		}
+		return &todoerrors.ValidationError{Err: errors.New(body.Error)}
+	case http.StatusPreconditionFailed:
+		return &todoerrors.ConflictError{Message: body.Error}
+	case http.StatusForbidden:
+		return &todoerrors.ForbiddenError{Message: body.Error}
+	case http.StatusUnauthorized:
+		return &todoerrors.UnauthorizedError{Message: body.Error}
+	default:
+		return &StatusError{StatusCode: resp.StatusCode, Message: body.Error}
+	}
 }
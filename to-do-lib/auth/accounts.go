@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are hashed with bcrypt, which only reads the first 72 bytes, so
+// longer passwords are refused rather than silently cut short.
+const (
+	MinPassword = 8
+	MaxPassword = 72
+)
+
+// Account is a user of the web UI. Its Username is the user_id of its ToDos.
+type Account struct {
+	Username  string    `json:"username"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AccountStore holds the accounts that can log in to the web UI. Like a
+// KeyStore, one with a path saves every change to it.
+type AccountStore struct {
+	mu       sync.RWMutex
+	path     string
+	accounts map[string]Account
+	// dummy is compared against when a username does not exist, so a failed
+	// login takes as long whether or not the account exists.
+	dummy []byte
+}
+
+type accountFile struct {
+	Accounts []Account `json:"accounts"`
+}
+
+func NewAccountStore() *AccountStore {
+	dummy, _ := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	return &AccountStore{accounts: make(map[string]Account), dummy: dummy}
+}
+
+// OpenAccountStore loads the accounts saved at path. A missing file is an
+// empty store that is created on the first change.
+func OpenAccountStore(path string) (*AccountStore, error) {
+	as := NewAccountStore()
+	as.path = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return as, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file accountFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+	for _, account := range file.Accounts {
+		as.accounts[account.Username] = account
+	}
+	return as, nil
+}
+
+// SetPassword creates the account username, or changes its password if it
+// exists.
+func (as *AccountStore) SetPassword(username string, password string) error {
+	if strings.TrimSpace(username) == "" || strings.TrimSpace(username) != username {
+		return &todoerrors.ValidationError{Field: "username", Err: errors.New("invalid username")}
+	}
+	if len(password) < MinPassword || len(password) > MaxPassword {
+		return &todoerrors.ValidationError{
+			Field: "password",
+			Err:   fmt.Errorf("passwords are %d to %d bytes long", MinPassword, MaxPassword),
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	previous, existed := as.accounts[username]
+	account := Account{Username: username, Hash: string(hash), CreatedAt: time.Now().UTC()}
+	if existed {
+		account.CreatedAt = previous.CreatedAt
+	}
+	as.accounts[username] = account
+	if err := as.save(); err != nil {
+		if existed {
+			as.accounts[username] = previous
+		} else {
+			delete(as.accounts, username)
+		}
+		return err
+	}
+	return nil
+}
+
+// Login checks the password of username. Unknown users and wrong passwords
+// fail with the same UnauthorizedError.
+func (as *AccountStore) Login(username string, password string) error {
+	as.mu.RLock()
+	account, exists := as.accounts[username]
+	as.mu.RUnlock()
+	hash := as.dummy
+	if exists {
+		hash = []byte(account.Hash)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !exists {
+		return &todoerrors.UnauthorizedError{Message: "wrong username or password"}
+	}
+	return nil
+}
+
+// save writes the accounts to path. The caller holds as.mu.
+func (as *AccountStore) save() error {
+	if as.path == "" {
+		return nil
+	}
+	file := accountFile{Accounts: make([]Account, 0, len(as.accounts))}
+	for _, account := range as.accounts {
+		file.Accounts = append(file.Accounts, account)
+	}
+	slices.SortFunc(file.Accounts, func(a, b Account) int { return strings.Compare(a.Username, b.Username) })
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(as.path, b)
+}
@@ -0,0 +1,58 @@
+package auth_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go-to-do-app/to-do-lib/auth"
+)
+
+func TestAccounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	accounts, _ := auth.OpenAccountStore(path)
+	for _, bad := range [][2]string{{"", "long enough"}, {" alice", "long enough"}, {"alice", "short"}, {"alice", strings.Repeat("x", auth.MaxPassword+1)}} {
+		if err := accounts.SetPassword(bad[0], bad[1]); err == nil {
+			t.Errorf("Expected %q with password %q to be refused", bad[0], bad[1])
+		}
+	}
+	if err := accounts.SetPassword("alice", "correct horse"); err != nil {
+		t.Fatalf("failed to add account: %s", err)
+	}
+
+	reopened, err := auth.OpenAccountStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen accounts: %s", err)
+	}
+	if err := reopened.Login("alice", "correct horse"); err != nil {
+		t.Errorf("Expected the right password to log in, Got: %s", err)
+	}
+	for _, bad := range [][2]string{{"alice", "wrong horse"}, {"bob", "correct horse"}} {
+		if err := reopened.Login(bad[0], bad[1]); err == nil {
+			t.Errorf("Expected %s with %q to be refused", bad[0], bad[1])
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	now := time.Now()
+	sessions := auth.NewSessions(time.Hour)
+	session, err := sessions.Start("alice", now)
+	if err != nil {
+		t.Fatalf("failed to start session: %s", err)
+	}
+	if got, ok := sessions.Get(session.Id, now.Add(time.Minute)); !ok || got.UserId != "alice" {
+		t.Errorf("Expected: %+v, Got: %+v", session, got)
+	}
+	if !session.CheckCSRF(session.CSRF) || session.CheckCSRF("") || session.CheckCSRF(session.Id) {
+		t.Errorf("Expected only the session's CSRF token to pass")
+	}
+	if _, ok := sessions.Get(session.Id, now.Add(time.Hour)); ok {
+		t.Errorf("Expected the session to expire")
+	}
+	sessions.End(session.Id)
+	if _, ok := sessions.Get(session.Id, now); ok {
+		t.Errorf("Expected the session to end")
+	}
+}
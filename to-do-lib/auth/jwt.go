@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+)
+
+// Scopes a token can carry. Reading needs ScopeRead and every change needs
+// ScopeWrite; neither implies the other.
+const (
+	ScopeRead  = "todo:read"
+	ScopeWrite = "todo:write"
+)
+
+// Signing algorithms, as named in the alg header of a token and of a JWK.
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// Leeway is how far clocks may disagree when checking exp and nbf.
+const Leeway = 30 * time.Second
+
+// Claims are the registered claims a token must carry, and its scopes as a
+// space separated list as in RFC 9068. Times are seconds since the epoch.
+type Claims struct {
+	Subject   string `json:"sub"`
+	Scope     string `json:"scope,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func (c Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// JWK is one key of a JWKS file (RFC 7517). HS256 keys are symmetric and keep
+// their secret in K; Ed25519 keys keep their public key in X and, on the
+// machine that mints tokens, their private seed in D.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	K   string `json:"k,omitempty"`
+	X   string `json:"x,omitempty"`
+	D   string `json:"d,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// GenerateJWK makes a new random key for alg with a random kid.
+func GenerateJWK(alg string) (JWK, error) {
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return JWK{}, err
+	}
+	key := JWK{Kid: base64.RawURLEncoding.EncodeToString(kid), Alg: alg}
+	switch alg {
+	case AlgHS256:
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return JWK{}, err
+		}
+		key.Kty, key.K = "oct", base64.RawURLEncoding.EncodeToString(secret)
+	case AlgEdDSA:
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return JWK{}, err
+		}
+		key.Kty, key.Crv = "OKP", "Ed25519"
+		key.X = base64.RawURLEncoding.EncodeToString(public)
+		key.D = base64.RawURLEncoding.EncodeToString(private.Seed())
+	default:
+		return JWK{}, fmt.Errorf("unsupported alg: %s. Valid options are: %s, %s", alg, AlgHS256, AlgEdDSA)
+	}
+	return key, nil
+}
+
+// LoadJWKS reads a JWKS file. A missing file has no keys.
+func LoadJWKS(path string) (JWKS, error) {
+	var set JWKS
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return set, nil
+	}
+	if err != nil {
+		return set, err
+	}
+	err = json.Unmarshal(b, &set)
+	return set, err
+}
+
+func SaveJWKS(path string, set JWKS) error {
+	b, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, b)
+}
+
+// signingKey is a JWK decoded for use.
+type signingKey struct {
+	alg     string
+	secret  []byte
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+func decodeJWK(key JWK) (signingKey, error) {
+	bad := func(field string) error { return fmt.Errorf("key %q: invalid %s", key.Kid, field) }
+	switch {
+	case key.Kid == "":
+		return signingKey{}, errors.New("every key needs a kid")
+	case key.Alg == AlgHS256 && key.Kty == "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(key.K)
+		if err != nil || len(secret) < 32 {
+			return signingKey{}, bad("k")
+		}
+		return signingKey{alg: AlgHS256, secret: secret}, nil
+	case key.Alg == AlgEdDSA && key.Kty == "OKP" && key.Crv == "Ed25519":
+		public, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil || len(public) != ed25519.PublicKeySize {
+			return signingKey{}, bad("x")
+		}
+		sk := signingKey{alg: AlgEdDSA, public: public}
+		if key.D != "" {
+			seed, err := base64.RawURLEncoding.DecodeString(key.D)
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return signingKey{}, bad("d")
+			}
+			sk.private = ed25519.NewKeyFromSeed(seed)
+		}
+		return sk, nil
+	}
+	return signingKey{}, fmt.Errorf("key %q: unsupported kty %q and alg %q", key.Kid, key.Kty, key.Alg)
+}
+
+// KeySet signs and verifies tokens with the keys of a JWKS file. Every key in
+// the file verifies tokens and the last one that can sign signs new ones, so
+// keys are rotated by appending a new key and, once the tokens it signed have
+// expired, removing the old one. The file is read again whenever it changes.
+type KeySet struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	keys    map[string]signingKey
+	signer  string
+}
+
+// OpenKeySet loads the JWKS file at path, which must hold at least one key.
+func OpenKeySet(path string) (*KeySet, error) {
+	ks := &KeySet{path: path}
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// reload reads the file again if it changed since it was last read.
+func (ks *KeySet) reload() error {
+	info, err := os.Stat(ks.path)
+	if err != nil {
+		return err
+	}
+	ks.mu.RLock()
+	current := info.ModTime().Equal(ks.modTime) && ks.keys != nil
+	ks.mu.RUnlock()
+	if current {
+		return nil
+	}
+	set, err := LoadJWKS(ks.path)
+	if err != nil {
+		return err
+	}
+	if len(set.Keys) == 0 {
+		return fmt.Errorf("%s has no keys", ks.path)
+	}
+	keys := make(map[string]signingKey, len(set.Keys))
+	signer := ""
+	for _, jwk := range set.Keys {
+		key, err := decodeJWK(jwk)
+		if err != nil {
+			return err
+		}
+		keys[jwk.Kid] = key
+		if key.secret != nil || key.private != nil {
+			signer = jwk.Kid
+		}
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys, ks.signer, ks.modTime = keys, signer, info.ModTime()
+	return nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Sign mints a token carrying claims with the newest signing key.
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	if err := ks.reload(); err != nil {
+		return "", err
+	}
+	ks.mu.RLock()
+	kid := ks.signer
+	key := ks.keys[kid]
+	ks.mu.RUnlock()
+	if kid == "" {
+		return "", errors.New("no key in the set can sign tokens")
+	}
+	h, err := json.Marshal(header{Alg: key.alg, Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	var sig []byte
+	if key.alg == AlgHS256 {
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	} else {
+		sig = ed25519.Sign(key.private, []byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verify checks the signature of token and that it is valid at now, and
+// returns its claims. The alg of the token must be the alg of the key its kid
+// names, so a token cannot pick a weaker algorithm, such as "none".
+func (ks *KeySet) Verify(token string, now time.Time) (Claims, error) {
+	invalid := func(reason string) (Claims, error) {
+		return Claims{}, &todoerrors.UnauthorizedError{Message: "invalid token: " + reason}
+	}
+	if err := ks.reload(); err != nil {
+		return Claims{}, err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return invalid("malformed")
+	}
+	var h header
+	if raw, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(raw, &h) != nil {
+		return invalid("malformed header")
+	}
+	ks.mu.RLock()
+	key, exists := ks.keys[h.Kid]
+	ks.mu.RUnlock()
+	if !exists {
+		return invalid("unknown kid")
+	}
+	if h.Alg != key.alg {
+		return invalid("alg does not match the key")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return invalid("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if key.alg == AlgHS256 {
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return invalid("bad signature")
+		}
+	} else if !ed25519.Verify(key.public, signed, sig) {
+		return invalid("bad signature")
+	}
+	var claims Claims
+	if raw, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(raw, &claims) != nil {
+		return invalid("malformed claims")
+	}
+	switch {
+	case claims.Subject == "":
+		return invalid("no sub")
+	case claims.ExpiresAt == 0:
+		return invalid("no exp")
+	case now.Add(-Leeway).Unix() >= claims.ExpiresAt:
+		return invalid("expired")
+	case claims.NotBefore != 0 && now.Add(Leeway).Unix() < claims.NotBefore:
+		return invalid("not valid yet")
+	}
+	return claims, nil
+}
+
+// HasScope reports whether scopes includes scope.
+func HasScope(scopes []string, scope string) bool {
+	return slices.Contains(scopes, scope)
+}
@@ -0,0 +1,99 @@
+package auth_test
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go-to-do-app/to-do-lib/auth"
+)
+
+func newKeySet(t *testing.T, algs ...string) (*auth.KeySet, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	var set auth.JWKS
+	for _, alg := range algs {
+		key, err := auth.GenerateJWK(alg)
+		if err != nil {
+			t.Fatalf("failed to generate %s key: %s", alg, err)
+		}
+		set.Keys = append(set.Keys, key)
+	}
+	if err := auth.SaveJWKS(path, set); err != nil {
+		t.Fatalf("failed to save keys: %s", err)
+	}
+	keys, err := auth.OpenKeySet(path)
+	if err != nil {
+		t.Fatalf("failed to open keys: %s", err)
+	}
+	return keys, path
+}
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	for _, alg := range []string{auth.AlgHS256, auth.AlgEdDSA} {
+		keys, _ := newKeySet(t, alg)
+		claims := auth.Claims{Subject: "alice", Scope: auth.ScopeRead, NotBefore: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()}
+		token, err := keys.Sign(claims)
+		if err != nil {
+			t.Fatalf("%s: failed to sign: %s", alg, err)
+		}
+		if got, err := keys.Verify(token, now); err != nil || got != claims {
+			t.Errorf("%s Expected: %+v, Got: %+v, %v", alg, claims, got, err)
+		}
+		for name, at := range map[string]time.Time{
+			"expired":       now.Add(time.Hour + auth.Leeway),
+			"not valid yet": now.Add(-time.Minute),
+		} {
+			if _, err := keys.Verify(token, at); err == nil {
+				t.Errorf("%s: Expected a token that is %s to be refused", alg, name)
+			}
+		}
+		parts := strings.Split(token, ".")
+		tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"bob","exp":9999999999}`)) + "." + parts[2]
+		if _, err := keys.Verify(tampered, now); err == nil {
+			t.Errorf("%s: Expected a tampered token to be refused", alg)
+		}
+		none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+		if _, err := keys.Verify(none, now); err == nil {
+			t.Errorf("%s: Expected an unsigned token to be refused", alg)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Now()
+	keys, path := newKeySet(t, auth.AlgHS256)
+	claims := auth.Claims{Subject: "alice", ExpiresAt: now.Add(time.Hour).Unix()}
+	old, _ := keys.Sign(claims)
+
+	set, _ := auth.LoadJWKS(path)
+	next, _ := auth.GenerateJWK(auth.AlgEdDSA)
+	set.Keys = append(set.Keys, next)
+	auth.SaveJWKS(path, set)
+	// Make sure the change is seen even on file systems with coarse times.
+	os.Chtimes(path, now.Add(time.Second), now.Add(time.Second))
+
+	rotated, err := keys.Sign(claims)
+	if err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	if strings.Split(rotated, ".")[0] == strings.Split(old, ".")[0] {
+		t.Errorf("Expected the new key to sign, Got: %s", rotated)
+	}
+	for _, token := range []string{old, rotated} {
+		if _, err := keys.Verify(token, now); err != nil {
+			t.Errorf("Expected tokens of both keys to verify, Got: %s", err)
+		}
+	}
+
+	set.Keys = set.Keys[1:]
+	auth.SaveJWKS(path, set)
+	os.Chtimes(path, now.Add(2*time.Second), now.Add(2*time.Second))
+	if _, err := keys.Verify(old, now); err == nil {
+		t.Errorf("Expected tokens of a removed key to be refused")
+	}
+}
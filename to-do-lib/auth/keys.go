@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+
+	"github.com/google/uuid"
+)
+
+// KeyPrefix starts every API key, so keys are easy to recognise in logs and
+// config files.
+const KeyPrefix = "tdk_"
+
+// APIKeyHeader carries the API key of a request.
+const APIKeyHeader = "X-API-Key"
+
+// Key is an issued API key. Only a hash of the secret is kept; the secret
+// itself is returned once, when the key is issued.
+type Key struct {
+	Id        uuid.UUID `json:"id"`
+	UserId    string    `json:"user_id"`
+	Admin     bool      `json:"admin,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// KeyStore holds the API keys a server accepts. A KeyStore with a path saves
+// every change to it; one without only keeps keys in memory.
+type KeyStore struct {
+	mu     sync.RWMutex
+	path   string
+	keys   map[uuid.UUID]Key
+	byHash map[string]uuid.UUID
+}
+
+type keyFile struct {
+	Keys []Key `json:"keys"`
+}
+
+func NewKeyStore() *KeyStore {
+	return &KeyStore{keys: make(map[uuid.UUID]Key), byHash: make(map[string]uuid.UUID)}
+}
+
+// OpenKeyStore loads the keys saved at path. A missing file is an empty store
+// that is created on the first change.
+func OpenKeyStore(path string) (*KeyStore, error) {
+	ks := NewKeyStore()
+	ks.path = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file keyFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+	for _, key := range file.Keys {
+		ks.keys[key.Id] = key
+		ks.byHash[key.Hash] = key.Id
+	}
+	return ks, nil
+}
+
+// Issue creates a key for userId and returns it with its secret.
+func (ks *KeyStore) Issue(userId string, admin bool) (Key, string, error) {
+	if strings.TrimSpace(userId) == "" {
+		return Key{}, "", &todoerrors.ValidationError{Field: "user_id", Err: errors.New("invalid user_id")}
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return Key{}, "", err
+	}
+	secret := KeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	key := Key{Id: uuid.New(), UserId: userId, Admin: admin, Hash: hashKey(secret), CreatedAt: time.Now().UTC()}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[key.Id] = key
+	ks.byHash[key.Hash] = key.Id
+	if err := ks.save(); err != nil {
+		delete(ks.keys, key.Id)
+		delete(ks.byHash, key.Hash)
+		return Key{}, "", err
+	}
+	return key, secret, nil
+}
+
+// Revoke deletes a key, so requests made with it are no longer accepted.
+func (ks *KeyStore) Revoke(id uuid.UUID) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	key, exists := ks.keys[id]
+	if !exists {
+		return &todoerrors.NotFoundError{Message: "Key Not Found"}
+	}
+	delete(ks.keys, id)
+	delete(ks.byHash, key.Hash)
+	if err := ks.save(); err != nil {
+		ks.keys[id] = key
+		ks.byHash[key.Hash] = id
+		return err
+	}
+	return nil
+}
+
+// Keys returns the keys of userId, or of every user if userId is empty, oldest
+// first.
+func (ks *KeyStore) Keys(userId string) []Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	keys := []Key{}
+	for _, key := range ks.keys {
+		if userId == "" || key.UserId == userId {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b Key) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Id.String(), b.Id.String())
+	})
+	return keys
+}
+
+// Authenticate returns the key whose secret is secret. Keys are looked up by
+// the hash of the secret, so the comparison never touches the secrets of
+// other keys.
+func (ks *KeyStore) Authenticate(secret string) (Key, error) {
+	if !strings.HasPrefix(secret, KeyPrefix) {
+		return Key{}, &todoerrors.UnauthorizedError{Message: "invalid API key"}
+	}
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if id, exists := ks.byHash[hashKey(secret)]; exists {
+		return ks.keys[id], nil
+	}
+	return Key{}, &todoerrors.UnauthorizedError{Message: "invalid API key"}
+}
+
+// hashKey hashes a secret for storage. Secrets are 256 random bits, so a
+// single unsalted SHA-256 is enough; a slow password hash would only slow
+// down every request.
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// save writes the keys to path. The caller holds ks.mu.
+func (ks *KeyStore) save() error {
+	if ks.path == "" {
+		return nil
+	}
+	file := keyFile{Keys: make([]Key, 0, len(ks.keys))}
+	for _, key := range ks.keys {
+		file.Keys = append(file.Keys, key)
+	}
+	slices.SortFunc(file.Keys, func(a, b Key) int { return strings.Compare(a.Id.String(), b.Id.String()) })
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(ks.path, b)
+}
+
+// writeFile writes b to a temporary file next to path and renames it over
+// path, so a crash never leaves a partial file. Key files hold secrets or
+// their hashes, so only the owner can read them.
+func writeFile(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
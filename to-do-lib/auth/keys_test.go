@@ -0,0 +1,52 @@
+package auth_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go-to-do-app/to-do-lib/auth"
+)
+
+func TestIssueAuthenticateRevoke(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys, err := auth.OpenKeyStore(path)
+	if err != nil {
+		t.Fatalf("failed to open key store: %s", err)
+	}
+	key, secret, err := keys.Issue("alice", false)
+	if err != nil || !strings.HasPrefix(secret, auth.KeyPrefix) {
+		t.Fatalf("Expected a key, Got: %q, %v", secret, err)
+	}
+	raw, _ := os.ReadFile(path)
+	if strings.Contains(string(raw), secret) {
+		t.Errorf("Expected only the hash of the key to be saved, Got: %s", raw)
+	}
+
+	reopened, err := auth.OpenKeyStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen key store: %s", err)
+	}
+	if got, err := reopened.Authenticate(secret); err != nil || got.Id != key.Id || got.UserId != "alice" {
+		t.Errorf("Expected: %+v, Got: %+v, %v", key, got, err)
+	}
+	for _, wrong := range []string{"", secret + "x", strings.TrimPrefix(secret, auth.KeyPrefix)} {
+		if _, err := reopened.Authenticate(wrong); err == nil {
+			t.Errorf("Expected %q to be refused", wrong)
+		}
+	}
+
+	if err := reopened.Revoke(key.Id); err != nil {
+		t.Fatalf("failed to revoke key: %s", err)
+	}
+	if _, err := reopened.Authenticate(secret); err == nil {
+		t.Errorf("Expected a revoked key to be refused")
+	}
+	if err := reopened.Revoke(key.Id); err == nil {
+		t.Errorf("Expected revoking a revoked key to fail")
+	}
+	if _, _, err := reopened.Issue(" ", false); err == nil {
+		t.Errorf("Expected a key without a user to be refused")
+	}
+}
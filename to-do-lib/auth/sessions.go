@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// Session is a logged in user of the web UI. Id is the secret kept in the
+// session cookie and CSRF the token every form of the session must send back.
+type Session struct {
+	Id        string
+	UserId    string
+	CSRF      string
+	ExpiresAt time.Time
+}
+
+// CheckCSRF reports whether token is the CSRF token of s.
+func (s Session) CheckCSRF(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRF)) == 1
+}
+
+// Sessions keeps the sessions of the web UI in memory, so restarting the
+// server logs everyone out. Sessions are indexed by the hash of their id, like
+// API keys.
+type Sessions struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]Session
+}
+
+// NewSessions makes a store whose sessions last ttl from when they start.
+func NewSessions(ttl time.Duration) *Sessions {
+	return &Sessions{ttl: ttl, sessions: make(map[string]Session)}
+}
+
+// RandomToken returns 256 random bits, base64url encoded.
+func RandomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// Start creates a session for userId.
+func (s *Sessions) Start(userId string, now time.Time) (Session, error) {
+	id, err := RandomToken()
+	if err != nil {
+		return Session{}, err
+	}
+	csrf, err := RandomToken()
+	if err != nil {
+		return Session{}, err
+	}
+	session := Session{Id: id, UserId: userId, CSRF: csrf, ExpiresAt: now.Add(s.ttl)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, other := range s.sessions {
+		if !now.Before(other.ExpiresAt) {
+			delete(s.sessions, key)
+		}
+	}
+	s.sessions[hashKey(id)] = session
+	return session, nil
+}
+
+// Get returns the session with id if it has not expired or ended.
+func (s *Sessions) Get(id string, now time.Time) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, exists := s.sessions[hashKey(id)]
+	if !exists || !now.Before(session.ExpiresAt) {
+		return Session{}, false
+	}
+	return session, true
+}
+
+// End logs a session out.
+func (s *Sessions) End(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, hashKey(id))
+}
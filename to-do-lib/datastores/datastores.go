@@ -1,14 +1,10 @@
 package datastores
 
 import (
-	"context"
-	"encoding/json"
-	"fmt"
-	"os"
+	"slices"
 	"sync"
 
 	todoerrors "go-to-do-app/to-do-lib/errors"
-	"go-to-do-app/to-do-lib/logging"
 	"go-to-do-app/to-do-lib/models"
 
 	"github.com/google/uuid"
@@ -30,144 +26,268 @@ import (
 type DataStore interface {
 	AddItem(item models.ToDo) (models.ToDo, error)
 	GetItem(userId string, itemId uuid.UUID) (models.ToDo, error)
+	ListItems(userId string, opts ListOptions) (ItemPage, error)
 	UpdateItem(item models.ToDo) (models.ToDo, error)
+	// ModifyItem replaces the stored item with the result of calling modify
+	// on it, atomically with respect to other writes. modify must not use the
+	// store. The result is saved by the same rules as UpdateItem.
+	ModifyItem(userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error)) (models.ToDo, error)
+	// DeleteItem also deletes the item's subtasks.
+	DeleteItem(userId string, itemId uuid.UUID) error
+	// DeleteItemIf is DeleteItem after calling check on the stored item,
+	// atomically with respect to other writes. Nothing is deleted if check
+	// fails. check must not use the store.
+	DeleteItemIf(userId string, itemId uuid.UUID, check func(current models.ToDo) error) error
+	// AddList, GetList, ListLists, UpdateList and DeleteList manage the lists
+	// a user's items are grouped in. Every user has the default list, which
+	// cannot be deleted.
+	AddList(list models.List) (models.List, error)
+	GetList(userId string, listId uuid.UUID) (models.List, error)
+	// ListLists returns the user's lists ordered by name, the default list
+	// first.
+	ListLists(userId string) ([]models.List, error)
+	// SharedLists returns the lists of other users that userId is a member
+	// of, in no particular order.
+	SharedLists(userId string) ([]models.List, error)
+	UpdateList(list models.List) (models.List, error)
+	// DeleteList also deletes the items in the list.
+	DeleteList(userId string, listId uuid.UUID) error
 	Close()
 }
 
+// itemMap is the index of items by user and id that the in-memory and JSON
+// stores keep.
+type itemMap map[string]map[uuid.UUID]models.ToDo
+
+func (m itemMap) get(userId string, itemId uuid.UUID) (models.ToDo, error) {
+	if item, exists := m[userId][itemId]; exists {
+		return item, nil
+	}
+	return models.ToDo{}, &todoerrors.NotFoundError{Message: "ToDo Not Found"}
+}
+
+func (m itemMap) children(userId string, parentId uuid.UUID) ([]models.ToDo, error) {
+	var subtasks []models.ToDo
+	for _, item := range m[userId] {
+		if item.ParentId != nil && *item.ParentId == parentId {
+			subtasks = append(subtasks, item)
+		}
+	}
+	return subtasks, nil
+}
+
+func (m itemMap) dependents(userId string, blockerId uuid.UUID) ([]models.ToDo, error) {
+	var dependents []models.ToDo
+	for _, item := range m[userId] {
+		if slices.Contains(item.BlockedBy, blockerId) {
+			dependents = append(dependents, item)
+		}
+	}
+	return dependents, nil
+}
+
+func (m itemMap) inList(userId string, listId uuid.UUID) ([]models.ToDo, error) {
+	var items []models.ToDo
+	for _, item := range m[userId] {
+		if item.ListId == listId {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (m itemMap) put(item models.ToDo) error {
+	putItem(m, item)
+	return nil
+}
+
+func (m itemMap) remove(userId string, itemId uuid.UUID) error {
+	removeItem(m, userId, itemId)
+	return nil
+}
+
+// memTx is the itemTx of the in-memory and JSON stores.
+type memTx struct {
+	itemMap
+	listMap
+}
+
+// undoTx is a memTx that keeps how to undo each change it makes, so that a
+// mutation that fails partway can be rolled back.
+type undoTx struct {
+	memTx
+	undo []func()
+}
+
+func (tx *undoTx) put(item models.ToDo) error {
+	prev, existed := tx.itemMap[item.UserId][item.Id]
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			putItem(tx.itemMap, prev)
+		} else {
+			removeItem(tx.itemMap, item.UserId, item.Id)
+		}
+	})
+	putItem(tx.itemMap, item)
+	return nil
+}
+
+func (tx *undoTx) remove(userId string, itemId uuid.UUID) error {
+	if prev, existed := tx.itemMap[userId][itemId]; existed {
+		tx.undo = append(tx.undo, func() { putItem(tx.itemMap, prev) })
+		removeItem(tx.itemMap, userId, itemId)
+	}
+	return nil
+}
+
+func (tx *undoTx) putList(list models.List) error {
+	prev, existed := tx.listMap[list.UserId][list.Id]
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			tx.listMap.putList(prev)
+		} else {
+			tx.listMap.removeList(list.UserId, list.Id)
+		}
+	})
+	return tx.listMap.putList(list)
+}
+
+func (tx *undoTx) removeList(userId string, listId uuid.UUID) error {
+	if prev, existed := tx.listMap[userId][listId]; existed {
+		tx.undo = append(tx.undo, func() { tx.listMap.putList(prev) })
+		tx.listMap.removeList(userId, listId)
+	}
+	return nil
+}
+
+func (tx *undoTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+}
+
 type inMemDatastore struct {
 	Items map[string]map[uuid.UUID]models.ToDo
+	Lists map[string]map[uuid.UUID]models.List
 	mut   sync.Mutex
 }
 
-func (ds *inMemDatastore) AddItem(item models.ToDo) (models.ToDo, error) {
-	item.Id = uuid.New()
+func (ds *inMemDatastore) tx() memTx {
+	return memTx{itemMap(ds.Items), listMap(ds.Lists)}
+}
+
+// mutate runs fn on the items, leaving them as they were if it fails.
+func (ds *inMemDatastore) mutate(fn func(tx itemTx) error) error {
 	ds.mut.Lock()
 	defer ds.mut.Unlock()
-
-	if user, exists := ds.Items[item.UserId]; exists {
-		user[item.Id] = item
-	} else {
-		ds.Items[item.UserId] = map[uuid.UUID]models.ToDo{item.Id: item}
+	tx := &undoTx{memTx: ds.tx()}
+	if err := fn(tx); err != nil {
+		tx.rollback()
+		return err
 	}
-	return ds.Items[item.UserId][item.Id], nil
+	return nil
+}
+
+func (ds *inMemDatastore) AddItem(item models.ToDo) (saved models.ToDo, err error) {
+	err = ds.mutate(func(tx itemTx) error {
+		saved, err = addItem(tx, item)
+		return err
+	})
+	return saved, err
 }
 
 func (ds *inMemDatastore) GetItem(userId string, itemId uuid.UUID) (models.ToDo, error) {
 	ds.mut.Lock()
 	defer ds.mut.Unlock()
-	if item, exists := ds.Items[userId][itemId]; exists {
-		return item, nil
-	}
-	return models.ToDo{}, &todoerrors.NotFoundError{Message: "ToDo Not Found"}
+	return itemMap(ds.Items).get(userId, itemId)
 }
 
-func (ds *inMemDatastore) UpdateItem(item models.ToDo) (models.ToDo, error) {
+func (ds *inMemDatastore) ListItems(userId string, opts ListOptions) (ItemPage, error) {
 	ds.mut.Lock()
-	defer ds.mut.Unlock()
-
-	if user, exists := ds.Items[item.UserId]; exists {
-		if _, iexist := user[item.Id]; iexist {
-			user[item.Id] = item
-			return ds.Items[item.UserId][item.Id], nil
+	items := make([]models.ToDo, 0, len(ds.Items[userId]))
+	for _, item := range ds.Items[userId] {
+		if opts.Filter.Match(item) {
+			items = append(items, item)
 		}
 	}
-	return models.ToDo{}, &todoerrors.NotFoundError{Message: "ToDo Not Found"}
+	ds.mut.Unlock()
+	return paginate(items, opts)
 }
 
-func (ds *inMemDatastore) Close() {
-	//no action for in mem
+func (ds *inMemDatastore) UpdateItem(item models.ToDo) (models.ToDo, error) {
+	return ds.ModifyItem(item.UserId, item.Id, replaceWith(item))
 }
 
-func NewInMemDataStore() DataStore {
-	return &inMemDatastore{Items: make(map[string]map[uuid.UUID]models.ToDo), mut: sync.Mutex{}}
+func (ds *inMemDatastore) ModifyItem(userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error)) (models.ToDo, error) {
+	return ds.modifyItemThen(userId, itemId, modify, nil)
 }
 
-func LoadJsonStore(fpath string) map[string]map[uuid.UUID]models.ToDo {
-	file, err := os.Open(fpath)
-	ctx := context.Background()
-	logging.AddTraceID(ctx)
-	if err != nil {
-		logging.LogWithTrace(ctx, map[string]interface{}{}, err.Error())
-	}
-	defer file.Close()
-	var todos []models.ToDo
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&todos)
-	if err != nil {
-		logging.LogWithTrace(ctx, map[string]interface{}{}, err.Error())
-	}
-	items := make(map[string]map[uuid.UUID]models.ToDo)
-	for _, item := range todos {
-		items[item.UserId] = map[uuid.UUID]models.ToDo{item.Id: item}
-		if err != nil {
-			logging.LogWithTrace(ctx, map[string]interface{}{}, fmt.Sprintf("error with todo: %+v", item))
-		}
-	}
-	return items
+func (ds *inMemDatastore) modifyItemThen(userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error), then func(tx itemTx, item models.ToDo) error) (item models.ToDo, err error) {
+	err = ds.mutate(func(tx itemTx) error {
+		item, err = modifyThen(tx, userId, itemId, modify, then)
+		return err
+	})
+	return item, err
 }
 
-type JsonDatastore struct {
-	fpath string
-	mut   sync.Mutex
-	items map[string]map[uuid.UUID]models.ToDo
+func (ds *inMemDatastore) DeleteItem(userId string, itemId uuid.UUID) error {
+	return ds.DeleteItemIf(userId, itemId, nil)
+}
+
+func (ds *inMemDatastore) DeleteItemIf(userId string, itemId uuid.UUID, check func(current models.ToDo) error) error {
+	return ds.mutate(func(tx itemTx) error {
+		return deleteItem(tx, userId, itemId, check)
+	})
 }
 
-func (ds *JsonDatastore) AddItem(item models.ToDo) (models.ToDo, error) {
-	item.Id = uuid.New()
+func (ds *inMemDatastore) AddList(list models.List) (saved models.List, err error) {
+	err = ds.mutate(func(tx itemTx) error {
+		saved, err = addList(tx, list)
+		return err
+	})
+	return saved, err
+}
+
+func (ds *inMemDatastore) GetList(userId string, listId uuid.UUID) (models.List, error) {
 	ds.mut.Lock()
 	defer ds.mut.Unlock()
-	if user, exists := ds.items[item.UserId]; exists {
-		user[item.Id] = item
-	} else {
-		ds.items[item.UserId] = map[uuid.UUID]models.ToDo{item.Id: item}
-	}
-	ds.Close()
-	return ds.items[item.UserId][item.Id], nil
+	return findList(ds.tx(), userId, listId)
 }
 
-func (ds *JsonDatastore) GetItem(userId string, itemId uuid.UUID) (models.ToDo, error) {
+func (ds *inMemDatastore) ListLists(userId string) ([]models.List, error) {
 	ds.mut.Lock()
 	defer ds.mut.Unlock()
-	if item, exists := ds.items[userId][itemId]; exists {
-		return item, nil
-	}
-	return models.ToDo{}, &todoerrors.NotFoundError{Message: "ToDo Not Found"}
+	return listLists(ds.tx(), userId)
 }
 
-func (ds *JsonDatastore) UpdateItem(item models.ToDo) (models.ToDo, error) {
+func (ds *inMemDatastore) SharedLists(userId string) ([]models.List, error) {
 	ds.mut.Lock()
 	defer ds.mut.Unlock()
-	if user, exists := ds.items[item.UserId]; exists {
-		if _, iexist := user[item.Id]; iexist {
-			ds.items[item.UserId][item.Id] = item
-			ds.Close()
-			return ds.items[item.UserId][item.Id], nil
-		}
-	}
-	return models.ToDo{}, &todoerrors.NotFoundError{Message: "ToDo Not Found"}
+	return listMap(ds.Lists).shared(userId), nil
 }
 
-func (ds *JsonDatastore) Close() {
-	items := make([]models.ToDo, 0)
-	for _, user := range ds.items {
-		for _, item := range user {
-			items = append(items, item)
-		}
-	}
-	bytes, err := json.MarshalIndent(items, "", "  ")
-	if err != nil {
-		fmt.Println("Error marshalling JSON:", err)
-		return
-	}
-	// Write the JSON to the file
-	err = os.WriteFile(ds.fpath, bytes, 0644)
-	if err != nil {
-		fmt.Println("Error writing to file:", err)
-		return
-	}
-	fmt.Println("Data written successfully!!!!!")
+func (ds *inMemDatastore) UpdateList(list models.List) (saved models.List, err error) {
+	err = ds.mutate(func(tx itemTx) error {
+		saved, err = updateList(tx, list)
+		return err
+	})
+	return saved, err
 }
 
-func NewJsonDatastore(path string) DataStore {
-	return &JsonDatastore{fpath: path, items: LoadJsonStore(path), mut: sync.Mutex{}}
+func (ds *inMemDatastore) DeleteList(userId string, listId uuid.UUID) error {
+	return ds.mutate(func(tx itemTx) error {
+		return deleteList(tx, userId, listId)
+	})
+}
+
+func (ds *inMemDatastore) Close() {
+	//no action for in mem
+}
+
+func NewInMemDataStore() DataStore {
+	return &inMemDatastore{
+		Items: make(map[string]map[uuid.UUID]models.ToDo),
+		Lists: make(map[string]map[uuid.UUID]models.List),
+		mut:   sync.Mutex{},
+	}
 }
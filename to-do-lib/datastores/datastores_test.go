@@ -1,13 +1,24 @@
 package datastores_test
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"go-to-do-app/to-do-lib/datastores"
 	todoerrors "go-to-do-app/to-do-lib/errors"
 	"go-to-do-app/to-do-lib/models"
 
 	"github.com/google/uuid"
+	_ "modernc.org/sqlite"
 )
 
 func TestNewInMemDataStore(t *testing.T) {
@@ -23,12 +34,15 @@ func TestNewInMemDataStore(t *testing.T) {
 
 func TestInMemUpdateToDo(t *testing.T) {
 	store := datastores.NewInMemDataStore()
-	expected := models.ToDo{Id: uuid.New(), Title: "test", Priority: "Low", Complete: false, UserId: uuid.New().String()}
-	store.AddItem(expected)
+	expected, _ := store.AddItem(models.ToDo{Title: "test", Priority: "Low", Complete: false, UserId: uuid.New().String()})
 	expected.Priority = "High"
 	expected.Complete = true
 	actual, _ := store.UpdateItem(expected)
-	if actual != expected {
+	expected.Revision++
+	expected.Status = models.StatusDone
+	expected.UpdatedAt = actual.UpdatedAt
+	expected.CompletedAt = actual.CompletedAt
+	if actual.CompletedAt == nil || !reflect.DeepEqual(actual, expected) {
 		t.Errorf("Expected: %+v, Got: %+v", expected, actual)
 	}
 }
@@ -46,15 +60,1042 @@ func TestUpdateNonExistientToDo(t *testing.T) {
 
 func TestInMemGetToDo(t *testing.T) {
 	store := datastores.NewInMemDataStore()
-	id := uuid.New()
 	userId := uuid.New().String()
-	expected := models.ToDo{Id: id, Title: "test", Priority: "Low", Complete: false, UserId: userId}
-	store.AddItem(expected)
-	actual, err := store.GetItem(userId, id)
+	expected, _ := store.AddItem(models.ToDo{Title: "test", Priority: "Low", Complete: false, UserId: userId})
+	actual, err := store.GetItem(userId, expected.Id)
 	if err != nil {
-		t.Errorf("datastore unable to find item that was created with uuid: %s", id)
+		t.Errorf("datastore unable to find item that was created with uuid: %s", expected.Id)
 	}
-	if actual != expected {
+	if !reflect.DeepEqual(actual, expected) {
 		t.Errorf("Expected: %+v, Got: %+v", expected, actual)
 	}
 }
+
+func TestInMemDeleteToDo(t *testing.T) {
+	store := datastores.NewInMemDataStore()
+	userId := uuid.New().String()
+	item, _ := store.AddItem(models.ToDo{Title: "test", Priority: "Low", Complete: false, UserId: userId})
+	if err := store.DeleteItem(userId, item.Id); err != nil {
+		t.Fatalf("Expected delete to succeed, got: %s", err)
+	}
+	_, err := store.GetItem(userId, item.Id)
+	if _, ok := err.(*todoerrors.NotFoundError); !ok {
+		t.Errorf("Expected: %T after delete, Got: %T", &todoerrors.NotFoundError{}, err)
+	}
+}
+
+func TestDeleteNonExistentToDo(t *testing.T) {
+	store := datastores.NewInMemDataStore()
+	err := store.DeleteItem(uuid.New().String(), uuid.New())
+	if _, ok := err.(*todoerrors.NotFoundError); !ok {
+		t.Errorf("Expected: %T, Got: %T", &todoerrors.NotFoundError{}, err)
+	}
+}
+
+func TestInMemListToDosPaginates(t *testing.T) {
+	store := datastores.NewInMemDataStore()
+	userId := uuid.New().String()
+	expected := make(map[uuid.UUID]bool)
+	for i := 0; i < 5; i++ {
+		item, _ := store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: userId})
+		expected[item.Id] = true
+	}
+	store.AddItem(models.ToDo{Title: "other user", Priority: "Low", UserId: uuid.New().String()})
+
+	seen := make(map[uuid.UUID]bool)
+	opts := datastores.ListOptions{Limit: 2}
+	for pages := 1; ; pages++ {
+		page, err := store.ListItems(userId, opts)
+		if err != nil {
+			t.Fatalf("ListItems failed with %s error", err)
+		}
+		for _, item := range page.Items {
+			if seen[item.Id] || !expected[item.Id] {
+				t.Errorf("unexpected or repeated item in page %d: %+v", pages, item)
+			}
+			seen[item.Id] = true
+		}
+		if page.NextCursor == "" {
+			if pages != 3 {
+				t.Errorf("Expected: 3 pages, Got: %d", pages)
+			}
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	if len(seen) != len(expected) {
+		t.Errorf("Expected: %d items, Got: %d", len(expected), len(seen))
+	}
+}
+
+func TestListToDosRejectsMalformedCursor(t *testing.T) {
+	store := datastores.NewInMemDataStore()
+	_, err := store.ListItems(uuid.New().String(), datastores.ListOptions{Cursor: "not a cursor"})
+	if _, ok := err.(*todoerrors.ValidationError); !ok {
+		t.Errorf("Expected: %T, Got: %T", &todoerrors.ValidationError{}, err)
+	}
+}
+
+func TestInMemListToDosFiltersAndSorts(t *testing.T) {
+	store := datastores.NewInMemDataStore()
+	userId := uuid.New().String()
+	inputs := []models.ToDo{
+		{Title: "b", Priority: models.PriorityHigh},
+		{Title: "a", Priority: models.PriorityHigh},
+		{Title: "c", Priority: models.PriorityHigh, Complete: true},
+		{Title: "d", Priority: models.PriorityLow},
+		{Title: "e", Priority: models.PriorityMedium},
+	}
+	for _, item := range inputs {
+		item.UserId = userId
+		store.AddItem(item)
+	}
+	incomplete := false
+	sort, _ := datastores.ParseSort("-priority,title")
+	opts := datastores.ListOptions{
+		Filter: datastores.Filter{Complete: &incomplete, Priorities: []string{models.PriorityHigh, models.PriorityMedium}},
+		Sort:   sort,
+		Limit:  1,
+	}
+	var titles []string
+	for {
+		page, err := store.ListItems(userId, opts)
+		if err != nil {
+			t.Fatalf("ListItems failed with %s error", err)
+		}
+		for _, item := range page.Items {
+			titles = append(titles, item.Title)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	expected := []string{"a", "b", "e"}
+	if strings.Join(titles, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected: %v, Got: %v", expected, titles)
+	}
+}
+
+func TestParseSortRejectsUnknownField(t *testing.T) {
+	_, err := datastores.ParseSort("priority,colour")
+	if _, ok := err.(*todoerrors.ValidationError); !ok {
+		t.Errorf("Expected: %T, Got: %T", &todoerrors.ValidationError{}, err)
+	}
+}
+
+func newStores(t *testing.T) map[string]datastores.DataStore {
+	t.Helper()
+	sqlStore, err := datastores.NewSQLDatastore("sqlite", filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatalf("failed to open sql datastore: %s", err)
+	}
+	jsonStore, err := datastores.NewJsonDatastore(filepath.Join(t.TempDir(), "store.json"), datastores.JsonOptions{})
+	if err != nil {
+		t.Fatalf("failed to open json datastore: %s", err)
+	}
+	stores := map[string]datastores.DataStore{
+		"in-mem": datastores.NewInMemDataStore(),
+		"json":   jsonStore,
+		"sql":    sqlStore,
+	}
+	t.Cleanup(func() {
+		for _, store := range stores {
+			store.Close()
+		}
+	})
+	return stores
+}
+
+func TestStoresAddGetUpdateDelete(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			userId := uuid.New().String()
+			added, err := store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: userId})
+			if err != nil {
+				t.Fatalf("AddItem failed with %s error", err)
+			}
+			if got, err := store.GetItem(userId, added.Id); err != nil || !reflect.DeepEqual(got, added) {
+				t.Errorf("Expected: %+v, Got: %+v (%v)", added, got, err)
+			}
+			added.Title = "updated"
+			added.Complete = true
+			got, err := store.UpdateItem(added)
+			added.Revision++
+			added.Status = models.StatusDone
+			added.UpdatedAt = got.UpdatedAt
+			added.CompletedAt = got.CompletedAt
+			if err != nil || !reflect.DeepEqual(got, added) {
+				t.Errorf("Expected: %+v, Got: %+v (%v)", added, got, err)
+			}
+			if got, _ := store.GetItem(userId, added.Id); !reflect.DeepEqual(got, added) {
+				t.Errorf("Expected update to persist: %+v, Got: %+v", added, got)
+			}
+			if _, err := store.GetItem(uuid.New().String(), added.Id); err == nil {
+				t.Errorf("Expected item to be scoped to its user")
+			}
+			refuse := errors.New("refused")
+			if err := store.DeleteItemIf(userId, added.Id, func(models.ToDo) error { return refuse }); err != refuse {
+				t.Errorf("Expected: %v, Got: %v", refuse, err)
+			}
+			if _, err := store.GetItem(userId, added.Id); err != nil {
+				t.Errorf("Expected a refused delete to keep the item, Got: %v", err)
+			}
+			if err := store.DeleteItem(userId, added.Id); err != nil {
+				t.Errorf("DeleteItem failed with %s error", err)
+			}
+			if err := store.DeleteItem(userId, added.Id); err == nil {
+				t.Errorf("Expected second delete to fail")
+			}
+			if _, err := store.UpdateItem(added); err == nil {
+				t.Errorf("Expected update of deleted item to fail")
+			}
+		})
+	}
+}
+
+func TestStoresKeepRichFields(t *testing.T) {
+	due := time.Date(2024, 3, 1, 17, 0, 0, 0, time.FixedZone("", 9*60*60))
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			added, err := store.AddItem(models.ToDo{
+				Title: "test", Priority: "Low", UserId: "user",
+				Description: "details", DueDate: &due, Tags: []string{"home", "work"},
+			})
+			if err != nil {
+				t.Fatalf("AddItem failed with %s error", err)
+			}
+			if added.CreatedAt.IsZero() || !added.UpdatedAt.Equal(added.CreatedAt) || added.CompletedAt != nil {
+				t.Errorf("Expected CreatedAt == UpdatedAt and no CompletedAt, Got: %+v", added)
+			}
+			got, _ := store.GetItem("user", added.Id)
+			if got.Description != "details" || !slices.Equal(got.Tags, added.Tags) || got.DueDate.Format(time.RFC3339) != "2024-03-01T17:00:00+09:00" {
+				t.Errorf("Expected: %+v, Got: %+v", added, got)
+			}
+
+			got.Complete = true
+			completed, _ := store.UpdateItem(got)
+			if !completed.CreatedAt.Equal(added.CreatedAt) || completed.CompletedAt == nil || completed.UpdatedAt.Before(added.UpdatedAt) {
+				t.Errorf("Expected CreatedAt to be kept and CompletedAt set, Got: %+v", completed)
+			}
+			completed.Title = "renamed"
+			renamed, _ := store.UpdateItem(completed)
+			if renamed.CompletedAt == nil || !renamed.CompletedAt.Equal(*completed.CompletedAt) {
+				t.Errorf("Expected CompletedAt to be kept, Got: %+v", renamed)
+			}
+			renamed.Complete = false
+			if reopened, _ := store.UpdateItem(renamed); reopened.CompletedAt != nil {
+				t.Errorf("Expected CompletedAt to be cleared, Got: %+v", reopened)
+			}
+		})
+	}
+}
+
+func TestStoresKeepCompleteInStepWithStatus(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			item, _ := store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: "user"})
+			steps := []struct {
+				status   string
+				complete bool
+				expected string
+			}{
+				{models.StatusInProgress, false, models.StatusInProgress},
+				{models.StatusInProgress, true, models.StatusDone},
+				{models.StatusDone, false, models.StatusTodo},
+				{models.StatusBlocked, false, models.StatusBlocked},
+				{models.StatusCancelled, true, models.StatusCancelled},
+			}
+			for _, step := range steps {
+				item.Status, item.Complete = step.status, step.complete
+				got, err := store.UpdateItem(item)
+				if err != nil || got.Status != step.expected || got.Complete != (step.expected == models.StatusDone) {
+					t.Errorf("%s/%t Expected: %s, Got: %s/%t (%v)", step.status, step.complete, step.expected, got.Status, got.Complete, err)
+				}
+				item = got
+			}
+		})
+	}
+}
+
+func TestWorkflowRejectsIllegalTransitions(t *testing.T) {
+	store := datastores.WithWorkflow(datastores.NewInMemDataStore(), models.DefaultWorkflow())
+	item, _ := store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: "user", Status: models.StatusCancelled})
+	item.Status = models.StatusInProgress
+	_, err := store.UpdateItem(item)
+	if _, ok := err.(*todoerrors.ValidationError); !ok {
+		t.Errorf("Expected: %T, Got: %T", &todoerrors.ValidationError{}, err)
+	}
+	item.Status = models.StatusTodo
+	if item, err = store.UpdateItem(item); err != nil {
+		t.Errorf("Expected cancelled -> todo to be allowed, Got: %s", err)
+	}
+	// Legacy callers only change Complete, which moves todo to done.
+	item.Complete = true
+	if got, err := store.UpdateItem(item); err != nil || got.Status != models.StatusDone {
+		t.Errorf("Expected: %s, Got: %s (%v)", models.StatusDone, got.Status, err)
+	}
+
+	strict := datastores.WithWorkflow(store, models.Workflow{
+		Initial:     []string{models.StatusTodo},
+		Transitions: map[string][]string{models.StatusTodo: {models.StatusDone}},
+	})
+	if _, err := strict.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: "user", Status: models.StatusBlocked}); err == nil {
+		t.Errorf("Expected blocked to be rejected as an initial status")
+	}
+	item, _ = strict.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: "user"})
+	item.Status = models.StatusDone
+	if item, err = strict.UpdateItem(item); err != nil {
+		t.Errorf("Expected todo -> done to be allowed, Got: %s", err)
+	}
+	_, err = strict.ModifyItem("user", item.Id, func(current models.ToDo) (models.ToDo, error) {
+		current.Complete = false
+		return current, nil
+	})
+	if err == nil {
+		t.Errorf("Expected done -> todo to be rejected")
+	}
+}
+
+func TestStoresRollUpSubtasks(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			parent, _ := store.AddItem(models.ToDo{Title: "parent", Priority: "Low", UserId: "user"})
+			step, _ := store.AddItem(models.ToDo{Title: "step", Priority: "Low", UserId: "user", ParentId: &parent.Id})
+			other, _ := store.AddItem(models.ToDo{Title: "other", Priority: "Low", UserId: "user", ParentId: &parent.Id})
+			nested, _ := store.AddItem(models.ToDo{Title: "nested", Priority: "Low", UserId: "user", ParentId: &other.Id})
+			progress := func(id uuid.UUID) string {
+				item, _ := store.GetItem("user", id)
+				if item.Progress == nil {
+					return "nil"
+				}
+				return fmt.Sprint(*item.Progress)
+			}
+			if got := progress(parent.Id); got != "0" {
+				t.Errorf("Expected: 0, Got: %s", got)
+			}
+
+			nested.Complete = true
+			store.UpdateItem(nested)
+			if got := progress(other.Id) + "," + progress(parent.Id); got != "100,50" {
+				t.Errorf("Expected: 100,50, Got: %s", got)
+			}
+			step.Status = models.StatusCancelled
+			store.UpdateItem(step)
+			if got := progress(parent.Id); got != "100" {
+				t.Errorf("Expected cancelled subtasks to be left out, Got: %s", got)
+			}
+
+			page, _ := store.ListItems("user", datastores.ListOptions{Filter: datastores.Filter{ParentId: &parent.Id}})
+			if len(page.Items) != 2 {
+				t.Errorf("Expected 2 subtasks, Got: %+v", page.Items)
+			}
+
+			if err := store.DeleteItem("user", other.Id); err != nil {
+				t.Fatalf("DeleteItem failed with %s error", err)
+			}
+			if _, err := store.GetItem("user", nested.Id); err == nil {
+				t.Errorf("Expected subtasks to be deleted with their parent")
+			}
+			if got := progress(parent.Id); got != "nil" {
+				t.Errorf("Expected no progress without open subtasks, Got: %s", got)
+			}
+		})
+	}
+}
+
+func TestStoresCloseSubtasksWithParent(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			parent, _ := store.AddItem(models.ToDo{Title: "parent", Priority: "Low", UserId: "user"})
+			open, _ := store.AddItem(models.ToDo{Title: "open", Priority: "Low", UserId: "user", ParentId: &parent.Id})
+			cancelled, _ := store.AddItem(models.ToDo{Title: "cancelled", Priority: "Low", UserId: "user", ParentId: &parent.Id, Status: models.StatusCancelled})
+			nested, _ := store.AddItem(models.ToDo{Title: "nested", Priority: "Low", UserId: "user", ParentId: &open.Id})
+
+			parent, _ = store.GetItem("user", parent.Id)
+			parent.Complete = true
+			parent, err := store.UpdateItem(parent)
+			if err != nil || parent.Progress == nil || *parent.Progress != 100 {
+				t.Fatalf("Expected parent to be 100%% done, Got: %+v (%v)", parent, err)
+			}
+			for _, item := range []models.ToDo{open, nested} {
+				if got, _ := store.GetItem("user", item.Id); got.Status != models.StatusDone || got.CompletedAt == nil {
+					t.Errorf("Expected %s to be done, Got: %+v", item.Title, got)
+				}
+			}
+			if got, _ := store.GetItem("user", cancelled.Id); got.Status != models.StatusCancelled {
+				t.Errorf("Expected cancelled subtask to stay cancelled, Got: %s", got.Status)
+			}
+
+			parent.Complete = false
+			if reopened, _ := store.UpdateItem(parent); reopened.Status != models.StatusTodo {
+				t.Errorf("Expected: %s, Got: %s", models.StatusTodo, reopened.Status)
+			}
+			if got, _ := store.GetItem("user", open.Id); got.Status != models.StatusDone {
+				t.Errorf("Expected reopening the parent to leave subtasks alone, Got: %s", got.Status)
+			}
+		})
+	}
+}
+
+func TestStoresRejectInvalidParents(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			missing := uuid.New()
+			if _, err := store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: "user", ParentId: &missing}); err == nil {
+				t.Errorf("Expected a missing parent to be rejected")
+			}
+			parent, _ := store.AddItem(models.ToDo{Title: "parent", Priority: "Low", UserId: "user"})
+			if _, err := store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: "other", ParentId: &parent.Id}); err == nil {
+				t.Errorf("Expected a parent of another user to be rejected")
+			}
+			child, _ := store.AddItem(models.ToDo{Title: "child", Priority: "Low", UserId: "user", ParentId: &parent.Id})
+			parent, _ = store.GetItem("user", parent.Id)
+			parent.ParentId = &child.Id
+			_, err := store.UpdateItem(parent)
+			if _, ok := err.(*todoerrors.ValidationError); !ok {
+				t.Errorf("Expected: %T, Got: %T", &todoerrors.ValidationError{}, err)
+			}
+
+			other, _ := store.AddItem(models.ToDo{Title: "other", Priority: "Low", UserId: "user"})
+			child.ParentId = &other.Id
+			if _, err := store.UpdateItem(child); err != nil {
+				t.Fatalf("Expected subtask to move, Got: %s", err)
+			}
+			if got, _ := store.GetItem("user", parent.Id); got.Progress != nil {
+				t.Errorf("Expected old parent to lose its progress, Got: %d", *got.Progress)
+			}
+			if got, _ := store.GetItem("user", other.Id); got.Progress == nil || *got.Progress != 0 {
+				t.Errorf("Expected new parent to be 0%% done, Got: %+v", got.Progress)
+			}
+		})
+	}
+}
+
+func TestStoresRejectDependencyCycles(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			first, _ := store.AddItem(models.ToDo{Title: "first", Priority: "Low", UserId: "user"})
+			second, _ := store.AddItem(models.ToDo{Title: "second", Priority: "Low", UserId: "user", BlockedBy: []uuid.UUID{first.Id}})
+			third, err := store.AddItem(models.ToDo{Title: "third", Priority: "Low", UserId: "user", BlockedBy: []uuid.UUID{second.Id}})
+			if err != nil {
+				t.Fatalf("AddItem failed with %s error", err)
+			}
+			first.BlockedBy = []uuid.UUID{third.Id}
+			_, err = store.UpdateItem(first)
+			if _, ok := err.(*todoerrors.ValidationError); !ok {
+				t.Errorf("Expected: %T, Got: %T (%v)", &todoerrors.ValidationError{}, err, err)
+			}
+			missing := uuid.New()
+			if _, err := store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: "user", BlockedBy: []uuid.UUID{missing}}); err == nil {
+				t.Errorf("Expected a missing blocker to be rejected")
+			}
+			if _, err := store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: "other", BlockedBy: []uuid.UUID{first.Id}}); err == nil {
+				t.Errorf("Expected a blocker of another user to be rejected")
+			}
+
+			if err := store.DeleteItem("user", second.Id); err != nil {
+				t.Fatalf("DeleteItem failed with %s error", err)
+			}
+			if got, _ := store.GetItem("user", third.Id); got.BlockedBy != nil {
+				t.Errorf("Expected deleted blocker to be removed, Got: %v", got.BlockedBy)
+			}
+		})
+	}
+}
+
+func TestStoresRefuseCompletingBlockedItems(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			blocker, _ := store.AddItem(models.ToDo{Title: "blocker", Priority: "Low", UserId: "user"})
+			blocked, _ := store.AddItem(models.ToDo{Title: "blocked", Priority: "Low", UserId: "user", BlockedBy: []uuid.UUID{blocker.Id}})
+			blocked.Complete = true
+			if _, err := store.UpdateItem(blocked); err == nil {
+				t.Errorf("Expected completing a blocked item to fail")
+			}
+			blocked.Complete, blocked.Status = false, models.StatusCancelled
+			if _, err := store.UpdateItem(blocked); err != nil {
+				t.Errorf("Expected cancelling a blocked item to be allowed, Got: %s", err)
+			}
+
+			parent, _ := store.AddItem(models.ToDo{Title: "parent", Priority: "Low", UserId: "user"})
+			first, _ := store.AddItem(models.ToDo{Title: "first", Priority: "Low", UserId: "user", ParentId: &parent.Id})
+			store.AddItem(models.ToDo{Title: "second", Priority: "Low", UserId: "user", ParentId: &parent.Id, BlockedBy: []uuid.UUID{first.Id}})
+			store.AddItem(models.ToDo{Title: "waiting", Priority: "Low", UserId: "user", ParentId: &first.Id, BlockedBy: []uuid.UUID{blocker.Id}})
+			parent, _ = store.GetItem("user", parent.Id)
+			parent.Complete = true
+			if _, err := store.UpdateItem(parent); err == nil {
+				t.Errorf("Expected completing a parent with a blocked subtask to fail")
+			}
+			if got, _ := store.GetItem("user", first.Id); got.Status != models.StatusTodo {
+				t.Errorf("Expected the refused close to leave subtasks open, Got: %s", got.Status)
+			}
+
+			blocker.Complete = true
+			store.UpdateItem(blocker)
+			blocked, _ = store.GetItem("user", blocked.Id)
+			blocked.Status = models.StatusDone
+			if _, err := store.UpdateItem(blocked); err != nil {
+				t.Errorf("Expected completing an unblocked item to be allowed, Got: %s", err)
+			}
+			// second is blocked by first, which is closed with it.
+			parent, _ = store.GetItem("user", parent.Id)
+			parent.Complete = true
+			if _, err := store.UpdateItem(parent); err != nil {
+				t.Errorf("Expected completing a parent whose subtasks are only blocked by each other to be allowed, Got: %s", err)
+			}
+		})
+	}
+}
+
+func TestRecurrenceSchedulesNextOccurrence(t *testing.T) {
+	for name, inner := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)
+			store := datastores.WithRecurrence(inner, func() time.Time { return now })
+			due := time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)
+			rule := &models.Recurrence{Frequency: models.Weekly, Interval: 1}
+			item, _ := store.AddItem(models.ToDo{Title: "weekly report", Priority: "Low", UserId: name, DueDate: &due, Recurrence: rule})
+
+			next := func() models.ToDo {
+				t.Helper()
+				page, _ := store.ListItems(name, datastores.ListOptions{Filter: datastores.Filter{Statuses: []string{models.StatusTodo}}})
+				if len(page.Items) != 1 {
+					t.Fatalf("Expected one open occurrence, Got: %+v", page.Items)
+				}
+				return page.Items[0]
+			}
+
+			item.Complete = true
+			done, err := store.UpdateItem(item)
+			if err != nil || done.Recurrence != nil {
+				t.Fatalf("Expected the recurrence to move to the next occurrence, Got: %+v (%v)", done, err)
+			}
+			second := next()
+			if second.DueDate.Format(time.RFC3339) != "2024-03-11T09:00:00Z" || !reflect.DeepEqual(second.Recurrence, rule) {
+				t.Errorf("Expected: due 2024-03-11T09:00:00Z, Got: %+v", second)
+			}
+			done.Complete = false
+			store.UpdateItem(done)
+			done, _ = store.GetItem(name, done.Id)
+			done.Complete = true
+			store.UpdateItem(done)
+			page, _ := store.ListItems(name, datastores.ListOptions{})
+			if len(page.Items) != 2 {
+				t.Errorf("Expected completing an occurrence twice to schedule once, Got: %d items", len(page.Items))
+			}
+
+			// Occurrences already in the past are skipped.
+			now = time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+			second.Complete = true
+			store.UpdateItem(second)
+			if third := next(); third.DueDate.Format(time.RFC3339) != "2024-04-08T09:00:00Z" {
+				t.Errorf("Expected: due 2024-04-08T09:00:00Z, Got: %+v", third.DueDate)
+			}
+		})
+	}
+}
+
+func TestRecurrenceRollsBackWhenTheNextOccurrenceFails(t *testing.T) {
+	// New items must start in progress, which the next occurrence does not.
+	workflow := models.Workflow{Initial: []string{models.StatusInProgress}, Transitions: models.DefaultWorkflow().Transitions}
+	for name, inner := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store := datastores.WithRecurrence(datastores.WithWorkflow(inner, workflow), nil)
+			parent, _ := store.AddItem(models.ToDo{Title: "chores", Priority: "Low", UserId: name, Status: models.StatusInProgress})
+			item, err := store.AddItem(models.ToDo{Title: "daily", Priority: "Low", UserId: name, Status: models.StatusInProgress,
+				ParentId: &parent.Id, Recurrence: &models.Recurrence{Frequency: models.Daily}})
+			if err != nil {
+				t.Fatalf("AddItem failed with %s error", err)
+			}
+			parent, _ = store.GetItem(name, parent.Id)
+
+			done := item
+			done.Status = models.StatusDone
+			if _, err := store.UpdateItem(done); !errors.As(err, new(*todoerrors.ValidationError)) {
+				t.Errorf("Expected: ValidationError for the next occurrence, Got: %v", err)
+			}
+			if got, _ := store.GetItem(name, item.Id); !reflect.DeepEqual(got, item) {
+				t.Errorf("Expected the completion to be rolled back, Expected: %+v, Got: %+v", item, got)
+			}
+			if got, _ := store.GetItem(name, parent.Id); !reflect.DeepEqual(got, parent) {
+				t.Errorf("Expected the roll-up to be rolled back, Expected: %+v, Got: %+v", parent, got)
+			}
+			if page, _ := store.ListItems(name, datastores.ListOptions{}); len(page.Items) != 2 {
+				t.Errorf("Expected: 2 items, Got: %+v", page.Items)
+			}
+		})
+	}
+}
+
+func TestRecurrenceStopsAfterUntil(t *testing.T) {
+	now := time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)
+	store := datastores.WithRecurrence(datastores.NewInMemDataStore(), func() time.Time { return now })
+	until := now.Add(36 * time.Hour)
+	item, _ := store.AddItem(models.ToDo{Title: "daily", Priority: "Low", UserId: "user", Recurrence: &models.Recurrence{Frequency: models.Daily, Until: &until}})
+	for i := 0; i < 2; i++ {
+		item.Complete = true
+		store.UpdateItem(item)
+		page, _ := store.ListItems("user", datastores.ListOptions{Filter: datastores.Filter{Statuses: []string{models.StatusTodo}}})
+		if len(page.Items) == 0 {
+			if i == 0 {
+				t.Fatalf("Expected an occurrence due on %s", now.AddDate(0, 0, 1))
+			}
+			return
+		}
+		item = page.Items[0]
+		if expected := now.AddDate(0, 0, 1); !item.DueDate.Equal(expected) {
+			t.Errorf("Expected: %s, Got: %s", expected, item.DueDate)
+		}
+	}
+	t.Errorf("Expected no occurrence after %s", until)
+}
+
+func TestRecurrenceSchedulesInTheSameWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	inner, _ := datastores.NewJsonDatastore(path, datastores.JsonOptions{})
+	store := datastores.WithRecurrence(inner, time.Now)
+	item, _ := store.AddItem(models.ToDo{Title: "daily", Priority: "Low", UserId: "user", Recurrence: &models.Recurrence{Frequency: models.Daily}})
+	before, _ := os.ReadFile(path + ".wal")
+	item.Complete = true
+	if _, err := store.UpdateItem(item); err != nil {
+		t.Fatalf("UpdateItem failed with %s error", err)
+	}
+
+	wal, _ := os.ReadFile(path + ".wal")
+	if lines := strings.Count(string(wal[len(before):]), "\n"); lines != 1 {
+		t.Errorf("Expected: the completion and the next occurrence to be logged as 1 line, Got: %d", lines)
+	}
+	page, _ := store.ListItems("user", datastores.ListOptions{})
+	if len(page.Items) != 2 {
+		t.Errorf("Expected: 2 items, Got: %+v", page.Items)
+	}
+}
+
+func TestStoresRejectStaleRevision(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			added, _ := store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: "user"})
+			if added.Revision != 1 {
+				t.Errorf("Expected: revision 1, Got: %d", added.Revision)
+			}
+			first := added
+			first.Title = "first"
+			if _, err := store.UpdateItem(first); err != nil {
+				t.Fatalf("UpdateItem failed with %s error", err)
+			}
+			second := added
+			second.Title = "second"
+			_, err := store.UpdateItem(second)
+			if _, ok := err.(*todoerrors.ConflictError); !ok {
+				t.Errorf("Expected: %T, Got: %T", &todoerrors.ConflictError{}, err)
+			}
+			second.Revision = 0
+			if got, err := store.UpdateItem(second); err != nil || got.Revision != 3 {
+				t.Errorf("Expected unconditional update to revision 3, Got: %+v (%v)", got, err)
+			}
+		})
+	}
+}
+
+func TestStoresListFiltered(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			userId := uuid.New().String()
+			store.AddItem(models.ToDo{Title: "100% done", Priority: models.PriorityHigh, UserId: userId})
+			store.AddItem(models.ToDo{Title: "Release NOTES", Priority: models.PriorityHigh, UserId: userId})
+			store.AddItem(models.ToDo{Title: "release notes", Priority: models.PriorityLow, UserId: userId})
+			store.AddItem(models.ToDo{Title: "release notes", Priority: models.PriorityHigh, Complete: true, UserId: userId})
+			incomplete := false
+			page, err := store.ListItems(userId, datastores.ListOptions{Filter: datastores.Filter{
+				Complete:      &incomplete,
+				Priorities:    []string{models.PriorityHigh},
+				TitleContains: "notes",
+			}})
+			if err != nil {
+				t.Fatalf("ListItems failed with %s error", err)
+			}
+			if len(page.Items) != 1 || page.Items[0].Title != "Release NOTES" {
+				t.Errorf("Expected: [Release NOTES], Got: %+v", page.Items)
+			}
+			page, _ = store.ListItems(userId, datastores.ListOptions{Filter: datastores.Filter{TitleContains: "0%"}})
+			if len(page.Items) != 1 {
+				t.Errorf("Expected title filter to treat %% literally, Got: %+v", page.Items)
+			}
+			page, _ = store.ListItems(userId, datastores.ListOptions{Filter: datastores.Filter{Statuses: []string{models.StatusDone}}})
+			if len(page.Items) != 1 || !page.Items[0].Complete {
+				t.Errorf("Expected the completed item, Got: %+v", page.Items)
+			}
+		})
+	}
+}
+
+func TestStoresGroupItemsInLists(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			userId := uuid.New().String()
+			inbox, _ := store.AddItem(models.ToDo{Title: "inbox", Priority: "Low", UserId: userId})
+			if inbox.ListId != models.DefaultListId {
+				t.Errorf("Expected: item in the default list, Got: %s", inbox.ListId)
+			}
+			work, err := store.AddList(models.List{UserId: userId, Name: "Work"})
+			if err != nil {
+				t.Fatalf("AddList failed with %s error", err)
+			}
+			if _, err := store.AddList(models.List{UserId: userId, Name: "work"}); !errors.As(err, new(*todoerrors.ValidationError)) {
+				t.Errorf("Expected: ValidationError for a duplicate name, Got: %v", err)
+			}
+			report, _ := store.AddItem(models.ToDo{Title: "report", Priority: "Low", UserId: userId, ListId: work.Id})
+			sub, _ := store.AddItem(models.ToDo{Title: "sub", Priority: "Low", UserId: userId, ParentId: &report.Id, ListId: work.Id})
+			if _, err := store.AddItem(models.ToDo{Title: "lost", Priority: "Low", UserId: userId, ListId: uuid.New()}); !errors.As(err, new(*todoerrors.ValidationError)) {
+				t.Errorf("Expected: ValidationError for an unknown list, Got: %v", err)
+			}
+
+			page, _ := store.ListItems(userId, datastores.ListOptions{Filter: datastores.Filter{ListId: &work.Id}})
+			if len(page.Items) != 2 {
+				t.Errorf("Expected: 2 items in %s, Got: %+v", work.Name, page.Items)
+			}
+			inbox.ListId = work.Id
+			if moved, err := store.UpdateItem(inbox); err != nil || moved.ListId != work.Id {
+				t.Errorf("Expected item to move to %s, Got: %+v (%v)", work.Id, moved, err)
+			}
+
+			lists, _ := store.ListLists(userId)
+			if len(lists) != 2 || lists[0].Id != models.DefaultListId || !reflect.DeepEqual(lists[1], work) {
+				t.Errorf("Expected: the default list and %+v, Got: %+v", work, lists)
+			}
+			renamed, err := store.UpdateList(models.List{Id: models.DefaultListId, UserId: userId, Name: "Home"})
+			if err != nil || renamed.Name != "Home" {
+				t.Errorf("Expected the default list to be renamed, Got: %+v (%v)", renamed, err)
+			}
+			if got, _ := store.GetList(userId, models.DefaultListId); got.Name != "Home" {
+				t.Errorf("Expected: Home, Got: %+v", got)
+			}
+
+			if err := store.DeleteList(userId, models.DefaultListId); !errors.As(err, new(*todoerrors.ValidationError)) {
+				t.Errorf("Expected: ValidationError deleting the default list, Got: %v", err)
+			}
+			if err := store.DeleteList(userId, work.Id); err != nil {
+				t.Fatalf("DeleteList failed with %s error", err)
+			}
+			for _, id := range []uuid.UUID{inbox.Id, report.Id, sub.Id} {
+				if _, err := store.GetItem(userId, id); !errors.As(err, new(*todoerrors.NotFoundError)) {
+					t.Errorf("Expected item %s to be deleted with its list, Got: %v", id, err)
+				}
+			}
+			if _, err := store.GetList(userId, work.Id); !errors.As(err, new(*todoerrors.NotFoundError)) {
+				t.Errorf("Expected: NotFoundError, Got: %v", err)
+			}
+		})
+	}
+}
+
+func TestStoresKeepSubtasksInTheirParentsList(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			userId := uuid.New().String()
+			work, _ := store.AddList(models.List{UserId: userId, Name: "Work"})
+			home, _ := store.AddList(models.List{UserId: userId, Name: "Home"})
+			parent, _ := store.AddItem(models.ToDo{Title: "parent", Priority: "Low", UserId: userId, ListId: work.Id})
+			child, _ := store.AddItem(models.ToDo{Title: "child", Priority: "Low", UserId: userId, ParentId: &parent.Id, ListId: work.Id})
+			grandchild, _ := store.AddItem(models.ToDo{Title: "grandchild", Priority: "Low", UserId: userId, ParentId: &child.Id, ListId: work.Id})
+
+			if _, err := store.AddItem(models.ToDo{Title: "elsewhere", Priority: "Low", UserId: userId, ParentId: &parent.Id, ListId: home.Id}); !errors.As(err, new(*todoerrors.ValidationError)) {
+				t.Errorf("Expected: ValidationError for a parent in another list, Got: %v", err)
+			}
+			child, _ = store.GetItem(userId, child.Id)
+			child.ListId = home.Id
+			if _, err := store.UpdateItem(child); !errors.As(err, new(*todoerrors.ValidationError)) {
+				t.Errorf("Expected: ValidationError moving a subtask away from its parent, Got: %v", err)
+			}
+
+			if _, err := store.AddItem(models.ToDo{Title: "elsewhere", Priority: "Low", UserId: userId, BlockedBy: []uuid.UUID{parent.Id}, ListId: home.Id}); !errors.As(err, new(*todoerrors.ValidationError)) {
+				t.Errorf("Expected: ValidationError for a blocker in another list, Got: %v", err)
+			}
+			waiting, _ := store.AddItem(models.ToDo{Title: "waiting", Priority: "Low", UserId: userId, BlockedBy: []uuid.UUID{grandchild.Id}, ListId: work.Id})
+			parent, _ = store.GetItem(userId, parent.Id)
+			parent.ListId = home.Id
+			if _, err := store.UpdateItem(parent); !errors.As(err, new(*todoerrors.ValidationError)) {
+				t.Errorf("Expected: ValidationError moving away from a dependent, Got: %v", err)
+			}
+			store.DeleteItem(userId, waiting.Id)
+			if _, err := store.UpdateItem(parent); err != nil {
+				t.Fatalf("UpdateItem failed with %s error", err)
+			}
+			for _, id := range []uuid.UUID{child.Id, grandchild.Id} {
+				if got, _ := store.GetItem(userId, id); got.ListId != home.Id {
+					t.Errorf("Expected: subtask moved to %s with its parent, Got: %+v", home.Id, got)
+				}
+			}
+			if err := store.DeleteList(userId, work.Id); err != nil {
+				t.Fatalf("DeleteList failed with %s error", err)
+			}
+			if _, err := store.GetItem(userId, grandchild.Id); err != nil {
+				t.Errorf("Expected the moved subtasks to outlive their old list, Got: %v", err)
+			}
+		})
+	}
+}
+
+func TestStoresFindSharedLists(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			members := []models.Member{{UserId: "b_%", Role: models.RoleEditor}}
+			team, _ := store.AddList(models.List{UserId: "a", Name: "Team", Members: members})
+			store.AddList(models.List{UserId: "a", Name: "Private"})
+			store.AddList(models.List{UserId: "c", Name: "Other", Members: []models.Member{{UserId: "bx%", Role: models.RoleViewer}}})
+			shared, err := store.SharedLists("b_%")
+			if err != nil || len(shared) != 1 || shared[0].Id != team.Id || !reflect.DeepEqual(shared[0].Members, members) {
+				t.Errorf("Expected: [%+v], Got: %+v (%v)", team, shared, err)
+			}
+			team.Members = nil
+			store.UpdateList(team)
+			if shared, _ := store.SharedLists("b_%"); len(shared) != 0 {
+				t.Errorf("Expected no shared lists after removing the member, Got: %+v", shared)
+			}
+		})
+	}
+}
+
+func TestSQLDatastoreMigratesItemsToDefaultList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	db, _ := sql.Open("sqlite", path)
+	db.Exec(`CREATE TABLE todos (user_id TEXT NOT NULL, id TEXT NOT NULL, title TEXT NOT NULL, priority TEXT NOT NULL,
+		complete BOOLEAN NOT NULL DEFAULT FALSE, PRIMARY KEY (user_id, id))`)
+	db.Exec(`CREATE TABLE schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`)
+	db.Exec(`INSERT INTO schema_migrations (version) VALUES (1)`)
+	id := uuid.New()
+	db.Exec(`INSERT INTO todos (user_id, id, title, priority) VALUES ('user', ?, 'old', 'Low')`, id.String())
+	db.Close()
+
+	store, err := datastores.NewSQLDatastore("sqlite", path)
+	if err != nil {
+		t.Fatalf("failed to migrate sql datastore: %s", err)
+	}
+	defer store.Close()
+	page, _ := store.ListItems("user", datastores.ListOptions{Filter: datastores.Filter{ListId: &models.DefaultListId}})
+	if len(page.Items) != 1 || page.Items[0].Id != id {
+		t.Errorf("Expected: %s in the default list, Got: %+v", id, page.Items)
+	}
+}
+
+func TestJsonDatastorePersistsLists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store, _ := datastores.NewJsonDatastore(path, datastores.JsonOptions{})
+	logged, _ := store.AddList(models.List{UserId: "user", Name: "logged"})
+	store.Close()
+	compacted, _ := store.AddList(models.List{UserId: "user", Name: "compacted"})
+	item, _ := store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: "user", ListId: compacted.Id})
+
+	reopened, err := datastores.NewJsonDatastore(path, datastores.JsonOptions{})
+	if err != nil {
+		t.Fatalf("failed to reopen json datastore: %s", err)
+	}
+	lists, _ := reopened.ListLists("user")
+	if len(lists) != 3 || !reflect.DeepEqual(lists[1:], []models.List{compacted, logged}) {
+		t.Errorf("Expected: %+v and %+v, Got: %+v", compacted, logged, lists)
+	}
+	if got, _ := reopened.GetItem("user", item.Id); got.ListId != compacted.Id {
+		t.Errorf("Expected: %s, Got: %s", compacted.Id, got.ListId)
+	}
+}
+
+func TestSQLDatastoreReopensExistingDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	store, err := datastores.NewSQLDatastore("sqlite", path)
+	if err != nil {
+		t.Fatalf("failed to open sql datastore: %s", err)
+	}
+	item, _ := store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: "user"})
+	store.Close()
+
+	store, err = datastores.NewSQLDatastore("sqlite", path)
+	if err != nil {
+		t.Fatalf("failed to reopen sql datastore: %s", err)
+	}
+	defer store.Close()
+	if got, err := store.GetItem("user", item.Id); err != nil || !reflect.DeepEqual(got, item) {
+		t.Errorf("Expected: %+v, Got: %+v (%v)", item, got, err)
+	}
+}
+
+func TestJsonDatastoreReplaysLogAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store, _ := datastores.NewJsonDatastore(path, datastores.JsonOptions{})
+	kept, _ := store.AddItem(models.ToDo{Title: "kept", Priority: "Low", UserId: "user"})
+	removed, _ := store.AddItem(models.ToDo{Title: "removed", Priority: "Low", UserId: "user"})
+	kept.Complete = true
+	kept, _ = store.UpdateItem(kept)
+	store.DeleteItem("user", removed.Id)
+	// No Close: the snapshot was never written, only the log.
+
+	f, _ := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"op":"put","item":{"id":"`)
+	f.Close()
+
+	reopened, err := datastores.NewJsonDatastore(path, datastores.JsonOptions{})
+	if err != nil {
+		t.Fatalf("failed to reopen json datastore: %s", err)
+	}
+	if got, err := reopened.GetItem("user", kept.Id); err != nil || !reflect.DeepEqual(got, kept) {
+		t.Errorf("Expected: %+v, Got: %+v (%v)", kept, got, err)
+	}
+	if _, err := reopened.GetItem("user", removed.Id); err == nil {
+		t.Errorf("Expected deleted item to stay deleted after replay")
+	}
+	if _, err := reopened.AddItem(models.ToDo{Title: "after", Priority: "Low", UserId: "user"}); err != nil {
+		t.Fatalf("AddItem failed with %s error", err)
+	}
+	if _, err := datastores.NewJsonDatastore(path, datastores.JsonOptions{}); err != nil {
+		t.Errorf("Expected torn entry to be truncated before appending, Got: %s", err)
+	}
+}
+
+func TestJsonDatastoreReplaysWholeMutations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store, _ := datastores.NewJsonDatastore(path, datastores.JsonOptions{})
+	parent, _ := store.AddItem(models.ToDo{Title: "parent", Priority: "Low", UserId: "user"})
+	child, _ := store.AddItem(models.ToDo{Title: "child", Priority: "Low", UserId: "user", ParentId: &parent.Id})
+	before, _ := os.ReadFile(path + ".wal")
+	parent, _ = store.GetItem("user", parent.Id)
+	parent.Complete = true
+	if _, err := store.UpdateItem(parent); err != nil {
+		t.Fatalf("UpdateItem failed with %s error", err)
+	}
+	// No Close: the snapshot was never written, only the log.
+
+	wal, _ := os.ReadFile(path + ".wal")
+	closing := wal[len(before):]
+	if lines := strings.Count(string(closing), "\n"); lines != 1 {
+		t.Fatalf("Expected: closing the parent and its subtask to be logged as 1 line, Got: %d", lines)
+	}
+	// A crash halfway through writing the line leaves only part of it.
+	os.Truncate(path+".wal", int64(len(before)+len(closing)/2))
+
+	reopened, err := datastores.NewJsonDatastore(path, datastores.JsonOptions{})
+	if err != nil {
+		t.Fatalf("failed to reopen json datastore: %s", err)
+	}
+	for _, item := range []models.ToDo{parent, child} {
+		if got, _ := reopened.GetItem("user", item.Id); got.Complete {
+			t.Errorf("Expected the torn mutation to be dropped whole, Got: %+v", got)
+		}
+	}
+}
+
+func TestJsonDatastoreCompactsLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store, _ := datastores.NewJsonDatastore(path, datastores.JsonOptions{CompactEvery: 3})
+	for i := 0; i < 4; i++ {
+		store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: "user"})
+	}
+	wal, _ := os.ReadFile(path + ".wal")
+	if lines := strings.Count(string(wal), "\n"); lines != 1 {
+		t.Errorf("Expected: 1 log entry after compaction, Got: %d", lines)
+	}
+	snapshot, _ := datastores.LoadJsonStore(path)
+	if len(snapshot["user"]) != 3 {
+		t.Errorf("Expected: 3 items in snapshot, Got: %d", len(snapshot["user"]))
+	}
+}
+
+func TestJsonDatastoreRejectsCorruptLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	os.WriteFile(path+".wal", []byte("not json\n{\"op\":\"delete\",\"item\":{}}\n"), 0644)
+	if _, err := datastores.NewJsonDatastore(path, datastores.JsonOptions{}); err == nil {
+		t.Errorf("Expected an error opening a store with a corrupt log")
+	}
+}
+
+func TestJsonDatastoreRefusesCorruptSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	corrupt := []byte(`{"version": 1, "checksum": "00", "items": [`)
+	os.WriteFile(path, corrupt, 0644)
+	_, err := datastores.NewJsonDatastore(path, datastores.JsonOptions{})
+	if !errors.Is(err, datastores.ErrCorruptStore) {
+		t.Errorf("Expected: %s, Got: %v", datastores.ErrCorruptStore, err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != string(corrupt) {
+		t.Errorf("Expected corrupt snapshot to be left untouched, Got: %s", b)
+	}
+}
+
+func TestJsonDatastoreRecoversFromBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store, _ := datastores.NewJsonDatastore(path, datastores.JsonOptions{})
+	first, _ := store.AddItem(models.ToDo{Title: "first", Priority: "Low", UserId: "user"})
+	store.Close()
+	second, _ := store.AddItem(models.ToDo{Title: "second", Priority: "Low", UserId: "user"})
+	store.Close()
+
+	// Flip a byte inside the items so the checksum no longer matches.
+	b, _ := os.ReadFile(path)
+	os.WriteFile(path, []byte(strings.Replace(string(b), "second", "secand", 1)), 0644)
+	if _, err := datastores.NewJsonDatastore(path, datastores.JsonOptions{}); !errors.Is(err, datastores.ErrCorruptStore) {
+		t.Fatalf("Expected: %s, Got: %v", datastores.ErrCorruptStore, err)
+	}
+
+	recovered, err := datastores.NewJsonDatastore(path, datastores.JsonOptions{RecoverFromBackup: true})
+	if err != nil {
+		t.Fatalf("failed to recover json datastore: %s", err)
+	}
+	if got, err := recovered.GetItem("user", first.Id); err != nil || !reflect.DeepEqual(got, first) {
+		t.Errorf("Expected: %+v, Got: %+v (%v)", first, got, err)
+	}
+	if _, err := recovered.GetItem("user", second.Id); err == nil {
+		t.Errorf("Expected item written after the backup to be lost")
+	}
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Errorf("Expected corrupt snapshot to be kept aside: %s", err)
+	}
+}
+
+func TestLoadJsonStoreAcceptsLegacyArray(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	item := models.ToDo{Id: uuid.New(), Title: "legacy", Priority: "Low", UserId: "user"}
+	other := models.ToDo{Id: uuid.New(), Title: "legacy", Priority: "Low", UserId: "user"}
+	b, _ := json.Marshal([]models.ToDo{item, other})
+	os.WriteFile(path, b, 0644)
+	items, err := datastores.LoadJsonStore(path)
+	if err != nil {
+		t.Fatalf("LoadJsonStore failed with %s error", err)
+	}
+	if len(items["user"]) != 2 {
+		t.Errorf("Expected: 2 items for user, Got: %d", len(items["user"]))
+	}
+	if items["user"][item.Id].Revision != 1 {
+		t.Errorf("Expected: legacy items at revision 1, Got: %+v", items["user"][item.Id])
+	}
+
+	store, err := datastores.NewJsonDatastore(path, datastores.JsonOptions{})
+	if err != nil {
+		t.Fatalf("NewJsonDatastore failed with %s error", err)
+	}
+	defer store.Close()
+	item.Revision = 1
+	item.Complete = true
+	if updated, err := store.UpdateItem(item); err != nil || updated.Revision != 2 {
+		t.Errorf("Expected an update based on revision 1 to succeed, Got: %+v (%v)", updated, err)
+	}
+}
+
+func BenchmarkJsonDatastoreUpdateItem(b *testing.B) {
+	for _, size := range []int{100, 10000} {
+		b.Run(fmt.Sprintf("items=%d", size), func(b *testing.B) {
+			store, _ := datastores.NewJsonDatastore(filepath.Join(b.TempDir(), "store.json"), datastores.JsonOptions{})
+			defer store.Close()
+			var item models.ToDo
+			for i := 0; i < size; i++ {
+				item, _ = store.AddItem(models.ToDo{Title: "test", Priority: "Low", UserId: fmt.Sprintf("user-%d", i%10)})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				item.Complete = !item.Complete
+				var err error
+				if item, err = store.UpdateItem(item); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package datastores
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// checkBlockers returns a ValidationError unless every blocker of item that
+// is not in previous exists in item's list and does not already wait on item,
+// directly or through other items, as the dependency graph would then have a
+// cycle. Like a parent, a blocker in another list is reported as missing.
+func checkBlockers(tx itemTx, item models.ToDo, previous []uuid.UUID) error {
+	for _, id := range item.BlockedBy {
+		if slices.Contains(previous, id) {
+			continue
+		}
+		blocker, err := tx.get(item.UserId, id)
+		if isNotFound(err) || err == nil && blocker.ListId != item.ListId {
+			return &todoerrors.ValidationError{Field: "blocked_by", Err: fmt.Errorf("blocker %s is not in list %s", id, item.ListId)}
+		}
+		if err != nil {
+			return err
+		}
+		waits, err := waitsOn(tx, blocker, item.Id, map[uuid.UUID]bool{})
+		if err != nil {
+			return err
+		}
+		if waits {
+			return &todoerrors.ValidationError{
+				Field: "blocked_by",
+				Err:   fmt.Errorf("%s already waits on this ToDo, so it cannot also block it", id),
+			}
+		}
+	}
+	return nil
+}
+
+// checkMovable returns a ValidationError if item or one of its subtasks, which
+// move to another list with it, blocks or is blocked by a ToDo that stays
+// behind, as dependencies do not cross lists.
+func checkMovable(tx itemTx, item models.ToDo) error {
+	moving := map[uuid.UUID]bool{}
+	var subtree []models.ToDo
+	var collect func(item models.ToDo) error
+	collect = func(item models.ToDo) error {
+		moving[item.Id] = true
+		subtree = append(subtree, item)
+		subtasks, err := tx.children(item.UserId, item.Id)
+		if err != nil {
+			return err
+		}
+		for _, sub := range subtasks {
+			if err := collect(sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := collect(item); err != nil {
+		return err
+	}
+	for _, member := range subtree {
+		linked := slices.Clone(member.BlockedBy)
+		dependents, err := tx.dependents(member.UserId, member.Id)
+		if err != nil {
+			return err
+		}
+		for _, dependent := range dependents {
+			linked = append(linked, dependent.Id)
+		}
+		for _, id := range linked {
+			if !moving[id] {
+				return &todoerrors.ValidationError{
+					Field: "list_id",
+					Err:   fmt.Errorf("%s is linked to %s by blocked_by, so it cannot move to another list without it", member.Id, id),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// waitsOn reports whether item is blocked by target, directly or through its
+// blockers. seen holds the items already searched.
+func waitsOn(tx itemTx, item models.ToDo, target uuid.UUID, seen map[uuid.UUID]bool) (bool, error) {
+	for _, id := range item.BlockedBy {
+		if id == target {
+			return true, nil
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		blocker, err := tx.get(item.UserId, id)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if waits, err := waitsOn(tx, blocker, target, seen); err != nil || waits {
+			return waits, err
+		}
+	}
+	return false, nil
+}
+
+// checkUnblocked returns a ValidationError if item is done while one of its
+// blockers is still open.
+func checkUnblocked(tx itemTx, item models.ToDo) error {
+	if item.Status != models.StatusDone {
+		return nil
+	}
+	var open []string
+	for _, id := range item.BlockedBy {
+		blocker, err := tx.get(item.UserId, id)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if blocker.IsOpen() {
+			open = append(open, id.String())
+		}
+	}
+	if len(open) > 0 {
+		return &todoerrors.ValidationError{
+			Field: "status",
+			Err:   fmt.Errorf("cannot be done while blocked by open ToDos: %s", strings.Join(open, ", ")),
+		}
+	}
+	return nil
+}
+
+// unblockDependents removes a deleted item from the blockers of the items it
+// was blocking.
+func unblockDependents(tx itemTx, userId string, itemId uuid.UUID) error {
+	dependents, err := tx.dependents(userId, itemId)
+	if err != nil {
+		return err
+	}
+	for _, dependent := range dependents {
+		next := dependent
+		next.BlockedBy = slices.DeleteFunc(slices.Clone(dependent.BlockedBy), func(id uuid.UUID) bool {
+			return id == itemId
+		})
+		if len(next.BlockedBy) == 0 {
+			next.BlockedBy = nil
+		}
+		if _, err := saveDerived(tx, dependent, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
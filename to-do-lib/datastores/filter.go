@@ -0,0 +1,145 @@
+package datastores
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+	"go-to-do-app/to-do-lib/query"
+
+	"github.com/google/uuid"
+)
+
+// Filter narrows the items returned by ListItems. Zero values match everything.
+type Filter struct {
+	Complete   *bool
+	Priorities []string
+	Statuses   []string
+	// ParentId only matches the direct subtasks of the given item.
+	ParentId *uuid.UUID
+	// ListId only matches the items in the given list, and InLists the items
+	// in any of the given lists when it is not empty.
+	ListId        *uuid.UUID
+	InLists       []uuid.UUID
+	TitleContains string
+	Query         query.Expr
+}
+
+func (f Filter) Match(item models.ToDo) bool {
+	if f.Complete != nil && item.Complete != *f.Complete {
+		return false
+	}
+	if len(f.Priorities) > 0 && !slices.Contains(f.Priorities, item.Priority) {
+		return false
+	}
+	if len(f.Statuses) > 0 && !slices.Contains(f.Statuses, item.EffectiveStatus()) {
+		return false
+	}
+	if f.ParentId != nil && !equalPtr(item.ParentId, f.ParentId) {
+		return false
+	}
+	if f.ListId != nil && item.ListId != *f.ListId {
+		return false
+	}
+	if len(f.InLists) > 0 && !slices.Contains(f.InLists, item.ListId) {
+		return false
+	}
+	if f.TitleContains != "" && !strings.Contains(strings.ToLower(item.Title), strings.ToLower(f.TitleContains)) {
+		return false
+	}
+	if f.Query != nil && !f.Query.Eval(item) {
+		return false
+	}
+	return true
+}
+
+type SortField string
+
+const (
+	SortById       SortField = "id"
+	SortByTitle    SortField = "title"
+	SortByPriority SortField = "priority"
+	SortByComplete SortField = "complete"
+)
+
+type SortKey struct {
+	Field SortField
+	Desc  bool
+}
+
+// ParseSort reads a comma separated list of sort fields, each optionally
+// prefixed with '-' for descending order, e.g. "-priority,title".
+func ParseSort(s string) ([]SortKey, error) {
+	var keys []SortKey
+	if s == "" {
+		return keys, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		key := SortKey{Field: SortField(strings.ToLower(strings.TrimSpace(part)))}
+		if strings.HasPrefix(string(key.Field), "-") {
+			key.Desc = true
+			key.Field = key.Field[1:]
+		}
+		switch key.Field {
+		case SortById, SortByTitle, SortByPriority, SortByComplete:
+			keys = append(keys, key)
+		default:
+			return nil, &todoerrors.ValidationError{
+				Field: "sort",
+				Err: fmt.Errorf("invalid sort field: %s. Valid options are: %s, %s, %s, %s",
+					part, SortById, SortByTitle, SortByPriority, SortByComplete),
+			}
+		}
+	}
+	return keys, nil
+}
+
+func sortString(keys []SortKey) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = string(key.Field)
+		if key.Desc {
+			parts[i] = "-" + parts[i]
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// compareItems orders items by the given keys, falling back to id so that the
+// ordering is total and pagination cursors are unambiguous.
+func compareItems(keys []SortKey, a, b models.ToDo) int {
+	for _, key := range keys {
+		var c int
+		switch key.Field {
+		case SortById:
+			c = cmp.Compare(a.Id.String(), b.Id.String())
+		case SortByTitle:
+			c = cmp.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+		case SortByPriority:
+			c = cmp.Compare(models.PriorityRank(a.Priority), models.PriorityRank(b.Priority))
+		case SortByComplete:
+			c = compareBool(a.Complete, b.Complete)
+		}
+		if key.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(a.Id.String(), b.Id.String())
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,493 @@
+package datastores
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+
+	"go-to-do-app/to-do-lib/logging"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultCompactEvery = 1000
+	DefaultBackups      = 3
+)
+
+type JsonOptions struct {
+	// CompactEvery is the minimum number of log entries written before the
+	// log is folded into the snapshot file. The log is also allowed to grow
+	// to the size of the store, so the cost of compaction is amortised over
+	// at least as many writes as it has items to rewrite. Defaults to
+	// DefaultCompactEvery.
+	CompactEvery int
+	// Backups is how many previous snapshots to keep as <path>.bak.N.
+	// Defaults to DefaultBackups; negative disables backups.
+	Backups int
+	// RecoverFromBackup opens the newest readable backup when the snapshot
+	// cannot be parsed, instead of refusing to open the store.
+	RecoverFromBackup bool
+}
+
+type walOp string
+
+const (
+	walPut        walOp = "put"
+	walDelete     walOp = "delete"
+	walPutList    walOp = "put-list"
+	walDeleteList walOp = "delete-list"
+)
+
+// walEntry is one change in the write-ahead log. Item is set for item
+// operations and List for list operations. Deletes only carry the UserId and
+// Id. Each line of the log is the JSON array of the entries of one mutation,
+// so a mutation that cascades to other items is replayed whole or not at all;
+// logs written before that hold a single entry per line.
+type walEntry struct {
+	Op   walOp        `json:"op"`
+	Item models.ToDo  `json:"item"`
+	List *models.List `json:"list,omitempty"`
+}
+
+func walPath(fpath string) string {
+	return fpath + ".wal"
+}
+
+func putItem(items map[string]map[uuid.UUID]models.ToDo, item models.ToDo) {
+	if user, exists := items[item.UserId]; exists {
+		user[item.Id] = item
+	} else {
+		items[item.UserId] = map[uuid.UUID]models.ToDo{item.Id: item}
+	}
+}
+
+func removeItem(items map[string]map[uuid.UUID]models.ToDo, userId string, itemId uuid.UUID) {
+	delete(items[userId], itemId)
+	if len(items[userId]) == 0 {
+		delete(items, userId)
+	}
+}
+
+// replayLog applies the entries of the log at path to items and lists and
+// returns how many were applied. A trailing line without a newline is the
+// remains of a mutation whose write was interrupted before it was synced, so
+// it is truncated away, with every entry in it, rather than treated as
+// corruption.
+func replayLog(path string, items map[string]map[uuid.UUID]models.ToDo, lists listMap) (int, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var applied int
+	var valid int64
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(b) > 0 {
+				return applied, file.Truncate(valid)
+			}
+			return applied, nil
+		}
+		if err != nil {
+			return applied, err
+		}
+		entries, err := decodeFrame(bytes.TrimSpace(b))
+		if err != nil {
+			return applied, fmt.Errorf("corrupt entry on line %d of %s: %w", line, path, err)
+		}
+		for _, entry := range entries {
+			switch entry.Op {
+			case walPut:
+				putItem(items, withRevision(entry.Item))
+			case walDelete:
+				removeItem(items, entry.Item.UserId, entry.Item.Id)
+			case walPutList, walDeleteList:
+				if entry.List == nil {
+					return applied, fmt.Errorf("%s without a list on line %d of %s", entry.Op, line, path)
+				}
+				if entry.Op == walPutList {
+					lists.putList(*entry.List)
+				} else {
+					lists.removeList(entry.List.UserId, entry.List.Id)
+				}
+			default:
+				return applied, fmt.Errorf("unknown operation %q on line %d of %s", entry.Op, line, path)
+			}
+			applied++
+		}
+		valid += int64(len(b))
+	}
+}
+
+// decodeFrame reads the entries of one line of the log.
+func decodeFrame(line []byte) ([]walEntry, error) {
+	if len(line) > 0 && line[0] == '[' {
+		var entries []walEntry
+		err := json.Unmarshal(line, &entries)
+		return entries, err
+	}
+	var entry walEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, err
+	}
+	return []walEntry{entry}, nil
+}
+
+// JsonDatastore keeps every item in memory. Mutations are appended to a
+// write-ahead log next to the snapshot file and synced before they are
+// applied, and the log is periodically compacted into the snapshot.
+type JsonDatastore struct {
+	fpath      string
+	mut        sync.Mutex
+	items      map[string]map[uuid.UUID]models.ToDo
+	lists      listMap
+	count      int
+	wal        *os.File
+	walEntries int
+	// walErr is set when a failed append could not be cut back out of the
+	// log. Nothing more is appended after it, as the log would not replay,
+	// until compaction empties the log.
+	walErr       error
+	compactEvery int
+	backups      int
+}
+
+// appendLog writes entries to the log as one line and syncs it.
+// If either fails the log is cut back to where it was, so neither a torn line
+// nor entries whose change was rolled back are left to replay.
+func (ds *JsonDatastore) appendLog(entries ...walEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if ds.walErr != nil {
+		return ds.walErr
+	}
+	if ds.wal == nil {
+		wal, err := os.OpenFile(walPath(ds.fpath), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		ds.wal = wal
+	}
+	frame, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	offset, err := ds.wal.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := ds.wal.Write(append(frame, '\n')); err != nil {
+		return ds.discardLog(offset, err)
+	}
+	if err := ds.wal.Sync(); err != nil {
+		return ds.discardLog(offset, err)
+	}
+	ds.walEntries += len(entries)
+	return nil
+}
+
+// discardLog cuts the log back to offset after an append failed with err.
+func (ds *JsonDatastore) discardLog(offset int64, err error) error {
+	if truncErr := ds.wal.Truncate(offset); truncErr != nil {
+		ds.walErr = fmt.Errorf("write-ahead log %s is damaged: %w", walPath(ds.fpath), errors.Join(err, truncErr))
+		return ds.walErr
+	}
+	if syncErr := ds.wal.Sync(); syncErr != nil {
+		ds.walErr = fmt.Errorf("write-ahead log %s is damaged: %w", walPath(ds.fpath), errors.Join(err, syncErr))
+		return ds.walErr
+	}
+	return err
+}
+
+// jsonTx applies the changes of one mutation to the items straight away and
+// collects them for the log. rollback undoes them if the mutation or the log
+// write fails.
+type jsonTx struct {
+	undoTx
+	entries []walEntry
+	added   int
+}
+
+func (tx *jsonTx) put(item models.ToDo) error {
+	if _, existed := tx.itemMap[item.UserId][item.Id]; !existed {
+		tx.added++
+	}
+	tx.undoTx.put(item)
+	tx.entries = append(tx.entries, walEntry{Op: walPut, Item: item})
+	return nil
+}
+
+func (tx *jsonTx) remove(userId string, itemId uuid.UUID) error {
+	if _, existed := tx.itemMap[userId][itemId]; !existed {
+		return nil
+	}
+	tx.added--
+	tx.undoTx.remove(userId, itemId)
+	tx.entries = append(tx.entries, walEntry{Op: walDelete, Item: models.ToDo{Id: itemId, UserId: userId}})
+	return nil
+}
+
+func (tx *jsonTx) putList(list models.List) error {
+	tx.undoTx.putList(list)
+	tx.entries = append(tx.entries, walEntry{Op: walPutList, List: &list})
+	return nil
+}
+
+func (tx *jsonTx) removeList(userId string, listId uuid.UUID) error {
+	if _, existed := tx.listMap[userId][listId]; !existed {
+		return nil
+	}
+	tx.undoTx.removeList(userId, listId)
+	tx.entries = append(tx.entries, walEntry{Op: walDeleteList, List: &models.List{Id: listId, UserId: userId}})
+	return nil
+}
+
+// mutate runs fn on the items and logs the changes it made. If either fails
+// the items are left as they were.
+func (ds *JsonDatastore) mutate(fn func(tx itemTx) error) error {
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+	tx := &jsonTx{undoTx: undoTx{memTx: memTx{ds.items, ds.lists}}}
+	err := fn(tx)
+	if err == nil {
+		err = ds.appendLog(tx.entries...)
+	}
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	ds.count += tx.added
+	ds.maybeCompact()
+	return nil
+}
+
+func (ds *JsonDatastore) maybeCompact() {
+	if ds.walEntries < max(ds.compactEvery, ds.count) {
+		return
+	}
+	if err := ds.compact(); err != nil {
+		// The log still holds every change, so the store stays consistent and
+		// compaction is retried after the next write.
+		logging.LogWithTrace(context.Background(), map[string]interface{}{"path": ds.fpath}, err.Error())
+	}
+}
+
+// compact writes a snapshot of every item and then empties the log. Entries
+// are idempotent, so a crash between the two steps only replays changes that
+// the snapshot already contains.
+func (ds *JsonDatastore) compact() error {
+	if err := ds.writeSnapshot(); err != nil {
+		return err
+	}
+	if ds.wal == nil {
+		if err := os.Truncate(walPath(ds.fpath), 0); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		ds.walEntries = 0
+		return nil
+	}
+	if err := ds.wal.Truncate(0); err != nil {
+		return err
+	}
+	ds.walEntries = 0
+	if err := ds.wal.Sync(); err != nil {
+		return err
+	}
+	ds.walErr = nil
+	return nil
+}
+
+func (ds *JsonDatastore) writeSnapshot() error {
+	items := make([]models.ToDo, 0, ds.count)
+	for _, user := range ds.items {
+		for _, item := range user {
+			items = append(items, item)
+		}
+	}
+	var lists []models.List
+	for _, user := range ds.lists {
+		for _, list := range user {
+			lists = append(lists, list)
+		}
+	}
+	return writeSnapshotFile(ds.fpath, items, lists, ds.backups)
+}
+
+func (ds *JsonDatastore) AddItem(item models.ToDo) (models.ToDo, error) {
+	err := ds.mutate(func(tx itemTx) (err error) {
+		item, err = addItem(tx, item)
+		return err
+	})
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	return item, nil
+}
+
+func (ds *JsonDatastore) GetItem(userId string, itemId uuid.UUID) (models.ToDo, error) {
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+	return itemMap(ds.items).get(userId, itemId)
+}
+
+func (ds *JsonDatastore) ListItems(userId string, opts ListOptions) (ItemPage, error) {
+	ds.mut.Lock()
+	items := make([]models.ToDo, 0, len(ds.items[userId]))
+	for _, item := range ds.items[userId] {
+		if opts.Filter.Match(item) {
+			items = append(items, item)
+		}
+	}
+	ds.mut.Unlock()
+	return paginate(items, opts)
+}
+
+func (ds *JsonDatastore) UpdateItem(item models.ToDo) (models.ToDo, error) {
+	return ds.ModifyItem(item.UserId, item.Id, replaceWith(item))
+}
+
+func (ds *JsonDatastore) ModifyItem(userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error)) (models.ToDo, error) {
+	return ds.modifyItemThen(userId, itemId, modify, nil)
+}
+
+func (ds *JsonDatastore) modifyItemThen(userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error), then func(tx itemTx, item models.ToDo) error) (models.ToDo, error) {
+	var item models.ToDo
+	err := ds.mutate(func(tx itemTx) (err error) {
+		item, err = modifyThen(tx, userId, itemId, modify, then)
+		return err
+	})
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	return item, nil
+}
+
+func (ds *JsonDatastore) DeleteItem(userId string, itemId uuid.UUID) error {
+	return ds.DeleteItemIf(userId, itemId, nil)
+}
+
+func (ds *JsonDatastore) DeleteItemIf(userId string, itemId uuid.UUID, check func(current models.ToDo) error) error {
+	return ds.mutate(func(tx itemTx) error {
+		return deleteItem(tx, userId, itemId, check)
+	})
+}
+
+func (ds *JsonDatastore) AddList(list models.List) (models.List, error) {
+	err := ds.mutate(func(tx itemTx) (err error) {
+		list, err = addList(tx, list)
+		return err
+	})
+	if err != nil {
+		return models.List{}, err
+	}
+	return list, nil
+}
+
+func (ds *JsonDatastore) GetList(userId string, listId uuid.UUID) (models.List, error) {
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+	return findList(memTx{ds.items, ds.lists}, userId, listId)
+}
+
+func (ds *JsonDatastore) ListLists(userId string) ([]models.List, error) {
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+	return listLists(memTx{ds.items, ds.lists}, userId)
+}
+
+func (ds *JsonDatastore) SharedLists(userId string) ([]models.List, error) {
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+	return ds.lists.shared(userId), nil
+}
+
+func (ds *JsonDatastore) UpdateList(list models.List) (models.List, error) {
+	err := ds.mutate(func(tx itemTx) (err error) {
+		list, err = updateList(tx, list)
+		return err
+	})
+	if err != nil {
+		return models.List{}, err
+	}
+	return list, nil
+}
+
+func (ds *JsonDatastore) DeleteList(userId string, listId uuid.UUID) error {
+	return ds.mutate(func(tx itemTx) error {
+		return deleteList(tx, userId, listId)
+	})
+}
+
+// Close compacts the log into the snapshot. The store can still be used
+// afterwards; the log is reopened by the next write.
+func (ds *JsonDatastore) Close() {
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+	if err := ds.compact(); err != nil {
+		logging.LogWithTrace(context.Background(), map[string]interface{}{"path": ds.fpath}, err.Error())
+	}
+	if ds.wal != nil {
+		ds.wal.Close()
+		ds.wal = nil
+	}
+}
+
+// NewJsonDatastore loads the snapshot at path and replays any changes logged
+// since it was written. A snapshot that cannot be parsed is never overwritten:
+// unless opts.RecoverFromBackup is set, an error wrapping ErrCorruptStore is
+// returned.
+func NewJsonDatastore(path string, opts JsonOptions) (DataStore, error) {
+	if opts.CompactEvery <= 0 {
+		opts.CompactEvery = DefaultCompactEvery
+	}
+	if opts.Backups == 0 {
+		opts.Backups = DefaultBackups
+	}
+	items, lists, err := loadSnapshot(path)
+	if errors.Is(err, ErrCorruptStore) && opts.RecoverFromBackup {
+		var backup string
+		if items, lists, backup, err = recoverSnapshot(path, opts.Backups); err == nil {
+			logging.LogWithTrace(
+				logging.AddTraceID(context.Background()),
+				map[string]interface{}{"path": path, "backup": backup, "corrupt": path + ".corrupt"},
+				"recovered json store from backup",
+			)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries, err := replayLog(walPath(path), items, lists)
+	if err != nil {
+		return nil, err
+	}
+	count := 0
+	for _, user := range items {
+		count += len(user)
+	}
+	return &JsonDatastore{
+		fpath:        path,
+		items:        items,
+		lists:        lists,
+		count:        count,
+		walEntries:   entries,
+		compactEvery: opts.CompactEvery,
+		backups:      opts.Backups,
+		mut:          sync.Mutex{},
+	}, nil
+}
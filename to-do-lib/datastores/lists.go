@@ -0,0 +1,171 @@
+package datastores
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// listMap is the index of lists by user and id that the in-memory and JSON
+// stores keep.
+type listMap map[string]map[uuid.UUID]models.List
+
+func (m listMap) getList(userId string, listId uuid.UUID) (models.List, error) {
+	if list, exists := m[userId][listId]; exists {
+		return list, nil
+	}
+	return models.List{}, &todoerrors.NotFoundError{Message: "List Not Found"}
+}
+
+func (m listMap) lists(userId string) ([]models.List, error) {
+	lists := make([]models.List, 0, len(m[userId]))
+	for _, list := range m[userId] {
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
+
+// shared scans every list for the ones userId is a member of.
+func (m listMap) shared(userId string) []models.List {
+	var lists []models.List
+	for owner, user := range m {
+		if owner == userId {
+			continue
+		}
+		for _, list := range user {
+			if _, ok := list.RoleOf(userId); ok {
+				lists = append(lists, list)
+			}
+		}
+	}
+	return lists
+}
+
+func (m listMap) putList(list models.List) error {
+	if user, exists := m[list.UserId]; exists {
+		user[list.Id] = list
+	} else {
+		m[list.UserId] = map[uuid.UUID]models.List{list.Id: list}
+	}
+	return nil
+}
+
+func (m listMap) removeList(userId string, listId uuid.UUID) error {
+	delete(m[userId], listId)
+	if len(m[userId]) == 0 {
+		delete(m, userId)
+	}
+	return nil
+}
+
+// findList returns a stored list, or the default list if it has not been
+// stored yet.
+func findList(tx itemTx, userId string, listId uuid.UUID) (models.List, error) {
+	list, err := tx.getList(userId, listId)
+	if isNotFound(err) && listId == models.DefaultListId {
+		return models.DefaultList(userId), nil
+	}
+	return list, err
+}
+
+func listLists(tx itemTx, userId string) ([]models.List, error) {
+	lists, err := tx.lists(userId)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(lists, func(l models.List) bool { return l.Id == models.DefaultListId }) {
+		lists = append(lists, models.DefaultList(userId))
+	}
+	slices.SortFunc(lists, func(a, b models.List) int {
+		switch {
+		case a.Id == models.DefaultListId:
+			return -1
+		case b.Id == models.DefaultListId:
+			return 1
+		}
+		return cmp.Or(
+			cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)),
+			cmp.Compare(a.Id.String(), b.Id.String()),
+		)
+	})
+	return lists, nil
+}
+
+func addList(tx itemTx, list models.List) (models.List, error) {
+	now := time.Now().UTC()
+	list.Id = uuid.New()
+	list.CreatedAt = now
+	list.UpdatedAt = now
+	if err := checkListName(tx, list); err != nil {
+		return models.List{}, err
+	}
+	return list, tx.putList(list)
+}
+
+// updateList renames a list and replaces its members. Changing the default
+// list stores it.
+func updateList(tx itemTx, list models.List) (models.List, error) {
+	current, err := findList(tx, list.UserId, list.Id)
+	if err != nil {
+		return models.List{}, err
+	}
+	list.CreatedAt = current.CreatedAt
+	list.UpdatedAt = time.Now().UTC()
+	if err := checkListName(tx, list); err != nil {
+		return models.List{}, err
+	}
+	return list, tx.putList(list)
+}
+
+// deleteList deletes a list and the items in it, with their subtasks.
+func deleteList(tx itemTx, userId string, listId uuid.UUID) error {
+	if listId == models.DefaultListId {
+		return &todoerrors.ValidationError{Field: "id", Err: errors.New("the default list cannot be deleted")}
+	}
+	if _, err := tx.getList(userId, listId); err != nil {
+		return err
+	}
+	items, err := tx.inList(userId, listId)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		// Subtasks go with their parent, so some may already be gone.
+		if err := deleteItem(tx, userId, item.Id, nil); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return tx.removeList(userId, listId)
+}
+
+// checkList returns a ValidationError unless item's list exists.
+func checkList(tx itemTx, item models.ToDo) error {
+	_, err := findList(tx, item.UserId, item.ListId)
+	if isNotFound(err) {
+		return &todoerrors.ValidationError{Field: "list_id", Err: fmt.Errorf("list %s does not exist", item.ListId)}
+	}
+	return err
+}
+
+// checkListName returns a ValidationError if another list of the same user
+// has list's name, ignoring case.
+func checkListName(tx itemTx, list models.List) error {
+	lists, err := listLists(tx, list.UserId)
+	if err != nil {
+		return err
+	}
+	for _, other := range lists {
+		if other.Id != list.Id && strings.EqualFold(other.Name, list.Name) {
+			return &todoerrors.ValidationError{Field: "name", Err: fmt.Errorf("a list named %q already exists", other.Name)}
+		}
+	}
+	return nil
+}
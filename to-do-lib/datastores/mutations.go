@@ -0,0 +1,236 @@
+package datastores
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// prepareAdd and prepareUpdate hold the rules every DataStore applies to a
+// mutation before persisting it, and addItem, modifyItem and deleteItem the
+// rules that span several items, so the stores only differ in how they load
+// and save items.
+
+// itemTx is a store as seen from inside its lock or transaction.
+type itemTx interface {
+	// get returns a NotFoundError if the item does not exist.
+	get(userId string, itemId uuid.UUID) (models.ToDo, error)
+	// children returns the direct subtasks of an item, in no particular order.
+	children(userId string, parentId uuid.UUID) ([]models.ToDo, error)
+	// dependents returns the items that an item blocks, in no particular order.
+	dependents(userId string, blockerId uuid.UUID) ([]models.ToDo, error)
+	// inList returns the items in a list, in no particular order.
+	inList(userId string, listId uuid.UUID) ([]models.ToDo, error)
+	put(item models.ToDo) error
+	remove(userId string, itemId uuid.UUID) error
+	// getList returns a NotFoundError if the list has not been stored, which
+	// the default list is not until it is renamed.
+	getList(userId string, listId uuid.UUID) (models.List, error)
+	// lists returns the stored lists of a user, in no particular order.
+	lists(userId string) ([]models.List, error)
+	putList(list models.List) error
+	removeList(userId string, listId uuid.UUID) error
+}
+
+// txModifier is implemented by the stores of this package and the wrappers
+// around them, so that a wrapper can make further changes in the same
+// transaction as a ModifyItem.
+type txModifier interface {
+	// modifyItemThen is ModifyItem followed, in the same transaction, by
+	// then, which is given the saved item and may change other items through
+	// tx. If then fails nothing is saved. then may be nil.
+	modifyItemThen(userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error), then func(tx itemTx, item models.ToDo) error) (models.ToDo, error)
+}
+
+// modifyItemThen calls the modifyItemThen of ds, which must be a store of
+// this package or a wrapper around one.
+func modifyItemThen(ds DataStore, userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error), then func(tx itemTx, item models.ToDo) error) (models.ToDo, error) {
+	inner, ok := ds.(txModifier)
+	if !ok {
+		return models.ToDo{}, fmt.Errorf("%T cannot make changes in the transaction of ModifyItem", ds)
+	}
+	return inner.modifyItemThen(userId, itemId, modify, then)
+}
+
+// txAdder is implemented by the wrappers that check items as they are added,
+// so that the items a wrapper adds inside a transaction are checked too.
+type txAdder interface {
+	addItemIn(tx itemTx, item models.ToDo) (models.ToDo, error)
+}
+
+// addItemThrough adds item inside the transaction tx with the checks of ds
+// and of the stores it wraps.
+func addItemThrough(ds DataStore, tx itemTx, item models.ToDo) (models.ToDo, error) {
+	if adder, ok := ds.(txAdder); ok {
+		return adder.addItemIn(tx, item)
+	}
+	return addItem(tx, item)
+}
+
+// modifyThen is modifyItemThen inside the transaction tx.
+func modifyThen(tx itemTx, userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error), then func(tx itemTx, item models.ToDo) error) (models.ToDo, error) {
+	item, err := modifyItem(tx, userId, itemId, modify)
+	if err != nil || then == nil {
+		return item, err
+	}
+	return item, then(tx, item)
+}
+
+func addItem(tx itemTx, item models.ToDo) (models.ToDo, error) {
+	item = prepareAdd(item)
+	if err := checkList(tx, item); err != nil {
+		return models.ToDo{}, err
+	}
+	if err := checkParent(tx, item); err != nil {
+		return models.ToDo{}, err
+	}
+	if err := checkBlockers(tx, item, nil); err != nil {
+		return models.ToDo{}, err
+	}
+	if err := checkUnblocked(tx, item); err != nil {
+		return models.ToDo{}, err
+	}
+	if err := tx.put(item); err != nil {
+		return models.ToDo{}, err
+	}
+	return item, rollUp(tx, item.UserId, item.ParentId)
+}
+
+func modifyItem(tx itemTx, userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error)) (models.ToDo, error) {
+	current, err := tx.get(userId, itemId)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	item, err := modify(current)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	if item, err = prepareUpdate(current, item); err != nil {
+		return models.ToDo{}, err
+	}
+	relisted := item.ListId != current.ListId
+	if relisted {
+		if err := checkList(tx, item); err != nil {
+			return models.ToDo{}, err
+		}
+	}
+	moved := !equalPtr(current.ParentId, item.ParentId)
+	if moved || relisted {
+		if err := checkParent(tx, item); err != nil {
+			return models.ToDo{}, err
+		}
+	}
+	if relisted {
+		if err := checkMovable(tx, item); err != nil {
+			return models.ToDo{}, err
+		}
+	}
+	if err := checkBlockers(tx, item, current.BlockedBy); err != nil {
+		return models.ToDo{}, err
+	}
+	if current.EffectiveStatus() != models.StatusDone {
+		if err := checkUnblocked(tx, item); err != nil {
+			return models.ToDo{}, err
+		}
+	}
+	if current.IsOpen() && !item.IsOpen() {
+		if err := checkSubtasksUnblocked(tx, item); err != nil {
+			return models.ToDo{}, err
+		}
+		if item.Progress, err = closeSubtasks(tx, item); err != nil {
+			return models.ToDo{}, err
+		}
+	}
+	if err := tx.put(item); err != nil {
+		return models.ToDo{}, err
+	}
+	if relisted {
+		if err := moveSubtasks(tx, item); err != nil {
+			return models.ToDo{}, err
+		}
+	}
+	if moved {
+		if err := rollUp(tx, userId, current.ParentId); err != nil {
+			return models.ToDo{}, err
+		}
+	}
+	return item, rollUp(tx, userId, item.ParentId)
+}
+
+// deleteItem deletes an item together with all of its subtasks, and removes
+// them from the blockers of other items, unless check fails on the item.
+// check may be nil.
+func deleteItem(tx itemTx, userId string, itemId uuid.UUID, check func(current models.ToDo) error) error {
+	current, err := tx.get(userId, itemId)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(current); err != nil {
+			return err
+		}
+	}
+	if err := removeSubtree(tx, current); err != nil {
+		return err
+	}
+	return rollUp(tx, userId, current.ParentId)
+}
+
+func prepareAdd(item models.ToDo) models.ToDo {
+	now := time.Now().UTC()
+	item.Id = uuid.New()
+	item.Revision = 1
+	item.ResolveStatus(models.ToDo{})
+	item.CreatedAt = now
+	item.UpdatedAt = now
+	item.CompletedAt = nil
+	item.Progress = nil
+	if item.Complete {
+		item.CompletedAt = &now
+	}
+	return item
+}
+
+func isNotFound(err error) bool {
+	var notFound *todoerrors.NotFoundError
+	return errors.As(err, &notFound)
+}
+
+// replaceWith is the ModifyItem function behind UpdateItem.
+func replaceWith(item models.ToDo) func(models.ToDo) (models.ToDo, error) {
+	return func(models.ToDo) (models.ToDo, error) {
+		return item, nil
+	}
+}
+
+// prepareUpdate checks item against the stored current version. A non-zero
+// item.Revision is the revision the caller last saw and must still be current.
+func prepareUpdate(current models.ToDo, item models.ToDo) (models.ToDo, error) {
+	if item.Revision != 0 && item.Revision != current.Revision {
+		return models.ToDo{}, &todoerrors.ConflictError{
+			Message: fmt.Sprintf("ToDo has been modified: revision %d does not match current revision %d", item.Revision, current.Revision),
+		}
+	}
+	now := time.Now().UTC()
+	item.Id = current.Id
+	item.UserId = current.UserId
+	item.Revision = current.Revision + 1
+	item.ResolveStatus(current)
+	item.CreatedAt = current.CreatedAt
+	item.UpdatedAt = now
+	item.Progress = current.Progress
+	switch {
+	case !item.Complete:
+		item.CompletedAt = nil
+	case current.Complete:
+		item.CompletedAt = current.CompletedAt
+	default:
+		item.CompletedAt = &now
+	}
+	return item, nil
+}
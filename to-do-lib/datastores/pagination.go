@@ -0,0 +1,134 @@
+package datastores
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultListLimit = 20
+	MaxListLimit     = 100
+)
+
+type ListOptions struct {
+	Filter Filter
+	Sort   []SortKey
+	Cursor string
+	Limit  int
+}
+
+type ItemPage struct {
+	Items      []models.ToDo `json:"items"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// cursor marks the last item of a page along with the sort it was taken
+// from. It is handed to clients as an opaque base64 string so its contents can
+// change without breaking the API.
+type cursor struct {
+	Sort     string    `json:"sort,omitempty"`
+	Id       uuid.UUID `json:"id"`
+	Title    string    `json:"title,omitempty"`
+	Priority string    `json:"priority,omitempty"`
+	Complete bool      `json:"complete,omitempty"`
+}
+
+func (c cursor) item() models.ToDo {
+	return models.ToDo{Id: c.Id, Title: c.Title, Priority: c.Priority, Complete: c.Complete}
+}
+
+func encodeCursor(keys []SortKey, item models.ToDo) string {
+	b, _ := json.Marshal(cursor{
+		Sort:     sortString(keys),
+		Id:       item.Id,
+		Title:    item.Title,
+		Priority: item.Priority,
+		Complete: item.Complete,
+	})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, &todoerrors.ValidationError{Field: "cursor", Err: errors.New("malformed cursor")}
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, &todoerrors.ValidationError{Field: "cursor", Err: errors.New("malformed cursor")}
+	}
+	return c, nil
+}
+
+func (opts ListOptions) limit() (int, error) {
+	switch {
+	case opts.Limit < 0:
+		return 0, &todoerrors.ValidationError{Field: "limit", Err: fmt.Errorf("limit must be between 1 and %d", MaxListLimit)}
+	case opts.Limit == 0:
+		return DefaultListLimit, nil
+	case opts.Limit > MaxListLimit:
+		return MaxListLimit, nil
+	}
+	return opts.Limit, nil
+}
+
+// paginate orders already filtered items by opts.Sort (then id) and returns
+// the page that follows opts.Cursor. The ordering does not depend on map
+// iteration, so cursors stay valid while items are added or removed between
+// requests.
+func paginate(items []models.ToDo, opts ListOptions) (ItemPage, error) {
+	limit, err := opts.limit()
+	if err != nil {
+		return ItemPage{}, err
+	}
+	slices.SortFunc(items, func(a, b models.ToDo) int {
+		return compareItems(opts.Sort, a, b)
+	})
+	start := 0
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return ItemPage{}, err
+		}
+		if c.Sort != sortString(opts.Sort) {
+			return ItemPage{}, &todoerrors.ValidationError{Field: "cursor", Err: errors.New("cursor was issued for a different sort")}
+		}
+		last := c.item()
+		start = sort.Search(len(items), func(i int) bool {
+			return compareItems(opts.Sort, items[i], last) > 0
+		})
+	}
+	end := min(start+limit, len(items))
+	page := ItemPage{Items: append([]models.ToDo{}, items[start:end]...)}
+	if end < len(items) {
+		page.NextCursor = encodeCursor(opts.Sort, items[end-1])
+	}
+	return page, nil
+}
+
+// ListAll returns every item of the user that matches filter, following the
+// pages of ListItems.
+func ListAll(ds DataStore, userId string, filter Filter) ([]models.ToDo, error) {
+	opts := ListOptions{Filter: filter, Limit: MaxListLimit}
+	var items []models.ToDo
+	for {
+		page, err := ds.ListItems(userId, opts)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+		if page.NextCursor == "" {
+			return items, nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
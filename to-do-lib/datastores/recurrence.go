@@ -0,0 +1,104 @@
+package datastores
+
+import (
+	"time"
+
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// recurrenceStore schedules the next occurrence of recurring items.
+type recurrenceStore struct {
+	DataStore
+	clock func() time.Time
+}
+
+// WithRecurrence returns ds with recurring items rescheduled when they are
+// completed: the completed item gives up its Recurrence to a new copy of
+// itself, which is due at the next occurrence after its due date that is
+// still in the future. Items without a due date become due one interval after
+// they were completed. clock tells the time, and defaults to time.Now.
+// Occurrences are added through ds, so wrap a store that has a Workflow for
+// their status to be checked against it.
+func WithRecurrence(ds DataStore, clock func() time.Time) DataStore {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &recurrenceStore{DataStore: ds, clock: clock}
+}
+
+func (ds *recurrenceStore) addItemIn(tx itemTx, item models.ToDo) (models.ToDo, error) {
+	return addItemThrough(ds.DataStore, tx, item)
+}
+
+func (ds *recurrenceStore) UpdateItem(item models.ToDo) (models.ToDo, error) {
+	return ds.ModifyItem(item.UserId, item.Id, replaceWith(item))
+}
+
+func (ds *recurrenceStore) ModifyItem(userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error)) (models.ToDo, error) {
+	return ds.modifyItemThen(userId, itemId, modify, nil)
+}
+
+// modifyItemThen takes the Recurrence off an item in the same write that
+// completes it, so completing it again cannot schedule a second occurrence,
+// and adds the next occurrence in the same transaction, so the schedule is
+// never lost between the two.
+func (ds *recurrenceStore) modifyItemThen(userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error), then func(tx itemTx, item models.ToDo) error) (models.ToDo, error) {
+	var rule *models.Recurrence
+	return modifyItemThen(ds.DataStore, userId, itemId, func(current models.ToDo) (models.ToDo, error) {
+		item, err := modify(current)
+		if err != nil {
+			return models.ToDo{}, err
+		}
+		next := item
+		next.ResolveStatus(current)
+		rule = nil
+		if item.Recurrence != nil && current.EffectiveStatus() != models.StatusDone && next.Status == models.StatusDone {
+			rule, item.Recurrence = item.Recurrence, nil
+		}
+		return item, nil
+	}, func(tx itemTx, item models.ToDo) error {
+		if rule != nil {
+			if next, ok := ds.nextOccurrence(item, *rule); ok {
+				if _, err := addItemThrough(ds.DataStore, tx, next); err != nil {
+					return err
+				}
+			}
+		}
+		if then != nil {
+			return then(tx, item)
+		}
+		return nil
+	})
+}
+
+// nextOccurrence copies a completed item with the next due date of rule. It
+// returns false once the rule has ended.
+func (ds *recurrenceStore) nextOccurrence(done models.ToDo, rule models.Recurrence) (models.ToDo, bool) {
+	now := ds.clock()
+	due := now
+	if done.DueDate != nil {
+		due = *done.DueDate
+	}
+	next := models.ToDo{
+		Title:       done.Title,
+		Priority:    done.Priority,
+		UserId:      done.UserId,
+		Description: done.Description,
+		Tags:        done.Tags,
+		ParentId:    done.ParentId,
+		ListId:      done.ListId,
+		Recurrence:  &rule,
+	}
+	for {
+		var ok bool
+		if due, ok = rule.Next(due); !ok {
+			return models.ToDo{}, false
+		}
+		if due.After(now) {
+			next.DueDate = &due
+			return next, true
+		}
+	}
+}
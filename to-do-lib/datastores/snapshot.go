@@ -0,0 +1,258 @@
+package datastores
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+const snapshotVersion = 2
+
+// ErrCorruptStore is wrapped by errors for snapshot files that cannot be
+// parsed or fail their checksum.
+var ErrCorruptStore = errors.New("json store is corrupt")
+
+// snapshot is the on-disk format of a JsonDatastore. Checksum is the hex
+// sha256 of the compact JSON encoding of Items followed by that of Lists.
+// Version 1 snapshots have no lists, and files written before the header was
+// introduced hold a bare array of items; both are still accepted, with every
+// item in the default list.
+type snapshot struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Items    json.RawMessage `json:"items"`
+	Lists    json.RawMessage `json:"lists,omitempty"`
+}
+
+func backupPath(fpath string, n int) string {
+	return fmt.Sprintf("%s.bak.%d", fpath, n)
+}
+
+func checksum(parts ...[]byte) string {
+	sum := sha256.New()
+	for _, part := range parts {
+		sum.Write(part)
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+func decodeSnapshot(b []byte) ([]models.ToDo, []models.List, error) {
+	var todos []models.ToDo
+	var lists []models.List
+	b = bytes.TrimSpace(b)
+	switch {
+	case len(b) == 0:
+		return todos, lists, nil
+	case b[0] == '[':
+		err := json.Unmarshal(b, &todos)
+		return todos, lists, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return nil, nil, err
+	}
+	if snap.Version < 1 || snap.Version > snapshotVersion {
+		return nil, nil, fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	var compactItems, compactLists bytes.Buffer
+	if err := json.Compact(&compactItems, snap.Items); err != nil {
+		return nil, nil, err
+	}
+	if len(snap.Lists) > 0 {
+		if err := json.Compact(&compactLists, snap.Lists); err != nil {
+			return nil, nil, err
+		}
+	}
+	if checksum(compactItems.Bytes(), compactLists.Bytes()) != snap.Checksum {
+		return nil, nil, errors.New("checksum mismatch")
+	}
+	if err := json.Unmarshal(snap.Items, &todos); err != nil {
+		return nil, nil, err
+	}
+	if len(snap.Lists) > 0 {
+		if err := json.Unmarshal(snap.Lists, &lists); err != nil {
+			return nil, nil, err
+		}
+	}
+	return todos, lists, nil
+}
+
+// LoadJsonStore reads the items of the snapshot at fpath. A missing or empty
+// file is an empty store; anything that cannot be decoded returns an error
+// wrapping ErrCorruptStore.
+func LoadJsonStore(fpath string) (map[string]map[uuid.UUID]models.ToDo, error) {
+	items, _, err := loadSnapshot(fpath)
+	return items, err
+}
+
+// loadSnapshot reads the items and lists of the snapshot at fpath, as
+// LoadJsonStore does.
+func loadSnapshot(fpath string) (map[string]map[uuid.UUID]models.ToDo, listMap, error) {
+	items := make(map[string]map[uuid.UUID]models.ToDo)
+	lists := make(listMap)
+	b, err := os.ReadFile(fpath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return items, lists, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	todos, stored, err := decodeSnapshot(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %s", ErrCorruptStore, fpath, err)
+	}
+	for _, item := range todos {
+		putItem(items, withRevision(item))
+	}
+	for _, list := range stored {
+		lists.putList(list)
+	}
+	return items, lists, nil
+}
+
+// withRevision gives an item saved before revisions existed revision 1, as
+// the SQL migration does, so that its ETag can be sent back in If-Match.
+func withRevision(item models.ToDo) models.ToDo {
+	if item.Revision < 1 {
+		item.Revision = 1
+	}
+	return item
+}
+
+// writeSnapshotFile atomically replaces fpath with a snapshot of items and
+// lists. The new contents are written and synced to a temporary file in the
+// same directory before being renamed over fpath, so a crash leaves either
+// the old or the new snapshot in place, never a partial one. The previous
+// snapshot is kept as fpath.bak.1, shifting older backups up to
+// fpath.bak.<backups>.
+func writeSnapshotFile(fpath string, items []models.ToDo, lists []models.List, backups int) error {
+	raw, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	var rawLists []byte
+	if len(lists) > 0 {
+		if rawLists, err = json.Marshal(lists); err != nil {
+			return err
+		}
+	}
+	snap := snapshot{Version: snapshotVersion, Checksum: checksum(raw, rawLists), Items: raw, Lists: rawLists}
+	b, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(fpath)
+	tmp, err := os.CreateTemp(dir, filepath.Base(fpath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := rotateBackups(fpath, backups); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fpath); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// rotateBackups shifts fpath.bak.N to fpath.bak.N+1 and links the current
+// snapshot to fpath.bak.1, leaving fpath itself in place until it is replaced.
+func rotateBackups(fpath string, backups int) error {
+	if backups <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(fpath); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	for n := backups - 1; n >= 1; n-- {
+		err := os.Rename(backupPath(fpath, n), backupPath(fpath, n+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	os.Remove(backupPath(fpath, 1))
+	if err := os.Link(fpath, backupPath(fpath, 1)); err == nil {
+		return nil
+	}
+	return copyFile(fpath, backupPath(fpath, 1))
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir makes a rename durable. Not every platform can sync a directory, so
+// failures to open or sync it are ignored.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	d.Sync()
+	return nil
+}
+
+// recoverSnapshot loads the newest backup of fpath that decodes cleanly and
+// moves the unreadable snapshot aside to fpath.corrupt so it is never
+// overwritten.
+func recoverSnapshot(fpath string, backups int) (map[string]map[uuid.UUID]models.ToDo, listMap, string, error) {
+	for n := 1; n <= backups; n++ {
+		path := backupPath(fpath, n)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		items, lists, err := loadSnapshot(path)
+		if err != nil {
+			continue
+		}
+		if err := os.Rename(fpath, fpath+".corrupt"); err != nil {
+			return nil, nil, "", err
+		}
+		if err := copyFile(path, fpath); err != nil {
+			return nil, nil, "", err
+		}
+		return items, lists, path, nil
+	}
+	return nil, nil, "", fmt.Errorf("%w: %s: no readable backup found", ErrCorruptStore, fpath)
+}
@@ -0,0 +1,622 @@
+package datastores
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// sqlMigrations are applied in order and recorded in schema_migrations, so
+// existing entries must never be edited; append new ones instead. Queries use
+// '?' placeholders, which SQLite and MySQL drivers accept.
+var sqlMigrations = []string{
+	`CREATE TABLE todos (
+		user_id  TEXT    NOT NULL,
+		id       TEXT    NOT NULL,
+		title    TEXT    NOT NULL,
+		priority TEXT    NOT NULL,
+		complete BOOLEAN NOT NULL DEFAULT FALSE,
+		PRIMARY KEY (user_id, id)
+	)`,
+	`ALTER TABLE todos ADD COLUMN revision INTEGER NOT NULL DEFAULT 1`,
+	`ALTER TABLE todos ADD COLUMN description TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE todos ADD COLUMN due_date TEXT`,
+	`ALTER TABLE todos ADD COLUMN tags TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE todos ADD COLUMN created_at TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE todos ADD COLUMN updated_at TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE todos ADD COLUMN completed_at TEXT`,
+	`ALTER TABLE todos ADD COLUMN status TEXT NOT NULL DEFAULT ''`,
+	`UPDATE todos SET status = CASE WHEN complete THEN 'done' ELSE 'todo' END`,
+	`ALTER TABLE todos ADD COLUMN parent_id TEXT`,
+	`ALTER TABLE todos ADD COLUMN progress INTEGER`,
+	`CREATE INDEX todos_parent ON todos (user_id, parent_id)`,
+	`ALTER TABLE todos ADD COLUMN blocked_by TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE todos ADD COLUMN recurrence TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE lists (
+		user_id    TEXT NOT NULL,
+		id         TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT '',
+		updated_at TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (user_id, id)
+	)`,
+	// Existing items land in the default list, models.DefaultListId.
+	`ALTER TABLE todos ADD COLUMN list_id TEXT NOT NULL DEFAULT '00000000-0000-0000-0000-000000000000'`,
+	`CREATE INDEX todos_list ON todos (user_id, list_id)`,
+	`ALTER TABLE lists ADD COLUMN members TEXT NOT NULL DEFAULT ''`,
+}
+
+// Times are stored as RFC 3339 text rather than driver-specific timestamp
+// types so that due dates keep the offset they were given in. Tags and
+// blocked_by are JSON arrays and recurrence a JSON object.
+const todoColumns = "id, title, priority, complete, user_id, revision, " +
+	"description, due_date, tags, created_at, updated_at, completed_at, status, parent_id, progress, blocked_by, recurrence, list_id"
+
+// todoSetColumns are the columns written from todoArgs.
+const todoSetColumns = "title, priority, complete, revision, description, " +
+	"due_date, tags, created_at, updated_at, completed_at, status, parent_id, progress, blocked_by, recurrence, list_id"
+
+// Members are a JSON array.
+const listColumns = "id, user_id, name, created_at, updated_at, members"
+
+type SQLDatastore struct {
+	db             *sql.DB
+	getStmt        *sql.Stmt
+	childrenStmt   *sql.Stmt
+	dependentsStmt *sql.Stmt
+	inListStmt     *sql.Stmt
+	insertStmt     *sql.Stmt
+	updateStmt     *sql.Stmt
+	deleteStmt     *sql.Stmt
+	getListStmt    *sql.Stmt
+	listsStmt      *sql.Stmt
+	sharedStmt     *sql.Stmt
+	insertListStmt *sql.Stmt
+	updateListStmt *sql.Stmt
+	deleteListStmt *sql.Stmt
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToDo(row rowScanner) (models.ToDo, error) {
+	var item models.ToDo
+	var id, tags, blockedBy, recurrence, listId, createdAt, updatedAt string
+	var dueDate, completedAt, parentId sql.NullString
+	var progress sql.NullInt64
+	err := row.Scan(&id, &item.Title, &item.Priority, &item.Complete, &item.UserId, &item.Revision,
+		&item.Description, &dueDate, &tags, &createdAt, &updatedAt, &completedAt, &item.Status,
+		&parentId, &progress, &blockedBy, &recurrence, &listId)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	if item.Id, err = uuid.Parse(id); err != nil {
+		return models.ToDo{}, err
+	}
+	if item.ListId, err = uuid.Parse(listId); err != nil {
+		return models.ToDo{}, err
+	}
+	if tags != "" {
+		if err := json.Unmarshal([]byte(tags), &item.Tags); err != nil {
+			return models.ToDo{}, err
+		}
+	}
+	if blockedBy != "" {
+		if err := json.Unmarshal([]byte(blockedBy), &item.BlockedBy); err != nil {
+			return models.ToDo{}, err
+		}
+	}
+	if recurrence != "" {
+		if err := json.Unmarshal([]byte(recurrence), &item.Recurrence); err != nil {
+			return models.ToDo{}, err
+		}
+	}
+	if item.DueDate, err = parseNullTime(dueDate); err != nil {
+		return models.ToDo{}, err
+	}
+	if item.CompletedAt, err = parseNullTime(completedAt); err != nil {
+		return models.ToDo{}, err
+	}
+	if item.CreatedAt, err = parseTime(createdAt); err != nil {
+		return models.ToDo{}, err
+	}
+	if parentId.Valid {
+		parent, err := uuid.Parse(parentId.String)
+		if err != nil {
+			return models.ToDo{}, err
+		}
+		item.ParentId = &parent
+	}
+	if progress.Valid {
+		p := int(progress.Int64)
+		item.Progress = &p
+	}
+	item.UpdatedAt, err = parseTime(updatedAt)
+	return item, err
+}
+
+// todoArgs returns the values of todoSetColumns for item.
+func todoArgs(item models.ToDo) []any {
+	var tags, blockedBy, recurrence string
+	if len(item.Tags) > 0 {
+		b, _ := json.Marshal(item.Tags)
+		tags = string(b)
+	}
+	if len(item.BlockedBy) > 0 {
+		b, _ := json.Marshal(item.BlockedBy)
+		blockedBy = string(b)
+	}
+	if item.Recurrence != nil {
+		b, _ := json.Marshal(item.Recurrence)
+		recurrence = string(b)
+	}
+	var parentId sql.NullString
+	if item.ParentId != nil {
+		parentId = sql.NullString{String: item.ParentId.String(), Valid: true}
+	}
+	var progress sql.NullInt64
+	if item.Progress != nil {
+		progress = sql.NullInt64{Int64: int64(*item.Progress), Valid: true}
+	}
+	return []any{item.Title, item.Priority, item.Complete, item.Revision, item.Description,
+		formatNullTime(item.DueDate), tags, formatTime(item.CreatedAt), formatTime(item.UpdatedAt),
+		formatNullTime(item.CompletedAt), item.Status, parentId, progress, blockedBy, recurrence, item.ListId.String()}
+}
+
+func scanList(row rowScanner) (models.List, error) {
+	var list models.List
+	var id, createdAt, updatedAt, members string
+	err := row.Scan(&id, &list.UserId, &list.Name, &createdAt, &updatedAt, &members)
+	if err != nil {
+		return models.List{}, err
+	}
+	if members != "" {
+		if err := json.Unmarshal([]byte(members), &list.Members); err != nil {
+			return models.List{}, err
+		}
+	}
+	if list.Id, err = uuid.Parse(id); err != nil {
+		return models.List{}, err
+	}
+	if list.CreatedAt, err = parseTime(createdAt); err != nil {
+		return models.List{}, err
+	}
+	list.UpdatedAt, err = parseTime(updatedAt)
+	return list, err
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func formatNullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.Format(time.RFC3339Nano), Valid: true}
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func parseNullTime(s sql.NullString) (*time.Time, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s.String)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (ds *SQLDatastore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqlTx is the itemTx of one database transaction.
+type sqlTx struct {
+	ds *SQLDatastore
+	tx *sql.Tx
+}
+
+func (t sqlTx) get(userId string, itemId uuid.UUID) (models.ToDo, error) {
+	item, err := scanToDo(t.tx.Stmt(t.ds.getStmt).QueryRow(userId, itemId.String()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.ToDo{}, &todoerrors.NotFoundError{Message: "ToDo Not Found"}
+	}
+	return item, err
+}
+
+func (t sqlTx) children(userId string, parentId uuid.UUID) ([]models.ToDo, error) {
+	return t.query(t.ds.childrenStmt, userId, parentId.String())
+}
+
+// dependents matches the quoted id inside the blocked_by JSON array.
+func (t sqlTx) dependents(userId string, blockerId uuid.UUID) ([]models.ToDo, error) {
+	return t.query(t.ds.dependentsStmt, userId, `%"`+blockerId.String()+`"%`)
+}
+
+func (t sqlTx) inList(userId string, listId uuid.UUID) ([]models.ToDo, error) {
+	return t.query(t.ds.inListStmt, userId, listId.String())
+}
+
+func (t sqlTx) query(stmt *sql.Stmt, args ...any) ([]models.ToDo, error) {
+	rows, err := t.tx.Stmt(stmt).Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []models.ToDo
+	for rows.Next() {
+		item, err := scanToDo(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (t sqlTx) put(item models.ToDo) error {
+	res, err := t.tx.Stmt(t.ds.updateStmt).Exec(append(todoArgs(item), item.UserId, item.Id.String())...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = t.tx.Stmt(t.ds.insertStmt).Exec(append([]any{item.Id.String(), item.UserId}, todoArgs(item)...)...)
+	return err
+}
+
+func (t sqlTx) remove(userId string, itemId uuid.UUID) error {
+	_, err := t.tx.Stmt(t.ds.deleteStmt).Exec(userId, itemId.String())
+	return err
+}
+
+func (t sqlTx) getList(userId string, listId uuid.UUID) (models.List, error) {
+	list, err := scanList(t.tx.Stmt(t.ds.getListStmt).QueryRow(userId, listId.String()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.List{}, &todoerrors.NotFoundError{Message: "List Not Found"}
+	}
+	return list, err
+}
+
+func (t sqlTx) lists(userId string) ([]models.List, error) {
+	return queryLists(t.tx.Stmt(t.ds.listsStmt), userId)
+}
+
+func queryLists(stmt *sql.Stmt, args ...any) ([]models.List, error) {
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lists []models.List
+	for rows.Next() {
+		list, err := scanList(rows)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	return lists, rows.Err()
+}
+
+func (t sqlTx) putList(list models.List) error {
+	var members string
+	if len(list.Members) > 0 {
+		b, _ := json.Marshal(list.Members)
+		members = string(b)
+	}
+	res, err := t.tx.Stmt(t.ds.updateListStmt).Exec(list.Name, formatTime(list.CreatedAt), formatTime(list.UpdatedAt), members, list.UserId, list.Id.String())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = t.tx.Stmt(t.ds.insertListStmt).Exec(list.Id.String(), list.UserId, list.Name, formatTime(list.CreatedAt), formatTime(list.UpdatedAt), members)
+	return err
+}
+
+func (t sqlTx) removeList(userId string, listId uuid.UUID) error {
+	_, err := t.tx.Stmt(t.ds.deleteListStmt).Exec(userId, listId.String())
+	return err
+}
+
+func (ds *SQLDatastore) AddItem(item models.ToDo) (models.ToDo, error) {
+	err := ds.inTx(func(tx *sql.Tx) (err error) {
+		item, err = addItem(sqlTx{ds, tx}, item)
+		return err
+	})
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	return item, nil
+}
+
+func (ds *SQLDatastore) GetItem(userId string, itemId uuid.UUID) (models.ToDo, error) {
+	item, err := scanToDo(ds.getStmt.QueryRow(userId, itemId.String()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.ToDo{}, &todoerrors.NotFoundError{Message: "ToDo Not Found"}
+	}
+	return item, err
+}
+
+func (ds *SQLDatastore) ListItems(userId string, opts ListOptions) (ItemPage, error) {
+	where := []string{"user_id = ?"}
+	args := []any{userId}
+	if opts.Filter.Complete != nil {
+		where = append(where, "complete = ?")
+		args = append(args, *opts.Filter.Complete)
+	}
+	if len(opts.Filter.Priorities) > 0 {
+		where = append(where, "priority IN (?"+strings.Repeat(", ?", len(opts.Filter.Priorities)-1)+")")
+		for _, p := range opts.Filter.Priorities {
+			args = append(args, p)
+		}
+	}
+	if opts.Filter.ParentId != nil {
+		where = append(where, "parent_id = ?")
+		args = append(args, opts.Filter.ParentId.String())
+	}
+	if opts.Filter.ListId != nil {
+		where = append(where, "list_id = ?")
+		args = append(args, opts.Filter.ListId.String())
+	}
+	if len(opts.Filter.InLists) > 0 {
+		where = append(where, "list_id IN (?"+strings.Repeat(", ?", len(opts.Filter.InLists)-1)+")")
+		for _, id := range opts.Filter.InLists {
+			args = append(args, id.String())
+		}
+	}
+	if len(opts.Filter.Statuses) > 0 {
+		where = append(where, "status IN (?"+strings.Repeat(", ?", len(opts.Filter.Statuses)-1)+")")
+		for _, s := range opts.Filter.Statuses {
+			args = append(args, s)
+		}
+	}
+	if opts.Filter.TitleContains != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(opts.Filter.TitleContains))
+		where = append(where, `LOWER(title) LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escaped+"%")
+	}
+	rows, err := ds.db.Query(
+		fmt.Sprintf("SELECT %s FROM todos WHERE %s", todoColumns, strings.Join(where, " AND ")),
+		args...,
+	)
+	if err != nil {
+		return ItemPage{}, err
+	}
+	defer rows.Close()
+	items := make([]models.ToDo, 0)
+	for rows.Next() {
+		item, err := scanToDo(rows)
+		if err != nil {
+			return ItemPage{}, err
+		}
+		// The query language is evaluated here rather than translated to SQL.
+		if opts.Filter.Query == nil || opts.Filter.Query.Eval(item) {
+			items = append(items, item)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return ItemPage{}, err
+	}
+	return paginate(items, opts)
+}
+
+func (ds *SQLDatastore) UpdateItem(item models.ToDo) (models.ToDo, error) {
+	return ds.ModifyItem(item.UserId, item.Id, replaceWith(item))
+}
+
+func (ds *SQLDatastore) ModifyItem(userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error)) (models.ToDo, error) {
+	return ds.modifyItemThen(userId, itemId, modify, nil)
+}
+
+func (ds *SQLDatastore) modifyItemThen(userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error), then func(tx itemTx, item models.ToDo) error) (models.ToDo, error) {
+	var item models.ToDo
+	err := ds.inTx(func(tx *sql.Tx) (err error) {
+		item, err = modifyThen(sqlTx{ds, tx}, userId, itemId, modify, then)
+		return err
+	})
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	return item, nil
+}
+
+func (ds *SQLDatastore) DeleteItem(userId string, itemId uuid.UUID) error {
+	return ds.DeleteItemIf(userId, itemId, nil)
+}
+
+func (ds *SQLDatastore) DeleteItemIf(userId string, itemId uuid.UUID, check func(current models.ToDo) error) error {
+	return ds.inTx(func(tx *sql.Tx) error {
+		return deleteItem(sqlTx{ds, tx}, userId, itemId, check)
+	})
+}
+
+func (ds *SQLDatastore) AddList(list models.List) (models.List, error) {
+	err := ds.inTx(func(tx *sql.Tx) (err error) {
+		list, err = addList(sqlTx{ds, tx}, list)
+		return err
+	})
+	if err != nil {
+		return models.List{}, err
+	}
+	return list, nil
+}
+
+func (ds *SQLDatastore) GetList(userId string, listId uuid.UUID) (models.List, error) {
+	var list models.List
+	err := ds.inTx(func(tx *sql.Tx) (err error) {
+		list, err = findList(sqlTx{ds, tx}, userId, listId)
+		return err
+	})
+	return list, err
+}
+
+func (ds *SQLDatastore) ListLists(userId string) ([]models.List, error) {
+	var lists []models.List
+	err := ds.inTx(func(tx *sql.Tx) (err error) {
+		lists, err = listLists(sqlTx{ds, tx}, userId)
+		return err
+	})
+	return lists, err
+}
+
+// SharedLists finds candidates by matching the quoted user id inside the
+// members JSON array, then checks them properly.
+func (ds *SQLDatastore) SharedLists(userId string) ([]models.List, error) {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(userId)
+	candidates, err := queryLists(ds.sharedStmt, userId, `%"user_id":"`+escaped+`"%`)
+	if err != nil {
+		return nil, err
+	}
+	var lists []models.List
+	for _, list := range candidates {
+		if _, ok := list.RoleOf(userId); ok {
+			lists = append(lists, list)
+		}
+	}
+	return lists, nil
+}
+
+func (ds *SQLDatastore) UpdateList(list models.List) (models.List, error) {
+	err := ds.inTx(func(tx *sql.Tx) (err error) {
+		list, err = updateList(sqlTx{ds, tx}, list)
+		return err
+	})
+	if err != nil {
+		return models.List{}, err
+	}
+	return list, nil
+}
+
+func (ds *SQLDatastore) DeleteList(userId string, listId uuid.UUID) error {
+	return ds.inTx(func(tx *sql.Tx) error {
+		return deleteList(sqlTx{ds, tx}, userId, listId)
+	})
+}
+
+func (ds *SQLDatastore) Close() {
+	for _, stmt := range []*sql.Stmt{
+		ds.getStmt, ds.childrenStmt, ds.dependentsStmt, ds.inListStmt, ds.insertStmt, ds.updateStmt, ds.deleteStmt,
+		ds.getListStmt, ds.listsStmt, ds.sharedStmt, ds.insertListStmt, ds.updateListStmt, ds.deleteListStmt,
+	} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	ds.db.Close()
+}
+
+// migrate brings the schema up to date, applying each pending migration in its
+// own transaction.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for version := current + 1; version <= len(sqlMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlMigrations[version-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ds *SQLDatastore) prepare() error {
+	stmts := []struct {
+		dest  **sql.Stmt
+		query string
+	}{
+		{&ds.getStmt, "SELECT " + todoColumns + " FROM todos WHERE user_id = ? AND id = ?"},
+		{&ds.childrenStmt, "SELECT " + todoColumns + " FROM todos WHERE user_id = ? AND parent_id = ?"},
+		{&ds.dependentsStmt, "SELECT " + todoColumns + " FROM todos WHERE user_id = ? AND blocked_by LIKE ?"},
+		{&ds.insertStmt, "INSERT INTO todos (id, user_id, " + todoSetColumns + ") VALUES (?, ?" + strings.Repeat(", ?", strings.Count(todoSetColumns, ",")+1) + ")"},
+		{&ds.updateStmt, "UPDATE todos SET " + strings.ReplaceAll(todoSetColumns, ",", " = ?,") + " = ? WHERE user_id = ? AND id = ?"},
+		{&ds.deleteStmt, "DELETE FROM todos WHERE user_id = ? AND id = ?"},
+		{&ds.inListStmt, "SELECT " + todoColumns + " FROM todos WHERE user_id = ? AND list_id = ?"},
+		{&ds.getListStmt, "SELECT " + listColumns + " FROM lists WHERE user_id = ? AND id = ?"},
+		{&ds.listsStmt, "SELECT " + listColumns + " FROM lists WHERE user_id = ?"},
+		{&ds.sharedStmt, "SELECT " + listColumns + ` FROM lists WHERE user_id <> ? AND members LIKE ? ESCAPE '\'`},
+		{&ds.insertListStmt, "INSERT INTO lists (" + listColumns + ") VALUES (?, ?, ?, ?, ?, ?)"},
+		{&ds.updateListStmt, "UPDATE lists SET name = ?, created_at = ?, updated_at = ?, members = ? WHERE user_id = ? AND id = ?"},
+		{&ds.deleteListStmt, "DELETE FROM lists WHERE user_id = ? AND id = ?"},
+	}
+	for _, s := range stmts {
+		stmt, err := ds.db.Prepare(s.query)
+		if err != nil {
+			return err
+		}
+		*s.dest = stmt
+	}
+	return nil
+}
+
+// NewSQLDatastore opens a database/sql backed DataStore, migrating the schema
+// if needed. The driver must already be registered by the caller, e.g. by
+// importing modernc.org/sqlite for the "sqlite" driver.
+func NewSQLDatastore(driverName string, dsn string) (DataStore, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driverName == "sqlite" {
+		// SQLite has a single writer, and each connection to ":memory:" is a
+		// separate database, so share one connection.
+		db.SetMaxOpenConns(1)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	ds := &SQLDatastore{db: db}
+	if err := ds.prepare(); err != nil {
+		ds.Close()
+		return nil, err
+	}
+	return ds, nil
+}
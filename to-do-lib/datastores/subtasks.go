@@ -0,0 +1,208 @@
+package datastores
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// checkParent returns a ValidationError unless item's parent exists, is in
+// the same list and is not item itself or one of its subtasks.
+func checkParent(tx itemTx, item models.ToDo) error {
+	if item.ParentId == nil {
+		return nil
+	}
+	parent, err := tx.get(item.UserId, *item.ParentId)
+	// A parent in another list is reported as missing, so that members of
+	// one list cannot learn which ids exist in the others.
+	if isNotFound(err) || err == nil && parent.ListId != item.ListId {
+		return &todoerrors.ValidationError{Field: "parent_id", Err: fmt.Errorf("parent %s is not in list %s", *item.ParentId, item.ListId)}
+	}
+	for {
+		if err != nil {
+			return err
+		}
+		if parent.Id == item.Id {
+			return &todoerrors.ValidationError{
+				Field: "parent_id",
+				Err:   errors.New("a ToDo cannot be a subtask of itself or of one of its subtasks"),
+			}
+		}
+		if parent.ParentId == nil {
+			return nil
+		}
+		parent, err = tx.get(item.UserId, *parent.ParentId)
+	}
+}
+
+// moveSubtasks moves the subtasks of parent, at any depth, to parent's list,
+// as a subtask is always in the list of its parent.
+func moveSubtasks(tx itemTx, parent models.ToDo) error {
+	subtasks, err := tx.children(parent.UserId, parent.Id)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subtasks {
+		next := sub
+		next.ListId = parent.ListId
+		if next, err = saveDerived(tx, sub, next); err != nil {
+			return err
+		}
+		if err := moveSubtasks(tx, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeSubtasks moves the open subtasks of parent, at any depth, to parent's
+// status, and returns parent's progress afterwards. Closing an item closes
+// the work under it, so these changes are not checked against a Workflow;
+// checkSubtasksUnblocked checks their blockers first.
+func closeSubtasks(tx itemTx, parent models.ToDo) (*int, error) {
+	subtasks, err := tx.children(parent.UserId, parent.Id)
+	if err != nil {
+		return nil, err
+	}
+	for i, sub := range subtasks {
+		next := sub
+		if sub.IsOpen() {
+			next.Status = parent.Status
+		}
+		if next.Progress, err = closeSubtasks(tx, next); err != nil {
+			return nil, err
+		}
+		if next.Status == sub.Status && equalPtr(next.Progress, sub.Progress) {
+			continue
+		}
+		if subtasks[i], err = saveDerived(tx, sub, next); err != nil {
+			return nil, err
+		}
+	}
+	return models.RollUp(subtasks), nil
+}
+
+// checkSubtasksUnblocked returns a ValidationError if marking parent done
+// would, through closeSubtasks, mark one of its open subtasks done while a
+// blocker of that subtask is still open. Blockers that are closed by the same
+// change do not count.
+func checkSubtasksUnblocked(tx itemTx, parent models.ToDo) error {
+	if parent.Status != models.StatusDone {
+		return nil
+	}
+	closing := map[uuid.UUID]bool{parent.Id: true}
+	var opened []models.ToDo
+	var collect func(id uuid.UUID) error
+	collect = func(id uuid.UUID) error {
+		subtasks, err := tx.children(parent.UserId, id)
+		if err != nil {
+			return err
+		}
+		for _, sub := range subtasks {
+			if sub.IsOpen() {
+				closing[sub.Id] = true
+				opened = append(opened, sub)
+			}
+			if err := collect(sub.Id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := collect(parent.Id); err != nil {
+		return err
+	}
+	for _, sub := range opened {
+		var open []string
+		for _, id := range sub.BlockedBy {
+			if closing[id] {
+				continue
+			}
+			blocker, err := tx.get(sub.UserId, id)
+			if isNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if blocker.IsOpen() {
+				open = append(open, id.String())
+			}
+		}
+		if len(open) > 0 {
+			return &todoerrors.ValidationError{
+				Field: "status",
+				Err:   fmt.Errorf("cannot be done while its subtask %s is blocked by open ToDos: %s", sub.Id, strings.Join(open, ", ")),
+			}
+		}
+	}
+	return nil
+}
+
+// rollUp recomputes the progress of the item with id parentId and then of its
+// ancestors, stopping at the first one whose progress does not change.
+func rollUp(tx itemTx, userId string, parentId *uuid.UUID) error {
+	for parentId != nil {
+		parent, err := tx.get(userId, *parentId)
+		if isNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		subtasks, err := tx.children(userId, parent.Id)
+		if err != nil {
+			return err
+		}
+		next := parent
+		if next.Progress = models.RollUp(subtasks); equalPtr(next.Progress, parent.Progress) {
+			return nil
+		}
+		if _, err := saveDerived(tx, parent, next); err != nil {
+			return err
+		}
+		parentId = parent.ParentId
+	}
+	return nil
+}
+
+func removeSubtree(tx itemTx, item models.ToDo) error {
+	subtasks, err := tx.children(item.UserId, item.Id)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subtasks {
+		if err := removeSubtree(tx, sub); err != nil {
+			return err
+		}
+	}
+	if err := tx.remove(item.UserId, item.Id); err != nil {
+		return err
+	}
+	return unblockDependents(tx, item.UserId, item.Id)
+}
+
+// saveDerived saves a change that the store made to current on its own, such
+// as a new progress, as the next revision of current.
+func saveDerived(tx itemTx, current models.ToDo, next models.ToDo) (models.ToDo, error) {
+	progress := next.Progress
+	next.Revision = 0
+	next, err := prepareUpdate(current, next)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	next.Progress = progress
+	return next, tx.put(next)
+}
+
+func equalPtr[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,62 @@
+package datastores
+
+import (
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// workflowStore restricts the status changes made through a DataStore.
+type workflowStore struct {
+	DataStore
+	workflow models.Workflow
+}
+
+// WithWorkflow returns ds with every status change checked against workflow.
+// Changes that the workflow does not allow fail with a ValidationError.
+// Wrapping a store that already has a workflow replaces it.
+func WithWorkflow(ds DataStore, workflow models.Workflow) DataStore {
+	if w, ok := ds.(*workflowStore); ok {
+		ds = w.DataStore
+	}
+	return &workflowStore{DataStore: ds, workflow: workflow}
+}
+
+func (ds *workflowStore) AddItem(item models.ToDo) (models.ToDo, error) {
+	if err := ds.checkInitial(item); err != nil {
+		return models.ToDo{}, err
+	}
+	return ds.DataStore.AddItem(item)
+}
+
+func (ds *workflowStore) addItemIn(tx itemTx, item models.ToDo) (models.ToDo, error) {
+	if err := ds.checkInitial(item); err != nil {
+		return models.ToDo{}, err
+	}
+	return addItemThrough(ds.DataStore, tx, item)
+}
+
+func (ds *workflowStore) checkInitial(item models.ToDo) error {
+	item.ResolveStatus(models.ToDo{})
+	return ds.workflow.CheckInitial(item.Status)
+}
+
+func (ds *workflowStore) UpdateItem(item models.ToDo) (models.ToDo, error) {
+	return ds.ModifyItem(item.UserId, item.Id, replaceWith(item))
+}
+
+func (ds *workflowStore) ModifyItem(userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error)) (models.ToDo, error) {
+	return ds.modifyItemThen(userId, itemId, modify, nil)
+}
+
+func (ds *workflowStore) modifyItemThen(userId string, itemId uuid.UUID, modify func(current models.ToDo) (models.ToDo, error), then func(tx itemTx, item models.ToDo) error) (models.ToDo, error) {
+	return modifyItemThen(ds.DataStore, userId, itemId, func(current models.ToDo) (models.ToDo, error) {
+		item, err := modify(current)
+		if err != nil {
+			return models.ToDo{}, err
+		}
+		next := item
+		next.ResolveStatus(current)
+		return item, ds.workflow.CheckTransition(current.EffectiveStatus(), next.Status)
+	}, then)
+}
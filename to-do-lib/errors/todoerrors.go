@@ -18,3 +18,33 @@ type ValidationError struct {
 func (e *ValidationError) Error() string {
 	return fmt.Sprintf("Validation error on field %s: %v", e.Field, e.Err)
 }
+
+// ConflictError reports that an item changed since the revision the caller
+// based its update on.
+type ConflictError struct {
+	Message string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
+}
+
+// ForbiddenError reports that the caller may not see or change an item or
+// list.
+type ForbiddenError struct {
+	Message string
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.Message
+}
+
+// UnauthorizedError reports that a request did not say who is making it, or
+// that its credentials are not valid.
+type UnauthorizedError struct {
+	Message string
+}
+
+func (e *UnauthorizedError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,43 @@
+// Package mergepatch applies JSON Merge Patch documents as defined by
+// RFC 7396.
+package mergepatch
+
+import "encoding/json"
+
+const ContentType = "application/merge-patch+json"
+
+// Apply merges patch into doc. Members of a patch object replace the
+// matching members of doc, null removes them and nested objects are merged
+// recursively. A patch that is not an object replaces doc entirely.
+func Apply(doc []byte, patch []byte) ([]byte, error) {
+	var target interface{}
+	if len(doc) > 0 {
+		if err := json.Unmarshal(doc, &target); err != nil {
+			return nil, err
+		}
+	}
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	return json.Marshal(merge(target, p))
+}
+
+func merge(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = merge(t[key], value)
+		}
+	}
+	return t
+}
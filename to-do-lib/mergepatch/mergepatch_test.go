@@ -0,0 +1,51 @@
+package mergepatch_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"go-to-do-app/to-do-lib/mergepatch"
+)
+
+// Test cases from RFC 7396 Appendix A.
+func TestApply(t *testing.T) {
+	cases := []struct {
+		doc, patch, expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, c := range cases {
+		actual, err := mergepatch.Apply([]byte(c.doc), []byte(c.patch))
+		if err != nil {
+			t.Errorf("Apply(%s, %s) failed with %s error", c.doc, c.patch, err)
+			continue
+		}
+		var got, want interface{}
+		json.Unmarshal(actual, &got)
+		json.Unmarshal([]byte(c.expected), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Apply(%s, %s) Expected: %s, Got: %s", c.doc, c.patch, c.expected, actual)
+		}
+	}
+}
+
+func TestApplyRejectsInvalidPatch(t *testing.T) {
+	if _, err := mergepatch.Apply([]byte(`{}`), []byte(`{"a":`)); err == nil {
+		t.Errorf("Expected an error for a malformed patch")
+	}
+}
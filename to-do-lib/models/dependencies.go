@@ -0,0 +1,114 @@
+package models
+
+import (
+	"cmp"
+	"container/heap"
+	"errors"
+	"slices"
+	"strings"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+
+	"github.com/google/uuid"
+)
+
+// ParseBlockers splits a comma separated list of ToDo ids.
+func ParseBlockers(s string) ([]uuid.UUID, error) {
+	var blockers []uuid.UUID
+	for _, part := range ParseTags(s) {
+		id, err := uuid.Parse(strings.TrimSpace(part))
+		if err != nil {
+			return nil, &todoerrors.ValidationError{Field: "blocked_by", Err: err}
+		}
+		blockers = append(blockers, id)
+	}
+	return blockers, nil
+}
+
+// normalizeBlockers drops duplicate blockers, keeping the order they were
+// first given in. No blockers is always nil.
+func normalizeBlockers(id uuid.UUID, blockers []uuid.UUID) ([]uuid.UUID, error) {
+	var normalized []uuid.UUID
+	for _, blocker := range blockers {
+		if blocker == id && id != uuid.Nil {
+			return nil, &todoerrors.ValidationError{Field: "blocked_by", Err: errors.New("a ToDo cannot block itself")}
+		}
+		if !slices.Contains(normalized, blocker) {
+			normalized = append(normalized, blocker)
+		}
+	}
+	return normalized, nil
+}
+
+// Plan orders the open items so that every item comes after the open items
+// blocking it. Whenever several items could come next, the one with the
+// highest priority goes first, then the one due soonest, then the oldest.
+// Blockers missing from items are treated as closed, and items caught in a
+// cycle, which the datastores do not allow, are left out.
+func Plan(items []ToDo) []ToDo {
+	open := make(map[uuid.UUID]ToDo)
+	for _, item := range items {
+		if item.IsOpen() {
+			open[item.Id] = item
+		}
+	}
+	waiting := make(map[uuid.UUID]int)
+	dependents := make(map[uuid.UUID][]uuid.UUID)
+	ready := &readyItems{}
+	for _, item := range open {
+		for _, blocker := range item.BlockedBy {
+			if _, ok := open[blocker]; ok {
+				waiting[item.Id]++
+				dependents[blocker] = append(dependents[blocker], item.Id)
+			}
+		}
+		if waiting[item.Id] == 0 {
+			*ready = append(*ready, item)
+		}
+	}
+	heap.Init(ready)
+	plan := make([]ToDo, 0, len(open))
+	for ready.Len() > 0 {
+		item := heap.Pop(ready).(ToDo)
+		plan = append(plan, item)
+		for _, id := range dependents[item.Id] {
+			if waiting[id]--; waiting[id] == 0 {
+				heap.Push(ready, open[id])
+			}
+		}
+	}
+	return plan
+}
+
+// readyItems is a heap of the items Plan can take next.
+type readyItems []ToDo
+
+func (r readyItems) Len() int      { return len(r) }
+func (r readyItems) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r *readyItems) Push(x any)   { *r = append(*r, x.(ToDo)) }
+
+func (r *readyItems) Pop() any {
+	old := *r
+	item := old[len(old)-1]
+	*r = old[:len(old)-1]
+	return item
+}
+
+func (r readyItems) Less(i, j int) bool {
+	a, b := r[i], r[j]
+	if c := cmp.Compare(PriorityRank(b.Priority), PriorityRank(a.Priority)); c != 0 {
+		return c < 0
+	}
+	switch {
+	case a.DueDate != nil && b.DueDate == nil:
+		return true
+	case a.DueDate == nil && b.DueDate != nil:
+		return false
+	case a.DueDate != nil && !a.DueDate.Equal(*b.DueDate):
+		return a.DueDate.Before(*b.DueDate)
+	}
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.Id.String() < b.Id.String()
+}
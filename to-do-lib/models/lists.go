@@ -0,0 +1,109 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+
+	"github.com/google/uuid"
+)
+
+// DefaultListId is the id of the list every user has without creating it.
+// ToDos that do not name a list, including every ToDo saved before lists
+// existed, are in it.
+var DefaultListId = uuid.Nil
+
+const DefaultListName = "Inbox"
+
+// MaxListName is the longest list name accepted, in characters.
+const MaxListName = 100
+
+type role = string
+
+// Roles give other users access to a list. A viewer can read the list and its
+// ToDos, an editor can also add, change and delete ToDos in it, and an owner
+// can also rename, share and delete the list. The user a list belongs to is
+// always its owner.
+const (
+	RoleViewer role = "viewer"
+	RoleEditor role = "editor"
+	RoleOwner  role = "owner"
+)
+
+// Roles lists every role from least to most access.
+var Roles = []role{RoleViewer, RoleEditor, RoleOwner}
+
+// RoleAllows reports whether r grants at least the access of need.
+func RoleAllows(r role, need role) bool {
+	return slices.Index(Roles, r) >= slices.Index(Roles, need) && slices.Contains(Roles, r)
+}
+
+// Member gives another user a Role on a list.
+type Member struct {
+	UserId string `json:"user_id"`
+	Role   role   `json:"role"`
+}
+
+// List is a named group of one user's ToDos. Every ToDo is in exactly one
+// list. The list and its ToDos belong to UserId, and Members share them.
+// CreatedAt and UpdatedAt are maintained by the datastores.
+type List struct {
+	Id        uuid.UUID `json:"id"`
+	UserId    string    `json:"user_id,omitempty"`
+	Name      string    `json:"name"`
+	Members   []Member  `json:"members,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DefaultList is the user's default list as it is before it is renamed.
+func DefaultList(userId string) List {
+	return List{Id: DefaultListId, UserId: userId, Name: DefaultListName}
+}
+
+// RoleOf returns the role userId has on l, or false if l is not shared with
+// them.
+func (l List) RoleOf(userId string) (role, bool) {
+	if userId == l.UserId {
+		return RoleOwner, true
+	}
+	for _, m := range l.Members {
+		if m.UserId == userId {
+			return m.Role, true
+		}
+	}
+	return "", false
+}
+
+// Validate checks the rules every List must follow, trims its name and
+// lower-cases the roles of its members.
+func (l *List) Validate() error {
+	l.Name = strings.TrimSpace(l.Name)
+	if l.Name == "" {
+		return &todoerrors.ValidationError{Field: "name", Err: errors.New("a list needs a name")}
+	}
+	if utf8.RuneCountInString(l.Name) > MaxListName {
+		return &todoerrors.ValidationError{Field: "name", Err: fmt.Errorf("list names are at most %d characters", MaxListName)}
+	}
+	seen := map[string]bool{l.UserId: true}
+	for i, m := range l.Members {
+		m.Role = strings.ToLower(strings.TrimSpace(m.Role))
+		if !slices.Contains(Roles, m.Role) {
+			return &todoerrors.ValidationError{
+				Field: "members",
+				Err:   fmt.Errorf("invalid role: %s. Valid options are: %s", m.Role, strings.Join(Roles, ", ")),
+			}
+		}
+		if m.UserId == "" || seen[m.UserId] {
+			return &todoerrors.ValidationError{Field: "members", Err: fmt.Errorf("invalid or repeated member: %q", m.UserId)}
+		}
+		seen[m.UserId] = true
+		l.Members[i] = m
+	}
+	return nil
+}
@@ -3,7 +3,9 @@ package models
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 
 	todoerrors "go-to-do-app/to-do-lib/errors"
 
@@ -18,10 +20,8 @@ const (
 	PriorityHigh   priority = "High"
 )
 
-var (
-	V1 = "v1"
-	V2 = "v2"
-)
+// MaxTags is the most tags a single ToDo can carry.
+const MaxTags = 20
 
 func ParsePriority(p string) (priority, error) {
 	if len(p) < 1 {
@@ -36,34 +36,132 @@ func ParsePriority(p string) (priority, error) {
 	}
 }
 
+// PriorityRank orders priorities Low < Medium < High. Unknown priorities rank
+// below Low.
+func PriorityRank(p priority) int {
+	switch p {
+	case PriorityLow:
+		return 1
+	case PriorityMedium:
+		return 2
+	case PriorityHigh:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// ParseDueDate reads a due date as RFC 3339, or as "2006-01-02T15:04" or
+// "2006-01-02" in the named IANA time zone (UTC if empty). An empty string
+// means no due date. The offset is kept, so the date is returned to clients in
+// the zone it was given in.
+func ParseDueDate(s string, zone string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return &t, nil
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, &todoerrors.ValidationError{Field: "time zone", Err: err}
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04", time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, &todoerrors.ValidationError{
+		Field: "due_date",
+		Err:   fmt.Errorf("invalid due date: %s. Use RFC 3339, YYYY-MM-DDTHH:MM or YYYY-MM-DD", s),
+	}
+}
+
+// ParseTags splits a comma separated list of tags.
+func ParseTags(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// normalizeTags trims and lower-cases tags and drops duplicates, keeping the
+// order they were first given in. No tags is always nil.
+func normalizeTags(tags []string) ([]string, error) {
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || strings.ContainsAny(tag, ", ") {
+			return nil, &todoerrors.ValidationError{Field: "tags", Err: fmt.Errorf("invalid tag: %q", tag)}
+		}
+		if !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > MaxTags {
+		return nil, &todoerrors.ValidationError{Field: "tags", Err: fmt.Errorf("at most %d tags are allowed", MaxTags)}
+	}
+	return normalized, nil
+}
+
+// ToDo is the stored form of an item. CreatedAt, UpdatedAt, CompletedAt and
+// Progress are maintained by the datastores and ignored on input; items saved
+// before they were tracked have a zero CreatedAt. Complete is kept in step
+// with Status by ResolveStatus. An item with a ParentId is a subtask of the
+// item with that id and the same UserId, and BlockedBy lists the items of the
+// same user that have to be closed before it can be done. ListId is the List
+// of the same user the item is in. Completing an item with a Recurrence
+// schedules its next occurrence; see datastores.WithRecurrence.
 type ToDo struct {
-	Id       uuid.UUID `json:"id"`
-	Title    string    `json:"title"`
-	Priority priority  `json:"priority"`
-	Complete bool      `json:"complete"`
-	UserId   string    `json:"user_id,omitempty"`
+	Id          uuid.UUID   `json:"id"`
+	Title       string      `json:"title"`
+	Priority    priority    `json:"priority"`
+	Complete    bool        `json:"complete"`
+	Status      status      `json:"status,omitempty"`
+	UserId      string      `json:"user_id,omitempty"`
+	Revision    int         `json:"revision"`
+	Description string      `json:"description,omitempty"`
+	DueDate     *time.Time  `json:"due_date,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	CompletedAt *time.Time  `json:"completed_at,omitempty"`
+	ParentId    *uuid.UUID  `json:"parent_id,omitempty"`
+	Progress    *int        `json:"progress,omitempty"`
+	BlockedBy   []uuid.UUID `json:"blocked_by,omitempty"`
+	Recurrence  *Recurrence `json:"recurrence,omitempty"`
+	ListId      uuid.UUID   `json:"list_id"`
 }
 
-func (t *ToDo) Validate(ver string) error {
+// Validate checks the rules every ToDo must follow, whichever API version it
+// came through, and normalizes its priority and tags.
+func (t *ToDo) Validate() error {
 	if t.Title == "" {
-		return &todoerrors.ValidationError{Field: t.Title, Err: errors.New("invalid title")}
+		return &todoerrors.ValidationError{Field: "title", Err: errors.New("invalid title")}
 	}
 	p, err := ParsePriority(t.Priority)
 	if err != nil {
-		return &todoerrors.ValidationError{Field: t.Priority, Err: err}
+		return &todoerrors.ValidationError{Field: "priority", Err: err}
 	}
 	t.Priority = p
-	switch ver {
-	case V1:
-		if t.UserId != "" {
-			return &todoerrors.ValidationError{Field: fmt.Sprintf("user_id: %s", t.UserId), Err: errors.New("v1 todo api does not allow user_id")}
+	if t.Status != "" {
+		if t.Status, err = ParseStatus(t.Status); err != nil {
+			return err
 		}
-	case V2:
-		if t.UserId == "" {
-			return &todoerrors.ValidationError{Field: fmt.Sprintf("user_id: %s", t.UserId), Err: errors.New("invalid user_id")}
+	}
+	if t.Tags, err = normalizeTags(t.Tags); err != nil {
+		return err
+	}
+	if t.ParentId != nil && *t.ParentId == t.Id {
+		return &todoerrors.ValidationError{Field: "parent_id", Err: errors.New("a ToDo cannot be its own subtask")}
+	}
+	if t.BlockedBy, err = normalizeBlockers(t.Id, t.BlockedBy); err != nil {
+		return err
+	}
+	if t.Recurrence != nil {
+		if err := t.Recurrence.Validate(); err != nil {
+			return err
 		}
-	default:
-		return &todoerrors.NotFoundError{Message: fmt.Sprintf("%d not a valid version", t.Id.Version())}
 	}
 	return nil
 }
@@ -71,14 +169,14 @@ func (t *ToDo) Validate(ver string) error {
 func NewToDo(userId *string, id *string, title *string, priority *string, complete *bool) (ToDo, error) {
 	uuid, err := uuid.Parse(*id)
 	if err != nil {
-		return ToDo{}, err
+		return ToDo{}, &todoerrors.ValidationError{Field: "id", Err: err}
 	}
 	if *title == "" {
-		return ToDo{}, &todoerrors.ValidationError{Field: *title, Err: errors.New("title is required")}
+		return ToDo{}, &todoerrors.ValidationError{Field: "title", Err: errors.New("title is required")}
 	}
 	p, err := ParsePriority(*priority)
 	if err != nil {
-		return ToDo{}, &todoerrors.ValidationError{Field: *priority, Err: err}
+		return ToDo{}, &todoerrors.ValidationError{Field: "priority", Err: err}
 	}
 	return ToDo{Id: uuid, Title: *title, Priority: p, Complete: *complete, UserId: *userId}, nil
 }
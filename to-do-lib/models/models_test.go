@@ -1,9 +1,15 @@
 package models_test
 
 import (
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 
 	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
 )
 
 func TestParsePriorityWithValidStrings(t *testing.T) {
@@ -33,3 +39,188 @@ func TestParsePriorityErrorsWithInvalidString(t *testing.T) {
 		t.Errorf("Expected parser to fail given an input of %s, but returned %s", input, ret)
 	}
 }
+
+func TestPriorityRankOrdersLowMediumHigh(t *testing.T) {
+	low := models.PriorityRank(models.PriorityLow)
+	medium := models.PriorityRank(models.PriorityMedium)
+	high := models.PriorityRank(models.PriorityHigh)
+	if !(low < medium && medium < high) {
+		t.Errorf("Expected Low < Medium < High, Got: %d, %d, %d", low, medium, high)
+	}
+}
+
+func TestParseDueDateKeepsTimeZone(t *testing.T) {
+	inputs := map[string]string{
+		"2024-03-01T17:00:00+02:00": "2024-03-01T17:00:00+02:00",
+		"2024-03-01T17:00":          "2024-03-01T17:00:00+09:00",
+		"2024-03-01":                "2024-03-01T00:00:00+09:00",
+	}
+	for input, expected := range inputs {
+		due, err := models.ParseDueDate(input, "Asia/Tokyo")
+		if err != nil || due.Format(time.RFC3339) != expected {
+			t.Errorf("Expected: %s, Got: %v %v", expected, due, err)
+		}
+	}
+	if due, err := models.ParseDueDate("", ""); due != nil || err != nil {
+		t.Errorf("Expected: no due date, Got: %v %v", due, err)
+	}
+	for _, input := range []string{"tomorrow", "2024-13-01"} {
+		if _, err := models.ParseDueDate(input, ""); err == nil {
+			t.Errorf("Expected an error for %s", input)
+		}
+	}
+}
+
+func TestValidateNormalizesTags(t *testing.T) {
+	item := models.ToDo{Title: "test", Priority: "low", UserId: "user", Tags: models.ParseTags(" Home,work,home ")}
+	if err := item.Validate(); err != nil {
+		t.Fatalf("Expected no error, Got: %s", err)
+	}
+	expected := []string{"home", "work"}
+	if !slices.Equal(item.Tags, expected) {
+		t.Errorf("Expected: %+v, Got: %+v", expected, item.Tags)
+	}
+	item.Tags = []string{"two words"}
+	if err := item.Validate(); err == nil {
+		t.Errorf("Expected an error for tag %q", item.Tags[0])
+	}
+}
+
+func TestParseStatusAcceptsSpellings(t *testing.T) {
+	for _, input := range []string{"in-progress", "In Progress", "IN_PROGRESS"} {
+		if s, err := models.ParseStatus(input); err != nil || s != models.StatusInProgress {
+			t.Errorf("Expected: %s, Got: %s (%v)", models.StatusInProgress, s, err)
+		}
+	}
+	if _, err := models.ParseStatus("waiting"); err == nil {
+		t.Errorf("Expected an error for an unknown status")
+	}
+}
+
+func TestLoadWorkflowRejectsUnknownStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workflow.json")
+	os.WriteFile(path, []byte(`{"transitions": {"todo": ["done"], "done": ["todo"]}}`), 0644)
+	w, err := models.LoadWorkflow(path)
+	if err != nil {
+		t.Fatalf("LoadWorkflow failed with %s error", err)
+	}
+	if w.CheckTransition(models.StatusTodo, models.StatusDone) != nil || w.CheckTransition(models.StatusTodo, models.StatusBlocked) == nil {
+		t.Errorf("Expected only todo -> done, Got: %+v", w)
+	}
+	os.WriteFile(path, []byte(`{"transitions": {"todo": ["waiting"]}}`), 0644)
+	if _, err := models.LoadWorkflow(path); err == nil {
+		t.Errorf("Expected an error for an unknown status")
+	}
+}
+
+func TestRollUpCountsOpenSubtasksByProgress(t *testing.T) {
+	half := 50
+	subtasks := []models.ToDo{
+		{Status: models.StatusDone},
+		{Status: models.StatusInProgress, Progress: &half},
+		{Status: models.StatusTodo},
+		{Status: models.StatusCancelled},
+	}
+	if got := models.RollUp(subtasks); got == nil || *got != 50 {
+		t.Errorf("Expected: 50, Got: %v", got)
+	}
+	if got := models.RollUp(subtasks[3:]); got != nil {
+		t.Errorf("Expected: nil, Got: %d", *got)
+	}
+}
+
+func TestPlanOrdersBlockersFirstThenByPriority(t *testing.T) {
+	ids := make([]uuid.UUID, 5)
+	for i := range ids {
+		ids[i] = uuid.New()
+	}
+	items := []models.ToDo{
+		{Id: ids[0], Title: "release", Priority: models.PriorityHigh, BlockedBy: []uuid.UUID{ids[1], ids[4]}},
+		{Id: ids[1], Title: "write notes", Priority: models.PriorityLow, CreatedAt: time.Unix(2, 0)},
+		{Id: ids[2], Title: "fix bug", Priority: models.PriorityMedium},
+		{Id: ids[3], Title: "done already", Priority: models.PriorityHigh, Complete: true},
+		{Id: ids[4], Title: "tag build", Priority: models.PriorityLow, CreatedAt: time.Unix(1, 0), BlockedBy: []uuid.UUID{ids[3]}},
+	}
+	var got []string
+	for _, item := range models.Plan(items) {
+		got = append(got, item.Title)
+	}
+	expected := []string{"fix bug", "tag build", "write notes", "release"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Expected: %v, Got: %v", expected, got)
+	}
+}
+
+func TestRecurrenceNext(t *testing.T) {
+	until := time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)
+	friday := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	cases := []struct {
+		rule     models.Recurrence
+		from     time.Time
+		expected string
+	}{
+		{models.Recurrence{Frequency: models.Daily, Interval: 2}, friday, "2024-03-03T09:30:00Z"},
+		{models.Recurrence{Frequency: models.Weekly}, friday, "2024-03-08T09:30:00Z"},
+		{models.Recurrence{Frequency: models.Weekly, Weekdays: []string{"MO", "FR"}}, friday, "2024-03-04T09:30:00Z"},
+		{models.Recurrence{Frequency: models.Weekly, Weekdays: []string{"MO", "SA"}}, friday, "2024-03-02T09:30:00Z"},
+		{models.Recurrence{Frequency: models.Weekly, Interval: 2, Weekdays: []string{"TU"}}, friday, "2024-03-12T09:30:00Z"},
+		{models.Recurrence{Frequency: models.Monthly}, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), "2024-03-31T00:00:00Z"},
+		{models.Recurrence{Frequency: models.Monthly, Until: &until}, friday, "ended"},
+	}
+	for _, c := range cases {
+		got := "ended"
+		if next, ok := c.rule.Next(c.from); ok {
+			got = next.Format(time.RFC3339)
+		}
+		if got != c.expected {
+			t.Errorf("%s from %s Expected: %s, Got: %s", c.rule, c.from.Format(time.RFC3339), c.expected, got)
+		}
+	}
+}
+
+func TestParseRecurrenceNormalizesRule(t *testing.T) {
+	rule, err := models.ParseRecurrence("FREQ=weekly;INTERVAL=2;BYDAY=fr,mo,fr;UNTIL=2025-12-31")
+	if err != nil {
+		t.Fatalf("ParseRecurrence failed with %s error", err)
+	}
+	expected := "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,FR;UNTIL=2025-12-31T23:59:59Z"
+	if rule.String() != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, rule)
+	}
+	for _, invalid := range []string{"FREQ=YEARLY", "FREQ=DAILY;BYDAY=MO", "FREQ=WEEKLY;BYDAY=XX", "FREQ=DAILY;INTERVAL=-1", "FREQ=DAILY;COUNT=3"} {
+		if _, err := models.ParseRecurrence(invalid); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestListRoles(t *testing.T) {
+	list := models.List{UserId: "owner", Name: "Team", Members: []models.Member{{UserId: "ed", Role: " Editor"}, {UserId: "vi", Role: "viewer"}}}
+	if err := list.Validate(); err != nil {
+		t.Fatalf("Validate failed with %s error", err)
+	}
+	cases := []struct {
+		userId  string
+		need    string
+		allowed bool
+	}{
+		{"owner", models.RoleOwner, true},
+		{"ed", models.RoleEditor, true},
+		{"ed", models.RoleOwner, false},
+		{"vi", models.RoleViewer, true},
+		{"vi", models.RoleEditor, false},
+		{"stranger", models.RoleViewer, false},
+	}
+	for _, c := range cases {
+		role, ok := list.RoleOf(c.userId)
+		if allowed := ok && models.RoleAllows(role, c.need); allowed != c.allowed {
+			t.Errorf("%s as %s Expected: %t, Got: %t", c.userId, c.need, c.allowed, allowed)
+		}
+	}
+	for _, members := range [][]models.Member{{{UserId: "owner", Role: "viewer"}}, {{UserId: "x", Role: "admin"}}, {{UserId: "x", Role: "viewer"}, {UserId: "x", Role: "editor"}}} {
+		invalid := models.List{UserId: "owner", Name: "Team", Members: members}
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Expected members %+v to be rejected", members)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+)
+
+const (
+	Daily   = "daily"
+	Weekly  = "weekly"
+	Monthly = "monthly"
+)
+
+// MaxInterval is the largest Recurrence.Interval accepted.
+const MaxInterval = 1000
+
+// weekdays are the RRULE names of the days of the week, starting on Monday as
+// RRULE weeks do.
+var weekdays = []string{"MO", "TU", "WE", "TH", "FR", "SA", "SU"}
+
+// Recurrence repeats a ToDo every Interval days, weeks or months. Weekly
+// recurrences can name the Weekdays they fall on. No occurrence is due after
+// Until.
+type Recurrence struct {
+	Frequency string     `json:"frequency"`
+	Interval  int        `json:"interval,omitempty"`
+	Weekdays  []string   `json:"weekdays,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+}
+
+// ParseRecurrence reads an RRULE-style rule such as
+// "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,FR;UNTIL=2025-12-31". UNTIL is RFC 3339 or a
+// date, which is read as the end of that day in UTC. An empty string means no
+// recurrence.
+func ParseRecurrence(s string) (*Recurrence, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var r Recurrence
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimSpace(s), "RRULE:"), ";") {
+		key, value, _ := strings.Cut(part, "=")
+		var err error
+		switch strings.ToUpper(strings.TrimSpace(key)) {
+		case "FREQ":
+			r.Frequency = value
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(value)
+		case "BYDAY":
+			r.Weekdays = strings.Split(value, ",")
+		case "UNTIL":
+			var until time.Time
+			if until, err = time.Parse(time.RFC3339, value); err != nil {
+				until, err = time.Parse(time.DateOnly, value)
+				until = until.Add(24*time.Hour - time.Nanosecond)
+			}
+			r.Until = &until
+		default:
+			err = fmt.Errorf("unknown part %q", part)
+		}
+		if err != nil {
+			return nil, &todoerrors.ValidationError{Field: "recurrence", Err: err}
+		}
+	}
+	return &r, r.Validate()
+}
+
+// String formats r as an RRULE-style rule that ParseRecurrence reads back.
+func (r Recurrence) String() string {
+	parts := []string{"FREQ=" + strings.ToUpper(r.Frequency)}
+	if r.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", r.Interval))
+	}
+	if len(r.Weekdays) > 0 {
+		parts = append(parts, "BYDAY="+strings.Join(r.Weekdays, ","))
+	}
+	if r.Until != nil {
+		parts = append(parts, "UNTIL="+r.Until.Format(time.RFC3339))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Validate checks r and normalizes its frequency, interval and weekdays.
+func (r *Recurrence) Validate() error {
+	r.Frequency = strings.ToLower(strings.TrimSpace(r.Frequency))
+	switch r.Frequency {
+	case Daily, Weekly, Monthly:
+	default:
+		return &todoerrors.ValidationError{
+			Field: "recurrence",
+			Err:   fmt.Errorf("invalid frequency: %s. Valid options are: %s, %s, %s", r.Frequency, Daily, Weekly, Monthly),
+		}
+	}
+	if r.Interval == 0 {
+		r.Interval = 1
+	}
+	if r.Interval < 1 || r.Interval > MaxInterval {
+		return &todoerrors.ValidationError{Field: "recurrence", Err: fmt.Errorf("interval must be between 1 and %d", MaxInterval)}
+	}
+	if len(r.Weekdays) > 0 && r.Frequency != Weekly {
+		return &todoerrors.ValidationError{Field: "recurrence", Err: errors.New("weekdays are only allowed on weekly recurrences")}
+	}
+	var days []string
+	for _, day := range r.Weekdays {
+		day = strings.ToUpper(strings.TrimSpace(day))
+		if !slices.Contains(weekdays, day) {
+			return &todoerrors.ValidationError{
+				Field: "recurrence",
+				Err:   fmt.Errorf("invalid weekday: %s. Valid options are: %s", day, strings.Join(weekdays, ", ")),
+			}
+		}
+		if !slices.Contains(days, day) {
+			days = append(days, day)
+		}
+	}
+	slices.SortFunc(days, func(a, b string) int {
+		return slices.Index(weekdays, a) - slices.Index(weekdays, b)
+	})
+	r.Weekdays = days
+	return nil
+}
+
+// Next returns the first occurrence after t, keeping t's time of day and
+// location. Monthly recurrences skip months that do not have t's day, as
+// RRULE does, so the 31st stays on the 31st. It returns false once the
+// recurrence has ended.
+func (r Recurrence) Next(t time.Time) (time.Time, bool) {
+	interval := max(r.Interval, 1)
+	var next time.Time
+	switch {
+	case r.Frequency == Daily:
+		next = t.AddDate(0, 0, interval)
+	case r.Frequency == Weekly && len(r.Weekdays) == 0:
+		next = t.AddDate(0, 0, 7*interval)
+	case r.Frequency == Weekly:
+		next = r.nextWeekday(t, interval)
+	case r.Frequency == Monthly:
+		for months := interval; ; months += interval {
+			if next = t.AddDate(0, months, 0); next.Day() == t.Day() {
+				break
+			}
+		}
+	default:
+		return time.Time{}, false
+	}
+	if r.Until != nil && next.After(*r.Until) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+// nextWeekday returns the next of r.Weekdays later in t's week, or the first
+// of them interval weeks on.
+func (r Recurrence) nextWeekday(t time.Time, interval int) time.Time {
+	today := weekdayIndex(t.Weekday())
+	for _, day := range r.Weekdays {
+		if i := slices.Index(weekdays, day); i > today {
+			return t.AddDate(0, 0, i-today)
+		}
+	}
+	first := slices.Index(weekdays, r.Weekdays[0])
+	return t.AddDate(0, 0, 7*interval-today+first)
+}
+
+// weekdayIndex numbers the days of the week from Monday.
+func weekdayIndex(d time.Weekday) int {
+	return (int(d) + 6) % 7
+}
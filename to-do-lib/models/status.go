@@ -0,0 +1,177 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+)
+
+type status = string
+
+const (
+	StatusTodo       status = "todo"
+	StatusInProgress status = "in-progress"
+	StatusBlocked    status = "blocked"
+	StatusDone       status = "done"
+	StatusCancelled  status = "cancelled"
+)
+
+// Statuses lists every status in workflow order.
+var Statuses = []status{StatusTodo, StatusInProgress, StatusBlocked, StatusDone, StatusCancelled}
+
+// OpenStatuses are the statuses of items that still need work.
+var OpenStatuses = []status{StatusTodo, StatusInProgress, StatusBlocked}
+
+// ParseStatus accepts a status in any case, with '_' or ' ' in place of '-'.
+func ParseStatus(s string) (status, error) {
+	normalized := strings.NewReplacer("_", "-", " ", "-").Replace(strings.ToLower(strings.TrimSpace(s)))
+	if slices.Contains(Statuses, normalized) {
+		return normalized, nil
+	}
+	return "", &todoerrors.ValidationError{
+		Field: "status",
+		Err:   fmt.Errorf("invalid status: %s. Valid options are: %s", s, strings.Join(Statuses, ", ")),
+	}
+}
+
+// EffectiveStatus is t.Status, or for items saved before statuses existed, the
+// status implied by Complete.
+func (t ToDo) EffectiveStatus() status {
+	switch {
+	case t.Status != "":
+		return t.Status
+	case t.Complete:
+		return StatusDone
+	default:
+		return StatusTodo
+	}
+}
+
+// IsOpen reports whether t is neither done nor cancelled.
+func (t ToDo) IsOpen() bool {
+	return slices.Contains(OpenStatuses, t.EffectiveStatus())
+}
+
+// ResolveStatus makes Status and Complete agree after t has been changed from
+// previous. A changed Status wins; otherwise a changed Complete moves the item
+// to done, or from done back to todo. Complete is true exactly when the
+// status is done, which keeps it meaningful to clients that only know about
+// Complete.
+func (t *ToDo) ResolveStatus(previous ToDo) {
+	from := previous.EffectiveStatus()
+	switch {
+	case t.Status != "" && t.Status != from:
+	case t.Complete != (from == StatusDone):
+		if t.Complete {
+			t.Status = StatusDone
+		} else {
+			t.Status = StatusTodo
+		}
+	default:
+		t.Status = from
+	}
+	t.Complete = t.Status == StatusDone
+}
+
+// Workflow is the graph of allowed status changes. Moving to the status an
+// item already has is always allowed.
+type Workflow struct {
+	// Initial lists the statuses new items may start in. Empty allows any.
+	Initial     []status            `json:"initial,omitempty"`
+	Transitions map[status][]status `json:"transitions"`
+}
+
+// DefaultWorkflow lets items move freely between the open statuses and be
+// reopened once done or cancelled, but a cancelled item has to go back to
+// todo before work on it can start again.
+func DefaultWorkflow() Workflow {
+	return Workflow{
+		Transitions: map[status][]status{
+			StatusTodo:       {StatusInProgress, StatusBlocked, StatusDone, StatusCancelled},
+			StatusInProgress: {StatusTodo, StatusBlocked, StatusDone, StatusCancelled},
+			StatusBlocked:    {StatusTodo, StatusInProgress, StatusDone, StatusCancelled},
+			StatusDone:       {StatusTodo, StatusInProgress},
+			StatusCancelled:  {StatusTodo},
+		},
+	}
+}
+
+// LoadWorkflow reads a Workflow from a JSON file such as
+//
+//	{"initial": ["todo"], "transitions": {"todo": ["done"], "done": ["todo"]}}
+func LoadWorkflow(path string) (Workflow, error) {
+	var w Workflow
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return w, err
+	}
+	if err := json.Unmarshal(b, &w); err != nil {
+		return w, fmt.Errorf("workflow %s: %w", path, err)
+	}
+	if err := w.Validate(); err != nil {
+		return w, fmt.Errorf("workflow %s: %w", path, err)
+	}
+	return w, nil
+}
+
+// Validate checks that the workflow only refers to known statuses.
+func (w Workflow) Validate() error {
+	check := func(s status) error {
+		if !slices.Contains(Statuses, s) {
+			return fmt.Errorf("unknown status %q. Valid options are: %s", s, strings.Join(Statuses, ", "))
+		}
+		return nil
+	}
+	for _, s := range w.Initial {
+		if err := check(s); err != nil {
+			return err
+		}
+	}
+	for from, to := range w.Transitions {
+		if err := check(from); err != nil {
+			return err
+		}
+		for _, s := range to {
+			if err := check(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Next returns the statuses an item can move to from the given one.
+func (w Workflow) Next(from status) []status {
+	return w.Transitions[from]
+}
+
+// CheckInitial returns a ValidationError if new items cannot start in s.
+func (w Workflow) CheckInitial(s status) error {
+	if len(w.Initial) == 0 || slices.Contains(w.Initial, s) {
+		return nil
+	}
+	return &todoerrors.ValidationError{
+		Field: "status",
+		Err:   fmt.Errorf("new items cannot start as %s. Allowed: %s", s, strings.Join(w.Initial, ", ")),
+	}
+}
+
+// CheckTransition returns a ValidationError if the workflow does not allow
+// moving from one status to the other.
+func (w Workflow) CheckTransition(from status, to status) error {
+	if from == to || slices.Contains(w.Next(from), to) {
+		return nil
+	}
+	allowed := "none"
+	if next := w.Next(from); len(next) > 0 {
+		allowed = strings.Join(next, ", ")
+	}
+	return &todoerrors.ValidationError{
+		Field: "status",
+		Err:   fmt.Errorf("cannot move from %s to %s. Allowed: %s", from, to, allowed),
+	}
+}
@@ -0,0 +1,25 @@
+package models
+
+// RollUp returns the completion percentage of an item with the given
+// subtasks. A done subtask counts as 100%, an open one as its own Progress
+// (0% if it has no subtasks of its own) and cancelled ones are left out. It
+// returns nil when no subtasks count.
+func RollUp(subtasks []ToDo) *int {
+	var total, counted int
+	for _, sub := range subtasks {
+		switch {
+		case sub.EffectiveStatus() == StatusCancelled:
+			continue
+		case sub.EffectiveStatus() == StatusDone:
+			total += 100
+		case sub.Progress != nil:
+			total += *sub.Progress
+		}
+		counted++
+	}
+	if counted == 0 {
+		return nil
+	}
+	progress := total / counted
+	return &progress
+}
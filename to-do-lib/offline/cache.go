@@ -0,0 +1,245 @@
+package offline
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"go-to-do-app/to-do-lib/mergepatch"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// Op is what a Change does to a ToDo.
+type Op string
+
+const (
+	OpCreate Op = "create"
+	OpUpdate Op = "update"
+	OpPatch  Op = "patch"
+	OpDelete Op = "delete"
+)
+
+// Change is a change to a ToDo waiting in the outbox to be sent to the server.
+type Change struct {
+	// Id is sent as the Idempotency-Key of creates, so a create that is
+	// replayed after its response was lost still adds one ToDo.
+	Id uuid.UUID `json:"id"`
+	Op Op        `json:"op"`
+	// Item is the ToDo as the change leaves it. Deletes only use its UserId
+	// and Id.
+	Item models.ToDo `json:"item"`
+	// Patch is the JSON Merge Patch a patch sends instead of Item, so the
+	// fields it leaves out keep whatever values they have on the server.
+	Patch map[string]interface{} `json:"patch,omitempty"`
+	// BaseRevision is the revision of the ToDo on the server when the change
+	// was made, so changes to a ToDo that changed on the server since are
+	// noticed. It is 0 for creates, and patches do not check it.
+	BaseRevision int       `json:"base_revision"`
+	QueuedAt     time.Time `json:"queued_at"`
+}
+
+// Cache is what the CLI knows without the server: the ToDos it last saw, with
+// the changes in the Outbox applied, and the Outbox of changes that have not
+// reached the server yet, oldest first. ToDos created offline have a local id
+// and revision 0 until they are sent.
+type Cache struct {
+	Items    []models.ToDo `json:"items"`
+	Outbox   []Change      `json:"outbox"`
+	LastSync time.Time     `json:"last_sync,omitempty"`
+}
+
+// LoadCache reads the cache saved at path. A missing file is an empty cache.
+func LoadCache(path string) (*Cache, error) {
+	cache := &Cache{}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, cache); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// Save writes the cache to path, replacing the file atomically so a crash
+// never loses the outbox.
+func (c *Cache) Save(path string) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (c *Cache) find(userId string, id uuid.UUID) int {
+	return slices.IndexFunc(c.Items, func(item models.ToDo) bool {
+		return item.UserId == userId && item.Id == id
+	})
+}
+
+// Get returns the cached ToDo.
+func (c *Cache) Get(userId string, id uuid.UUID) (models.ToDo, bool) {
+	if i := c.find(userId, id); i >= 0 {
+		return c.Items[i], true
+	}
+	return models.ToDo{}, false
+}
+
+// Pending reports whether the outbox holds a change to the ToDo.
+func (c *Cache) Pending(userId string, id uuid.UUID) bool {
+	return c.pending(userId, id) >= 0
+}
+
+func (c *Cache) pending(userId string, id uuid.UUID) int {
+	return slices.IndexFunc(c.Outbox, func(change Change) bool {
+		return change.Item.UserId == userId && change.Item.Id == id
+	})
+}
+
+func (c *Cache) put(item models.ToDo) {
+	if i := c.find(item.UserId, item.Id); i >= 0 {
+		c.Items[i] = item
+		return
+	}
+	c.Items = append(c.Items, item)
+}
+
+func (c *Cache) remove(userId string, id uuid.UUID) {
+	if i := c.find(userId, id); i >= 0 {
+		c.Items = slices.Delete(c.Items, i, i+1)
+	}
+}
+
+// queue applies change to the cached ToDos and adds it to the outbox. A
+// change to a ToDo that already has one waiting is folded into it, so the
+// server only sees where the ToDo ended up: a ToDo created and deleted offline
+// never reaches it at all, and a patch of a ToDo with a create or update
+// waiting is sent as part of it.
+func (c *Cache) queue(change Change) {
+	switch change.Op {
+	case OpDelete:
+		c.remove(change.Item.UserId, change.Item.Id)
+	default:
+		c.put(change.Item)
+	}
+	i := c.pending(change.Item.UserId, change.Item.Id)
+	if i < 0 || change.Op == OpCreate {
+		c.Outbox = append(c.Outbox, change)
+		return
+	}
+	waiting := &c.Outbox[i]
+	switch {
+	case waiting.Op == OpCreate && change.Op == OpDelete:
+		c.Outbox = slices.Delete(c.Outbox, i, i+1)
+	case waiting.Op == OpDelete:
+		// The ToDo is already gone; there is nothing left to change.
+		c.remove(change.Item.UserId, change.Item.Id)
+	case change.Op == OpDelete:
+		waiting.Op = OpDelete
+		waiting.Item = change.Item
+		waiting.Patch = nil
+	case waiting.Op == OpPatch && change.Op == OpPatch:
+		if waiting.Patch == nil {
+			waiting.Patch = make(map[string]interface{})
+		}
+		for name, value := range change.Patch {
+			waiting.Patch[name] = value
+		}
+		waiting.Item = change.Item
+	case waiting.Op == OpPatch:
+		waiting.Op = OpUpdate
+		waiting.Item = change.Item
+		waiting.Patch = nil
+		waiting.BaseRevision = change.BaseRevision
+	default:
+		waiting.Item = change.Item
+	}
+}
+
+// applyPatch merges patch into item the way the server does, keeping its id
+// and user.
+func applyPatch(item models.ToDo, patch map[string]interface{}) (models.ToDo, error) {
+	doc, err := json.Marshal(item)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	p, err := json.Marshal(patch)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	merged, err := mergepatch.Apply(doc, p)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	var patched models.ToDo
+	if err := json.Unmarshal(merged, &patched); err != nil {
+		return models.ToDo{}, err
+	}
+	patched.Id = item.Id
+	patched.UserId = item.UserId
+	patched.ResolveStatus(item)
+	return patched, nil
+}
+
+// rename replaces the local id of a ToDo created offline with the id the
+// server gave it, wherever the cache refers to it.
+func (c *Cache) rename(userId string, local uuid.UUID, assigned uuid.UUID) {
+	fix := func(item *models.ToDo) {
+		if item.UserId != userId {
+			return
+		}
+		if item.Id == local {
+			item.Id = assigned
+		}
+		if item.ParentId != nil && *item.ParentId == local {
+			item.ParentId = &assigned
+		}
+		for i, blocker := range item.BlockedBy {
+			if blocker == local {
+				item.BlockedBy[i] = assigned
+			}
+		}
+	}
+	for i := range c.Items {
+		fix(&c.Items[i])
+	}
+	for i := range c.Outbox {
+		change := &c.Outbox[i]
+		fix(&change.Item)
+		// Patches take the ids they refer to from the fixed Item.
+		if _, ok := change.Patch["parent_id"]; ok {
+			change.Patch["parent_id"] = change.Item.ParentId
+		}
+		if _, ok := change.Patch["blocked_by"]; ok {
+			change.Patch["blocked_by"] = change.Item.BlockedBy
+		}
+	}
+}
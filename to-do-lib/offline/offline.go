@@ -0,0 +1,380 @@
+// Package offline lets the CLI work without the server. It keeps the ToDos it
+// has seen in a local JSON Cache and every change in a durable outbox, and
+// sends the outbox through apiclient, in order, whenever the server can be
+// reached.
+package offline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go-to-do-app/to-do-lib/apiclient"
+	"go-to-do-app/to-do-lib/datastores"
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+	"go-to-do-app/to-do-lib/query"
+
+	"github.com/google/uuid"
+)
+
+// Remote is the server as a Client uses it. *apiclient.APIClient is one.
+type Remote interface {
+	Create(ctx context.Context, item models.ToDo) (models.ToDo, error)
+	Get(ctx context.Context, userId string, id uuid.UUID) (models.ToDo, error)
+	Update(ctx context.Context, item models.ToDo) (models.ToDo, error)
+	Patch(ctx context.Context, userId string, id uuid.UUID, patch map[string]interface{}) (models.ToDo, error)
+	Delete(ctx context.Context, userId string, id uuid.UUID) error
+	List(ctx context.Context, userId string, opts apiclient.ListOptions) (datastores.ItemPage, error)
+}
+
+// Client reads ToDos from the server when it can be reached and from its
+// Cache when it cannot. Every change goes through the outbox, so changes
+// reach the server in the order they were made even when some of them were
+// made offline. Once a change is queued, later ones wait behind it until Sync
+// sends them all and reports any conflicts.
+type Client struct {
+	remote Remote
+	path   string
+	cache  *Cache
+}
+
+// Report is what a Sync did.
+type Report struct {
+	// Pushed are the changes from the outbox that reached the server.
+	Pushed []Change
+	// Pulled counts the ToDos that were added, changed or removed on the
+	// server since they were cached.
+	Pulled int
+	// Conflicts are the changes the server refused because the ToDo changed
+	// there. They are dropped from the outbox and the cache takes the
+	// server's side.
+	Conflicts []Conflict
+}
+
+// Conflict is a change the server refused because the ToDo changed on the
+// server after the change was made: its revision moved on, or it was
+// deleted.
+type Conflict struct {
+	Change Change
+	// Server is the ToDo as it is on the server, or nil if it is not there.
+	Server *models.ToDo
+	Err    error
+}
+
+// Open loads the cache saved at path.
+func Open(remote Remote, path string) (*Client, error) {
+	cache, err := LoadCache(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{remote: remote, path: path, cache: cache}, nil
+}
+
+// Cache returns what the client knows without the server.
+func (c *Client) Cache() *Cache {
+	return c.cache
+}
+
+// Unreachable reports whether err means the server could not be reached, or
+// a proxy in front of it could not, rather than that the server refused a
+// request.
+func Unreachable(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+	var status *apiclient.StatusError
+	if errors.As(err, &status) {
+		switch status.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
+
+// Create adds item. It is sent to the server right away if it can be reached,
+// and returned as the server saved it. Otherwise it is returned with a local
+// id, and queued reports that it waits in the outbox.
+func (c *Client) Create(ctx context.Context, item models.ToDo) (saved models.ToDo, queued bool, err error) {
+	if err := item.Validate(); err != nil {
+		return models.ToDo{}, false, err
+	}
+	item.Id = uuid.New()
+	item.Revision = 0
+	return c.change(ctx, Change{Id: uuid.New(), Op: OpCreate, Item: item, QueuedAt: time.Now().UTC()})
+}
+
+// Update replaces the ToDo with item. The change is based on the revision
+// that was last read, so it conflicts if the ToDo changed on the server in
+// the meantime. ToDos that were never read are read first, which needs the
+// server.
+func (c *Client) Update(ctx context.Context, item models.ToDo) (saved models.ToDo, queued bool, err error) {
+	if err := item.Validate(); err != nil {
+		return models.ToDo{}, false, err
+	}
+	current, err := c.cached(ctx, item.UserId, item.Id)
+	if err != nil {
+		return models.ToDo{}, false, err
+	}
+	item.Revision = current.Revision
+	return c.change(ctx, Change{Id: uuid.New(), Op: OpUpdate, Item: item, BaseRevision: current.Revision, QueuedAt: time.Now().UTC()})
+}
+
+// Patch changes only the fields of the ToDo that patch, a JSON Merge Patch,
+// sets. Unlike Update it keeps changes made to the other fields on the server
+// in the meantime, and only conflicts if the ToDo was deleted there. ToDos
+// that were never read are read first, which needs the server.
+func (c *Client) Patch(ctx context.Context, userId string, id uuid.UUID, patch map[string]interface{}) (saved models.ToDo, queued bool, err error) {
+	current, err := c.cached(ctx, userId, id)
+	if err != nil {
+		return models.ToDo{}, false, err
+	}
+	item, err := applyPatch(current, patch)
+	if err != nil {
+		return models.ToDo{}, false, &todoerrors.ValidationError{Field: "patch", Err: err}
+	}
+	if err := item.Validate(); err != nil {
+		return models.ToDo{}, false, err
+	}
+	return c.change(ctx, Change{Id: uuid.New(), Op: OpPatch, Item: item, Patch: patch, BaseRevision: current.Revision, QueuedAt: time.Now().UTC()})
+}
+
+// Delete removes the ToDo, unless it changed on the server since it was last
+// read.
+func (c *Client) Delete(ctx context.Context, userId string, id uuid.UUID) (queued bool, err error) {
+	current, err := c.cached(ctx, userId, id)
+	if err != nil {
+		return false, err
+	}
+	_, queued, err = c.change(ctx, Change{Id: uuid.New(), Op: OpDelete, Item: current, BaseRevision: current.Revision, QueuedAt: time.Now().UTC()})
+	return queued, err
+}
+
+// Get returns the ToDo from the server, or from the cache when the server
+// cannot be reached, in which case offline is set.
+func (c *Client) Get(ctx context.Context, userId string, id uuid.UUID) (item models.ToDo, offline bool, err error) {
+	if !c.cache.Pending(userId, id) {
+		item, err = c.remote.Get(ctx, userId, id)
+		switch {
+		case err == nil:
+			c.cache.put(item)
+			return item, false, c.cache.Save(c.path)
+		case errors.As(err, new(*todoerrors.NotFoundError)):
+			c.cache.remove(userId, id)
+			return models.ToDo{}, false, errors.Join(err, c.cache.Save(c.path))
+		case !Unreachable(err):
+			return models.ToDo{}, false, err
+		}
+	}
+	// ToDos with changes in the outbox are read from the cache, where the
+	// changes are already applied.
+	item, ok := c.cache.Get(userId, id)
+	if !ok {
+		return models.ToDo{}, true, notCached(id)
+	}
+	return item, err != nil, nil
+}
+
+// List returns a page of the user's ToDos from the server, or all the cached
+// ToDos matching opts when the server cannot be reached, in which case
+// offline is set. While changes wait in the outbox it lists the cache, where
+// they are applied.
+func (c *Client) List(ctx context.Context, userId string, opts apiclient.ListOptions) (items []models.ToDo, nextCursor string, offline bool, err error) {
+	if len(c.cache.Outbox) == 0 {
+		page, err := c.remote.List(ctx, userId, opts)
+		if err == nil {
+			for _, item := range page.Items {
+				c.cache.put(item)
+			}
+			return page.Items, page.NextCursor, false, c.cache.Save(c.path)
+		}
+		if !Unreachable(err) {
+			return nil, "", false, err
+		}
+		offline = true
+	}
+	filter := datastores.Filter{ParentId: opts.ParentId, ListId: opts.ListId}
+	if opts.Query != "" {
+		if filter.Query, err = query.Parse(opts.Query); err != nil {
+			return nil, "", offline, err
+		}
+	}
+	for _, item := range c.cache.Items {
+		if item.UserId == userId && filter.Match(item) {
+			items = append(items, item)
+		}
+	}
+	return items, "", offline, nil
+}
+
+// Sync sends the outbox to the server and then refreshes the cached ToDos of
+// userId from it. It stops with an error if the server cannot be reached or
+// refuses a change for any reason but a conflict, keeping what is left of the
+// outbox for next time.
+func (c *Client) Sync(ctx context.Context, userId string) (Report, error) {
+	report, err := c.push(ctx)
+	if err != nil {
+		return report, err
+	}
+	var fresh []models.ToDo
+	opts := apiclient.ListOptions{}
+	for {
+		page, err := c.remote.List(ctx, userId, opts)
+		if err != nil {
+			return report, err
+		}
+		fresh = append(fresh, page.Items...)
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+
+	seen := make(map[uuid.UUID]bool, len(fresh))
+	for _, item := range fresh {
+		seen[item.Id] = true
+		if cached, ok := c.cache.Get(userId, item.Id); !ok || cached.Revision != item.Revision {
+			report.Pulled++
+		}
+		c.cache.put(item)
+	}
+	for _, cached := range append([]models.ToDo{}, c.cache.Items...) {
+		if cached.UserId == userId && !seen[cached.Id] {
+			report.Pulled++
+			c.cache.remove(userId, cached.Id)
+		}
+	}
+	c.cache.LastSync = time.Now().UTC()
+	return report, c.cache.Save(c.path)
+}
+
+// change queues ch and, unless older changes are already waiting for a Sync,
+// sends it. If ch reaches the server it returns the ToDo as the server saved
+// it, and if the server refused it the error it gave, taking ch back out of
+// the outbox. Otherwise queued is set.
+func (c *Client) change(ctx context.Context, ch Change) (models.ToDo, bool, error) {
+	waiting := len(c.cache.Outbox) > 0
+	before, cached := c.cache.Get(ch.Item.UserId, ch.Item.Id)
+	c.cache.queue(ch)
+	if err := c.cache.Save(c.path); err != nil {
+		return models.ToDo{}, false, err
+	}
+	if !waiting {
+		report, err := c.push(ctx)
+		switch {
+		case len(report.Conflicts) > 0:
+			return models.ToDo{}, false, report.Conflicts[0].Err
+		case len(report.Pushed) > 0:
+			return report.Pushed[0].Item, false, nil
+		case !Unreachable(err) && ctx.Err() == nil:
+			// ch is all the outbox holds, as it was empty before.
+			c.cache.Outbox = nil
+			c.cache.remove(ch.Item.UserId, ch.Item.Id)
+			if cached {
+				c.cache.put(before)
+			}
+			return models.ToDo{}, false, errors.Join(err, c.cache.Save(c.path))
+		}
+	}
+	item, _ := c.cache.Get(ch.Item.UserId, ch.Item.Id)
+	return item, true, nil
+}
+
+// push sends the outbox to the server, oldest change first, saving the cache
+// after each change so none is sent twice. Pushed changes hold the ToDo as
+// the server saved it. Changes that conflict are dropped, and any other error,
+// such as an unreachable server or an expired token, stops the push with the
+// change still at the head of the outbox.
+func (c *Client) push(ctx context.Context) (Report, error) {
+	var report Report
+	for len(c.cache.Outbox) > 0 {
+		ch := c.cache.Outbox[0]
+		saved, err := c.send(ctx, ch)
+		if err != nil && !conflicts(ch, err) {
+			return report, err
+		}
+		c.cache.Outbox = c.cache.Outbox[1:]
+		switch {
+		case err != nil:
+			conflict := Conflict{Change: ch, Err: err}
+			c.cache.remove(ch.Item.UserId, ch.Item.Id)
+			if server, err := c.remote.Get(ctx, ch.Item.UserId, ch.Item.Id); err == nil {
+				conflict.Server = &server
+				c.cache.put(server)
+			}
+			report.Conflicts = append(report.Conflicts, conflict)
+		case ch.Op == OpCreate:
+			c.cache.rename(ch.Item.UserId, ch.Item.Id, saved.Id)
+			c.cache.put(saved)
+			ch.Item = saved
+			report.Pushed = append(report.Pushed, ch)
+		case ch.Op == OpUpdate || ch.Op == OpPatch:
+			c.cache.put(saved)
+			ch.Item = saved
+			report.Pushed = append(report.Pushed, ch)
+		default:
+			report.Pushed = append(report.Pushed, ch)
+		}
+		if err := c.cache.Save(c.path); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// conflicts reports whether err means the server refused ch because the ToDo
+// changed there: a ConflictError, which send also returns for a delete whose
+// revision moved on, or a NotFoundError for an update or patch of a deleted
+// ToDo.
+func conflicts(ch Change, err error) bool {
+	return errors.As(err, new(*todoerrors.ConflictError)) ||
+		(ch.Op == OpUpdate || ch.Op == OpPatch) && errors.As(err, new(*todoerrors.NotFoundError))
+}
+
+// send makes one change on the server.
+func (c *Client) send(ctx context.Context, ch Change) (models.ToDo, error) {
+	switch ch.Op {
+	case OpCreate:
+		return c.remote.Create(apiclient.WithIdempotencyKey(ctx, ch.Id.String()), ch.Item)
+	case OpUpdate:
+		item := ch.Item
+		item.Revision = ch.BaseRevision
+		return c.remote.Update(ctx, item)
+	case OpPatch:
+		return c.remote.Patch(ctx, ch.Item.UserId, ch.Item.Id, ch.Patch)
+	case OpDelete:
+		// Deletes are not conditional on the server, so check the revision
+		// first. A ToDo that is already gone is as good as deleted.
+		current, err := c.remote.Get(ctx, ch.Item.UserId, ch.Item.Id)
+		if errors.As(err, new(*todoerrors.NotFoundError)) {
+			return models.ToDo{}, nil
+		}
+		if err != nil {
+			return models.ToDo{}, err
+		}
+		if current.Revision != ch.BaseRevision {
+			return models.ToDo{}, &todoerrors.ConflictError{Message: fmt.Sprintf("ToDo %s changed on the server since revision %d", ch.Item.Id, ch.BaseRevision)}
+		}
+		return models.ToDo{}, c.remote.Delete(ctx, ch.Item.UserId, ch.Item.Id)
+	}
+	return models.ToDo{}, fmt.Errorf("unknown change %q", ch.Op)
+}
+
+// cached returns the cached ToDo, reading it from the server if it is not
+// cached yet.
+func (c *Client) cached(ctx context.Context, userId string, id uuid.UUID) (models.ToDo, error) {
+	if item, ok := c.cache.Get(userId, id); ok {
+		return item, nil
+	}
+	item, _, err := c.Get(ctx, userId, id)
+	return item, err
+}
+
+func notCached(id uuid.UUID) error {
+	return &todoerrors.NotFoundError{Message: fmt.Sprintf("ToDo %s is not in the offline cache; run sync while online first", id)}
+}
@@ -0,0 +1,242 @@
+package offline_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"go-to-do-app/to-do-lib/apiclient"
+	"go-to-do-app/to-do-lib/datastores"
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+	"go-to-do-app/to-do-lib/offline"
+	"go-to-do-app/to-do-server/server"
+
+	"github.com/google/uuid"
+)
+
+func TestOfflineChangesSync(t *testing.T) {
+	ds := datastores.NewInMemDataStore()
+	srv := server.NewToDoServer(":0", make(chan bool), ds)
+	var down atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		srv.Handler().ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	remote := apiclient.NewAPIClient(ts.URL)
+	remote.Retry.MaxAttempts = 1
+	path := filepath.Join(t.TempDir(), "cache.json")
+	client, err := offline.Open(&remote, path)
+	if err != nil {
+		t.Fatalf("Error opening cache: %s", err)
+	}
+	ctx := context.Background()
+
+	rent, queued, err := client.Create(ctx, models.ToDo{UserId: "alice", Title: "Pay rent", Priority: "High"})
+	if err != nil || queued || rent.Revision == 0 {
+		t.Fatalf("Expected the item to reach the server, Got: %+v queued=%t (%v)", rent, queued, err)
+	}
+	plants, _, err := client.Create(ctx, models.ToDo{UserId: "alice", Title: "Water plants", Priority: "Low"})
+	if err != nil {
+		t.Fatalf("Error creating item: %s", err)
+	}
+
+	down.Store(true)
+	stamps, queued, err := client.Create(ctx, models.ToDo{UserId: "alice", Title: "Buy stamps", Priority: "Medium"})
+	if err != nil || !queued || stamps.Revision != 0 {
+		t.Fatalf("Expected the item to be queued, Got: %+v queued=%t (%v)", stamps, queued, err)
+	}
+	rent.Title = "Pay the rent"
+	if _, queued, err := client.Update(ctx, rent); err != nil || !queued {
+		t.Errorf("Expected the update to be queued, Got: queued=%t (%v)", queued, err)
+	}
+	plants.Priority = "High"
+	if _, queued, err := client.Update(ctx, plants); err != nil || !queued {
+		t.Errorf("Expected the update to be queued, Got: queued=%t (%v)", queued, err)
+	}
+	if got, stale, err := client.Get(ctx, "alice", rent.Id); err != nil || got.Title != "Pay the rent" {
+		t.Errorf("Expected the cached change, Got: %+v stale=%t (%v)", got, stale, err)
+	}
+	items, _, stale, err := client.List(ctx, "alice", apiclient.ListOptions{Query: "priority:high"})
+	if err != nil || len(items) != 2 || stale {
+		t.Errorf("Expected the 2 high priority items from the cache, Got: %+v stale=%t (%v)", items, stale, err)
+	}
+	if _, err := client.Sync(ctx, "alice"); !offline.Unreachable(err) {
+		t.Errorf("Expected the sync to fail while offline, Got: %v", err)
+	}
+
+	// Someone else changes the plants while we are offline.
+	ds.ModifyItem("alice", plants.Id, func(current models.ToDo) (models.ToDo, error) {
+		current.Title = "Water the plants"
+		return current, nil
+	})
+	down.Store(false)
+	// The outbox survives restarting the CLI.
+	if client, err = offline.Open(&remote, path); err != nil || len(client.Cache().Outbox) != 3 {
+		t.Fatalf("Expected 3 queued changes, Got: %+v (%v)", client.Cache().Outbox, err)
+	}
+	report, err := client.Sync(ctx, "alice")
+	if err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if len(report.Pushed) != 2 || report.Pushed[0].Op != offline.OpCreate || report.Pushed[1].Op != offline.OpUpdate {
+		t.Errorf("Expected the create and the rent update to be pushed, Got: %+v", report.Pushed)
+	}
+	if len(report.Conflicts) != 1 || report.Conflicts[0].Server == nil || report.Conflicts[0].Server.Title != "Water the plants" ||
+		!errors.As(report.Conflicts[0].Err, new(*todoerrors.ConflictError)) {
+		t.Errorf("Expected the plants update to conflict, Got: %+v", report.Conflicts)
+	}
+
+	page, _ := ds.ListItems("alice", datastores.ListOptions{})
+	if len(page.Items) != 3 {
+		t.Errorf("Expected: 3 items on the server, Got: %+v", page.Items)
+	}
+	created := report.Pushed[0].Item
+	if created.Id == stamps.Id || created.Title != "Buy stamps" {
+		t.Errorf("Expected the server's copy of %+v, Got: %+v", stamps, created)
+	}
+	if _, ok := client.Cache().Get("alice", created.Id); !ok || len(client.Cache().Items) != 3 || len(client.Cache().Outbox) != 0 {
+		t.Errorf("Expected the cache to match the server, Got: %+v", client.Cache())
+	}
+
+	if queued, err := client.Delete(ctx, "alice", created.Id); err != nil || queued {
+		t.Errorf("Expected the delete to reach the server, Got: queued=%t (%v)", queued, err)
+	}
+	if _, err := ds.GetItem("alice", created.Id); err == nil {
+		t.Errorf("Expected %s to be deleted", created.Id)
+	}
+}
+
+func TestOfflineSyncKeepsOutboxOnRefusal(t *testing.T) {
+	ds := datastores.NewInMemDataStore()
+	srv := server.NewToDoServer(":0", make(chan bool), ds)
+	var status atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := int(status.Load()); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+		srv.Handler().ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	remote := apiclient.NewAPIClient(ts.URL)
+	remote.Retry.MaxAttempts = 1
+	client, err := offline.Open(&remote, filepath.Join(t.TempDir(), "cache.json"))
+	if err != nil {
+		t.Fatalf("Error opening cache: %s", err)
+	}
+	ctx := context.Background()
+
+	status.Store(http.StatusServiceUnavailable)
+	for _, title := range []string{"Pay rent", "Buy stamps"} {
+		if _, queued, err := client.Create(ctx, models.ToDo{UserId: "alice", Title: title, Priority: "High"}); err != nil || !queued {
+			t.Fatalf("Expected the item to be queued, Got: queued=%t (%v)", queued, err)
+		}
+	}
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests, http.StatusInternalServerError} {
+		status.Store(int32(code))
+		report, err := client.Sync(ctx, "alice")
+		if err == nil || len(report.Conflicts) != 0 || len(client.Cache().Outbox) != 2 || len(client.Cache().Items) != 2 {
+			t.Errorf("%d Expected the sync to stop and keep the outbox, Got: %+v %+v (%v)", code, report, client.Cache(), err)
+		}
+	}
+
+	status.Store(0)
+	if report, err := client.Sync(ctx, "alice"); err != nil || len(report.Pushed) != 2 {
+		t.Errorf("Expected both creates to be pushed, Got: %+v (%v)", report, err)
+	}
+	if page, _ := ds.ListItems("alice", datastores.ListOptions{}); len(page.Items) != 2 {
+		t.Errorf("Expected: 2 items on the server, Got: %+v", page.Items)
+	}
+
+	// A change refused while online is not queued.
+	status.Store(http.StatusUnauthorized)
+	if _, queued, err := client.Create(ctx, models.ToDo{UserId: "alice", Title: "Water plants", Priority: "Low"}); err == nil || queued {
+		t.Errorf("Expected the refusal, Got: queued=%t (%v)", queued, err)
+	}
+	if len(client.Cache().Outbox) != 0 || len(client.Cache().Items) != 2 {
+		t.Errorf("Expected the refused change to be taken back, Got: %+v", client.Cache())
+	}
+}
+
+func TestOfflinePatchesKeepServerChanges(t *testing.T) {
+	ds := datastores.NewInMemDataStore()
+	srv := server.NewToDoServer(":0", make(chan bool), ds)
+	var down atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		srv.Handler().ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	remote := apiclient.NewAPIClient(ts.URL)
+	remote.Retry.MaxAttempts = 1
+	path := filepath.Join(t.TempDir(), "cache.json")
+	client, err := offline.Open(&remote, path)
+	if err != nil {
+		t.Fatalf("Error opening cache: %s", err)
+	}
+	ctx := context.Background()
+	rename := func(id uuid.UUID, title string) {
+		ds.ModifyItem("alice", id, func(current models.ToDo) (models.ToDo, error) {
+			current.Title = title
+			return current, nil
+		})
+	}
+
+	rent, _, err := client.Create(ctx, models.ToDo{UserId: "alice", Title: "Pay rent", Priority: "Low"})
+	if err != nil {
+		t.Fatalf("Error creating item: %s", err)
+	}
+	rename(rent.Id, "Pay the rent")
+	saved, queued, err := client.Patch(ctx, "alice", rent.Id, map[string]interface{}{"priority": "High"})
+	if err != nil || queued || saved.Title != "Pay the rent" || saved.Priority != "High" {
+		t.Errorf("Expected the patch to keep the server's title, Got: %+v queued=%t (%v)", saved, queued, err)
+	}
+
+	down.Store(true)
+	if _, queued, err := client.Patch(ctx, "alice", rent.Id, map[string]interface{}{"description": "By the 30th"}); err != nil || !queued {
+		t.Errorf("Expected the patch to be queued, Got: queued=%t (%v)", queued, err)
+	}
+	got, _, err := client.Patch(ctx, "alice", rent.Id, map[string]interface{}{"status": "done", "complete": true})
+	if err != nil || got.Status != models.StatusDone || got.Description != "By the 30th" {
+		t.Errorf("Expected both patches in the cache, Got: %+v (%v)", got, err)
+	}
+	if outbox := client.Cache().Outbox; len(outbox) != 1 || outbox[0].Op != offline.OpPatch || len(outbox[0].Patch) != 3 {
+		t.Errorf("Expected the patches folded into one, Got: %+v", outbox)
+	}
+
+	rename(rent.Id, "Pay rent today")
+	down.Store(false)
+	if client, err = offline.Open(&remote, path); err != nil {
+		t.Fatalf("Error opening cache: %s", err)
+	}
+	report, err := client.Sync(ctx, "alice")
+	if err != nil || len(report.Pushed) != 1 || len(report.Conflicts) != 0 {
+		t.Fatalf("Expected the patch to be pushed, Got: %+v (%v)", report, err)
+	}
+	stored, _ := ds.GetItem("alice", rent.Id)
+	if stored.Title != "Pay rent today" || stored.Priority != "High" || stored.Description != "By the 30th" || stored.Status != models.StatusDone {
+		t.Errorf("Expected the patches on top of the server's title, Got: %+v", stored)
+	}
+
+	down.Store(true)
+	if _, queued, err := client.Patch(ctx, "alice", rent.Id, map[string]interface{}{"priority": "Low"}); err != nil || !queued {
+		t.Errorf("Expected the patch to be queued, Got: queued=%t (%v)", queued, err)
+	}
+	ds.DeleteItem("alice", rent.Id)
+	down.Store(false)
+	if report, err := client.Sync(ctx, "alice"); err != nil || len(report.Conflicts) != 1 || report.Conflicts[0].Server != nil {
+		t.Errorf("Expected the patch of a deleted item to conflict, Got: %+v (%v)", report, err)
+	}
+}
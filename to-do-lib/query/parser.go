@@ -0,0 +1,282 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go-to-do-app/to-do-lib/models"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokLParen
+	tokRParen
+	tokMinus
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("'%s'", t.text)
+	}
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func isWordRune(r rune) bool {
+	return !unicode.IsSpace(r) && !strings.ContainsRune(`():<>="`, r)
+}
+
+// peek decodes the rune at the lexer's position and returns it with its width
+// in bytes.
+func (l *lexer) peek() (rune, int) {
+	return utf8.DecodeRuneInString(l.src[l.pos:])
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) {
+		r, width := l.peek()
+		if !unicode.IsSpace(r) {
+			break
+		}
+		l.pos += width
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+	switch c := l.src[l.pos]; c {
+	case '(':
+		l.pos++
+		return token{kind: tokLParen, text: "(", pos: start}, nil
+	case ')':
+		l.pos++
+		return token{kind: tokRParen, text: ")", pos: start}, nil
+	case ':', '=':
+		l.pos++
+		return token{kind: tokOp, text: ":", pos: start}, nil
+	case '<', '>':
+		l.pos++
+		if l.pos < len(l.src) && l.src[l.pos] == '=' {
+			l.pos++
+		}
+		return token{kind: tokOp, text: l.src[start:l.pos], pos: start}, nil
+	case '-':
+		l.pos++
+		return token{kind: tokMinus, text: "-", pos: start}, nil
+	case '"':
+		var sb strings.Builder
+		l.pos++
+		for l.pos < len(l.src) {
+			c := l.src[l.pos]
+			switch {
+			case c == '"':
+				l.pos++
+				return token{kind: tokString, text: sb.String(), pos: start}, nil
+			case c == '\\' && l.pos+1 < len(l.src):
+				sb.WriteByte(l.src[l.pos+1])
+				l.pos += 2
+			default:
+				sb.WriteByte(c)
+				l.pos++
+			}
+		}
+		return token{}, &SyntaxError{Pos: start, Msg: "unterminated quoted string"}
+	}
+	for l.pos < len(l.src) {
+		r, width := l.peek()
+		if !isWordRune(r) {
+			break
+		}
+		l.pos += width
+	}
+	return token{kind: tokWord, text: l.src[start:l.pos], pos: start}, nil
+}
+
+type parser struct {
+	lex lexer
+	tok token
+	err error
+}
+
+func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+	if p.err != nil {
+		p.tok = token{kind: tokEOF, pos: len(p.lex.src)}
+	}
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	return &SyntaxError{Pos: p.tok.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) isKeyword(kw string) bool {
+	return p.tok.kind == tokWord && p.tok.text == kw
+}
+
+// parseOr := parseAnd ("OR" parseAnd)*
+func (p *parser) parseOr() (Expr, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	terms := []Expr{first}
+	for p.isKeyword("OR") {
+		p.next()
+		term, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 1 {
+		return first, nil
+	}
+	return Or{Terms: terms}, nil
+}
+
+// parseAnd := parseUnary (["AND"] parseUnary)*
+func (p *parser) parseAnd() (Expr, error) {
+	var terms []Expr
+	for {
+		if p.isKeyword("AND") && len(terms) > 0 {
+			p.next()
+		}
+		if p.tok.kind == tokEOF || p.tok.kind == tokRParen || p.isKeyword("OR") {
+			break
+		}
+		term, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	switch len(terms) {
+	case 0:
+		return nil, p.errorf("expected a search term but found %s", p.tok)
+	case 1:
+		return terms[0], nil
+	}
+	return And{Terms: terms}, nil
+}
+
+// parseUnary := ("-" | "NOT") parseUnary | "(" parseOr ")" | term
+func (p *parser) parseUnary() (Expr, error) {
+	switch {
+	case p.tok.kind == tokMinus || p.isKeyword("NOT"):
+		p.next()
+		term, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{Term: term}, nil
+	case p.tok.kind == tokLParen:
+		open := p.tok
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, &SyntaxError{Pos: open.pos, Msg: "unclosed '('"}
+		}
+		p.next()
+		return expr, nil
+	}
+	return p.parseTerm()
+}
+
+// parseTerm := word [op value] | string
+func (p *parser) parseTerm() (Expr, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokString:
+		p.next()
+		return TitleContains{Text: tok.text}, nil
+	case tokWord:
+	default:
+		return nil, p.errorf("unexpected %s", tok)
+	}
+	p.next()
+	if p.tok.kind != tokOp {
+		if strings.ToLower(tok.text) == "complete" {
+			return CompleteIs{Complete: true}, nil
+		}
+		return TitleContains{Text: tok.text}, nil
+	}
+	op := p.tok
+	p.next()
+	if p.tok.kind != tokWord && p.tok.kind != tokString {
+		return nil, p.errorf("expected a value after %s%s but found %s", tok.text, op.text, p.tok)
+	}
+	value := p.tok
+	p.next()
+	return newFieldTerm(tok, op, value)
+}
+
+func newFieldTerm(field, op, value token) (Expr, error) {
+	switch strings.ToLower(field.text) {
+	case "title":
+		if op.text != ":" {
+			return nil, &SyntaxError{Pos: op.pos, Msg: fmt.Sprintf("title does not support %s", op.text)}
+		}
+		return TitleContains{Text: value.text}, nil
+	case "complete":
+		if op.text != ":" {
+			return nil, &SyntaxError{Pos: op.pos, Msg: fmt.Sprintf("complete does not support %s", op.text)}
+		}
+		switch strings.ToLower(value.text) {
+		case "true", "yes":
+			return CompleteIs{Complete: true}, nil
+		case "false", "no":
+			return CompleteIs{Complete: false}, nil
+		}
+		return nil, &SyntaxError{Pos: value.pos, Msg: fmt.Sprintf("invalid complete value %s, expected true or false", value)}
+	case "status":
+		if op.text != ":" {
+			return nil, &SyntaxError{Pos: op.pos, Msg: fmt.Sprintf("status does not support %s", op.text)}
+		}
+		s, err := models.ParseStatus(value.text)
+		if err != nil {
+			return nil, &SyntaxError{Pos: value.pos, Msg: fmt.Sprintf("invalid status %s. Valid options are: %s", value, strings.Join(models.Statuses, ", "))}
+		}
+		return StatusIs{Status: s}, nil
+	case "priority":
+		p, err := models.ParsePriority(value.text)
+		if err != nil {
+			return nil, &SyntaxError{Pos: value.pos, Msg: err.Error()}
+		}
+		return PriorityCompare{Op: op.text, Priority: p}, nil
+	}
+	return nil, &SyntaxError{
+		Pos: field.pos,
+		Msg: fmt.Sprintf("unknown field %s. Valid fields are: title, priority, complete, status", field),
+	}
+}
@@ -0,0 +1,171 @@
+// Package query implements the compact search syntax used to filter to-dos,
+// for example:
+//
+//	priority:high -complete title:"release notes" -status:blocked
+//
+// Terms separated by whitespace must all match. Terms can be combined with OR,
+// grouped with parentheses and negated with a leading '-' or NOT. A bare word
+// or quoted string matches titles containing it, except for the bare word
+// "complete" which matches completed items.
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+)
+
+type Expr interface {
+	Eval(item models.ToDo) bool
+	String() string
+}
+
+type And struct {
+	Terms []Expr
+}
+
+func (e And) Eval(item models.ToDo) bool {
+	for _, t := range e.Terms {
+		if !t.Eval(item) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e And) String() string {
+	return joinExprs(e.Terms, " ")
+}
+
+type Or struct {
+	Terms []Expr
+}
+
+func (e Or) Eval(item models.ToDo) bool {
+	for _, t := range e.Terms {
+		if t.Eval(item) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e Or) String() string {
+	return "(" + joinExprs(e.Terms, " OR ") + ")"
+}
+
+type Not struct {
+	Term Expr
+}
+
+func (e Not) Eval(item models.ToDo) bool {
+	return !e.Term.Eval(item)
+}
+
+func (e Not) String() string {
+	return "-" + e.Term.String()
+}
+
+type TitleContains struct {
+	Text string
+}
+
+func (e TitleContains) Eval(item models.ToDo) bool {
+	return strings.Contains(strings.ToLower(item.Title), strings.ToLower(e.Text))
+}
+
+func (e TitleContains) String() string {
+	return "title:" + strconv.Quote(e.Text)
+}
+
+type CompleteIs struct {
+	Complete bool
+}
+
+func (e CompleteIs) Eval(item models.ToDo) bool {
+	return item.Complete == e.Complete
+}
+
+func (e CompleteIs) String() string {
+	return "complete:" + strconv.FormatBool(e.Complete)
+}
+
+type StatusIs struct {
+	Status string
+}
+
+func (e StatusIs) Eval(item models.ToDo) bool {
+	return item.EffectiveStatus() == e.Status
+}
+
+func (e StatusIs) String() string {
+	return "status:" + e.Status
+}
+
+// PriorityCompare compares an item's priority using the Low < Medium < High
+// ordering. Op is one of ":", "<", "<=", ">" or ">=", where ":" is equality.
+type PriorityCompare struct {
+	Op       string
+	Priority string
+}
+
+func (e PriorityCompare) Eval(item models.ToDo) bool {
+	a, b := models.PriorityRank(item.Priority), models.PriorityRank(e.Priority)
+	switch e.Op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	default:
+		return a == b
+	}
+}
+
+func (e PriorityCompare) String() string {
+	return "priority" + e.Op + strings.ToLower(e.Priority)
+}
+
+func joinExprs(exprs []Expr, sep string) string {
+	parts := make([]string, len(exprs))
+	for i, e := range exprs {
+		parts[i] = e.String()
+	}
+	return strings.Join(parts, sep)
+}
+
+// SyntaxError reports where in the query string parsing failed. Pos is a
+// zero based byte offset.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+// Parse turns a query string into an expression. An empty query matches every
+// item. Syntax errors are returned as a *todoerrors.ValidationError wrapping a
+// *SyntaxError.
+func Parse(q string) (Expr, error) {
+	p := parser{lex: lexer{src: q}}
+	p.next()
+	if p.tok.kind == tokEOF && p.err == nil {
+		return And{}, nil
+	}
+	expr, err := p.parseOr()
+	if err == nil && (p.err != nil || p.tok.kind != tokEOF) {
+		err = p.errorf("unexpected %s", p.tok)
+	}
+	if err != nil {
+		return nil, &todoerrors.ValidationError{Field: "q", Err: err}
+	}
+	return expr, nil
+}
@@ -0,0 +1,83 @@
+package query_test
+
+import (
+	"errors"
+	"testing"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+	"go-to-do-app/to-do-lib/query"
+)
+
+func TestParseAndEval(t *testing.T) {
+	items := map[string]models.ToDo{
+		"notes":   {Title: "Write release notes", Priority: models.PriorityHigh},
+		"done":    {Title: "Write release notes", Priority: models.PriorityHigh, Complete: true},
+		"low":     {Title: "Tidy desk", Priority: models.PriorityLow},
+		"medium":  {Title: "Follow-up email", Priority: models.PriorityMedium, Status: models.StatusBlocked},
+		"accents": {Title: "Relire le déjà-vu, voilà", Priority: models.PriorityLow},
+	}
+	cases := []struct {
+		q        string
+		expected []string
+	}{
+		{`priority:high -complete title:"release notes"`, []string{"notes"}},
+		{`complete`, []string{"done"}},
+		{`complete:false priority>=medium`, []string{"notes", "medium"}},
+		{`desk OR follow-up`, []string{"low", "medium"}},
+		{`NOT (priority:high OR priority:low)`, []string{"medium"}},
+		{`priority<high AND -tidy`, []string{"medium", "accents"}},
+		{``, []string{"notes", "done", "low", "medium", "accents"}},
+		{`status:todo`, []string{"notes", "low", "accents"}},
+		{`title:voilà`, []string{"accents"}},
+		{`DÉJÀ relire`, []string{"accents"}},
+		{`priority:low -à`, []string{"low"}},
+		{`status:done OR status:"In Progress" OR status:blocked`, []string{"done", "medium"}},
+	}
+	for _, c := range cases {
+		expr, err := query.Parse(c.q)
+		if err != nil {
+			t.Errorf("Parse(%q) failed with %s error", c.q, err)
+			continue
+		}
+		expected := make(map[string]bool)
+		for _, name := range c.expected {
+			expected[name] = true
+		}
+		for name, item := range items {
+			if actual := expr.Eval(item); actual != expected[name] {
+				t.Errorf("Parse(%q) = %s, Expected %s to match: %t, Got: %t", c.q, expr, name, expected[name], actual)
+			}
+		}
+	}
+}
+
+func TestParseReportsSyntaxErrors(t *testing.T) {
+	cases := map[string]int{
+		`priority:urgent`:   9,
+		`colour:red`:        0,
+		`title:"unfinished`: 6,
+		`(priority:high`:    0,
+		`complete:maybe`:    9,
+		`title>foo`:         5,
+		`a OR`:              4,
+		`status:waiting`:    7,
+		`status>todo`:       6,
+	}
+	for q, pos := range cases {
+		_, err := query.Parse(q)
+		var verr *todoerrors.ValidationError
+		if !errors.As(err, &verr) {
+			t.Errorf("Parse(%q) Expected: %T, Got: %T", q, verr, err)
+			continue
+		}
+		var serr *query.SyntaxError
+		if !errors.As(verr.Err, &serr) {
+			t.Errorf("Parse(%q) Expected wrapped %T, Got: %T", q, serr, verr.Err)
+			continue
+		}
+		if serr.Pos != pos {
+			t.Errorf("Parse(%q) Expected error at position %d, Got: %d (%s)", q, pos, serr.Pos, serr)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"fmt"
+
+	"go-to-do-app/to-do-lib/datastores"
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// access is what a caller may do with the ToDos and lists of one owner.
+type access struct {
+	caller string
+	owner  string
+	// roles holds the caller's role on each of the owner's lists that is
+	// shared with them. It is nil when the caller is the owner.
+	roles map[uuid.UUID]string
+}
+
+func (s *Service) access(caller string, owner string) (access, error) {
+	a := access{caller: caller, owner: owner}
+	if caller == owner {
+		return a, nil
+	}
+	shared, err := s.store.SharedLists(caller)
+	if err != nil {
+		return a, err
+	}
+	a.roles = make(map[uuid.UUID]string)
+	for _, list := range shared {
+		if list.UserId == owner {
+			a.roles[list.Id], _ = list.RoleOf(caller)
+		}
+	}
+	return a, nil
+}
+
+// check returns a ForbiddenError unless the caller has at least the role need
+// on the owner's list listId. It does not use the store, so it can be called
+// from a ModifyItem function.
+func (a access) check(listId uuid.UUID, need string) error {
+	if a.caller == a.owner {
+		return nil
+	}
+	if role, ok := a.roles[listId]; ok && models.RoleAllows(role, need) {
+		return nil
+	}
+	return &todoerrors.ForbiddenError{Message: fmt.Sprintf("%s needs %s access to list %s of %s", a.caller, need, listId, a.owner)}
+}
+
+// see returns the NotFoundError of a missing ToDo unless the caller can see
+// the owner's list listId, so that callers cannot tell the ToDos they may not
+// see from ToDos that do not exist. Like check, it does not use the store.
+func (a access) see(listId uuid.UUID) error {
+	if a.check(listId, models.RoleViewer) != nil {
+		return &todoerrors.NotFoundError{Message: "ToDo Not Found"}
+	}
+	return nil
+}
+
+// restrict narrows filter to the lists the caller can see.
+func (a access) restrict(filter *datastores.Filter) error {
+	if a.caller == a.owner {
+		return nil
+	}
+	if filter.ListId != nil {
+		return a.check(*filter.ListId, models.RoleViewer)
+	}
+	for id := range a.roles {
+		filter.InLists = append(filter.InLists, id)
+	}
+	if len(filter.InLists) == 0 {
+		return &todoerrors.ForbiddenError{Message: fmt.Sprintf("%s has no lists shared by %s", a.caller, a.owner)}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"fmt"
+
+	"go-to-do-app/to-do-lib/datastores"
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// Service is what users can do with ToDos and lists, shared by the JSON API
+// and the web UI. Every method takes the caller, the user making the request,
+// and the owner whose ToDos or lists it addresses, and returns a
+// ForbiddenError unless the caller's role on the lists involved allows it.
+// Callers always have every role on their own lists. The stores keep subtasks
+// and blockers in the list of the ToDos they belong to, so the changes a
+// mutation makes to other ToDos stay within the lists checked here.
+type Service struct {
+	store datastores.DataStore
+}
+
+func New(store datastores.DataStore) *Service {
+	return &Service{store: store}
+}
+
+// AddItem adds item for its user, who is the owner.
+func (s *Service) AddItem(caller string, item models.ToDo) (models.ToDo, error) {
+	a, err := s.access(caller, item.UserId)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	if err := a.check(item.ListId, models.RoleEditor); err != nil {
+		return models.ToDo{}, err
+	}
+	return s.store.AddItem(item)
+}
+
+// GetItem returns the same NotFoundError for an item the caller cannot see as
+// for one that does not exist.
+func (s *Service) GetItem(caller string, owner string, id uuid.UUID) (models.ToDo, error) {
+	a, err := s.access(caller, owner)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	item, err := s.store.GetItem(owner, id)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	if err := a.see(item.ListId); err != nil {
+		return models.ToDo{}, err
+	}
+	return item, nil
+}
+
+// ModifyItem changes an item with modify, like DataStore.ModifyItem. The
+// caller needs to be an editor of both the list the item is in and the list
+// modify moves it to. Items the caller cannot see are not found.
+func (s *Service) ModifyItem(caller string, owner string, id uuid.UUID, modify func(current models.ToDo) (models.ToDo, error)) (models.ToDo, error) {
+	a, err := s.access(caller, owner)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	return s.store.ModifyItem(owner, id, func(current models.ToDo) (models.ToDo, error) {
+		if err := a.see(current.ListId); err != nil {
+			return models.ToDo{}, err
+		}
+		if err := a.check(current.ListId, models.RoleEditor); err != nil {
+			return models.ToDo{}, err
+		}
+		update, err := modify(current)
+		if err != nil {
+			return models.ToDo{}, err
+		}
+		return update, a.check(update.ListId, models.RoleEditor)
+	})
+}
+
+// DeleteItem deletes an item and its subtasks. The caller needs to be an
+// editor of the item's list when it is deleted, so the check is made in the
+// same write as the delete. Items the caller cannot see are not found.
+func (s *Service) DeleteItem(caller string, owner string, id uuid.UUID) error {
+	a, err := s.access(caller, owner)
+	if err != nil {
+		return err
+	}
+	return s.store.DeleteItemIf(owner, id, func(current models.ToDo) error {
+		if err := a.see(current.ListId); err != nil {
+			return err
+		}
+		return a.check(current.ListId, models.RoleEditor)
+	})
+}
+
+// ListItems returns a page of the owner's items in the lists the caller can
+// see.
+func (s *Service) ListItems(caller string, owner string, opts datastores.ListOptions) (datastores.ItemPage, error) {
+	a, err := s.access(caller, owner)
+	if err != nil {
+		return datastores.ItemPage{}, err
+	}
+	if err := a.restrict(&opts.Filter); err != nil {
+		return datastores.ItemPage{}, err
+	}
+	return s.store.ListItems(owner, opts)
+}
+
+// Subtasks returns a page of the direct subtasks of parentId.
+func (s *Service) Subtasks(caller string, owner string, parentId uuid.UUID, opts datastores.ListOptions) (datastores.ItemPage, error) {
+	if _, err := s.GetItem(caller, owner, parentId); err != nil {
+		return datastores.ItemPage{}, err
+	}
+	opts.Filter.ParentId = &parentId
+	return s.ListItems(caller, owner, opts)
+}
+
+// Next returns the owner's open ToDos that the caller can see in the order
+// they can be worked on: every ToDo comes after the ToDos blocking it, and
+// otherwise higher priorities come first. A positive limit cuts the list
+// short.
+func (s *Service) Next(caller string, owner string, limit int) ([]models.ToDo, error) {
+	a, err := s.access(caller, owner)
+	if err != nil {
+		return nil, err
+	}
+	filter := datastores.Filter{Statuses: models.OpenStatuses}
+	if err := a.restrict(&filter); err != nil {
+		return nil, err
+	}
+	items, err := datastores.ListAll(s.store, owner, filter)
+	if err != nil {
+		return nil, err
+	}
+	plan := models.Plan(items)
+	if limit > 0 && limit < len(plan) {
+		plan = plan[:limit]
+	}
+	return plan, nil
+}
+
+func (s *Service) GetList(caller string, owner string, id uuid.UUID) (models.List, error) {
+	list, err := s.store.GetList(owner, id)
+	if err != nil {
+		return models.List{}, err
+	}
+	return list, s.checkList(caller, owner, id, models.RoleViewer)
+}
+
+// AddList creates a list. Only its user can create it.
+func (s *Service) AddList(caller string, list models.List) (models.List, error) {
+	if caller != list.UserId {
+		return models.List{}, &todoerrors.ForbiddenError{Message: fmt.Sprintf("%s cannot create lists for %s", caller, list.UserId)}
+	}
+	return s.store.AddList(list)
+}
+
+// UpdateList renames and shares a list, which only its owners can do.
+func (s *Service) UpdateList(caller string, list models.List) (models.List, error) {
+	if err := s.checkList(caller, list.UserId, list.Id, models.RoleOwner); err != nil {
+		return models.List{}, err
+	}
+	return s.store.UpdateList(list)
+}
+
+func (s *Service) DeleteList(caller string, owner string, id uuid.UUID) error {
+	if err := s.checkList(caller, owner, id, models.RoleOwner); err != nil {
+		return err
+	}
+	return s.store.DeleteList(owner, id)
+}
+
+// Lists returns the owner's lists followed by the lists shared with them.
+// Only the owner can see them all.
+func (s *Service) Lists(caller string, owner string) ([]models.List, error) {
+	if caller != owner {
+		return nil, &todoerrors.ForbiddenError{Message: fmt.Sprintf("%s cannot see the lists of %s", caller, owner)}
+	}
+	lists, err := s.store.ListLists(owner)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := s.store.SharedLists(owner)
+	if err != nil {
+		return nil, err
+	}
+	return append(lists, shared...), nil
+}
+
+func (s *Service) checkList(caller string, owner string, id uuid.UUID, need string) error {
+	a, err := s.access(caller, owner)
+	if err != nil {
+		return err
+	}
+	return a.check(id, need)
+}
@@ -0,0 +1,181 @@
+package service_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"go-to-do-app/to-do-lib/datastores"
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+	"go-to-do-app/to-do-lib/service"
+
+	"github.com/google/uuid"
+)
+
+func TestServiceChecksRoles(t *testing.T) {
+	svc := service.New(datastores.NewInMemDataStore())
+	forbidden := func(err error) bool { return errors.As(err, new(*todoerrors.ForbiddenError)) }
+	notFound := func(err error) bool { return errors.As(err, new(*todoerrors.NotFoundError)) }
+
+	shared, err := svc.AddList("alice", models.List{UserId: "alice", Name: "Groceries", Members: []models.Member{
+		{UserId: "bob", Role: models.RoleViewer},
+		{UserId: "carol", Role: models.RoleEditor},
+	}})
+	if err != nil {
+		t.Fatalf("Error adding list: %s", err)
+	}
+	milk, err := svc.AddItem("alice", models.ToDo{Id: uuid.New(), UserId: "alice", Title: "Milk", Priority: "Low", ListId: shared.Id})
+	if err != nil {
+		t.Fatalf("Error adding item: %s", err)
+	}
+	private, err := svc.AddItem("alice", models.ToDo{Id: uuid.New(), UserId: "alice", Title: "Diary", Priority: "Low"})
+	if err != nil {
+		t.Fatalf("Error adding item: %s", err)
+	}
+
+	if _, err := svc.GetItem("bob", "alice", milk.Id); err != nil {
+		t.Errorf("Expected a viewer to read the item, Got: %v", err)
+	}
+	// Callers cannot tell the items they may not see from missing ones.
+	for _, id := range []uuid.UUID{private.Id, uuid.New()} {
+		if _, err := svc.GetItem("bob", "alice", id); !notFound(err) {
+			t.Errorf("Expected: NotFoundError for %s, Got: %v", id, err)
+		}
+		if _, err := svc.GetItem("dave", "alice", id); !notFound(err) {
+			t.Errorf("Expected: NotFoundError for %s, Got: %v", id, err)
+		}
+		if err := svc.DeleteItem("carol", "alice", id); !notFound(err) {
+			t.Errorf("Expected: NotFoundError for %s, Got: %v", id, err)
+		}
+	}
+	if err := svc.DeleteItem("bob", "alice", milk.Id); !forbidden(err) {
+		t.Errorf("Expected a viewer not to delete the item, Got: %v", err)
+	}
+	rename := func(current models.ToDo) (models.ToDo, error) {
+		current.Title = "Oat milk"
+		return current, nil
+	}
+	if _, err := svc.ModifyItem("bob", "alice", milk.Id, rename); !forbidden(err) {
+		t.Errorf("Expected a viewer not to change the item, Got: %v", err)
+	}
+	if item, err := svc.ModifyItem("carol", "alice", milk.Id, rename); err != nil || item.Title != "Oat milk" {
+		t.Errorf("Expected an editor to change the item, Got: %+v (%v)", item, err)
+	}
+	moveOut := func(current models.ToDo) (models.ToDo, error) {
+		current.ListId = models.DefaultListId
+		return current, nil
+	}
+	if _, err := svc.ModifyItem("carol", "alice", milk.Id, moveOut); !forbidden(err) {
+		t.Errorf("Expected an editor not to move the item out of the list, Got: %v", err)
+	}
+
+	page, err := svc.ListItems("bob", "alice", datastores.ListOptions{})
+	if err != nil || len(page.Items) != 1 || page.Items[0].Id != milk.Id {
+		t.Errorf("Expected: only %s, Got: %+v (%v)", milk.Id, page.Items, err)
+	}
+	if _, err := svc.ListItems("dave", "alice", datastores.ListOptions{}); !forbidden(err) {
+		t.Errorf("Expected: ForbiddenError, Got: %v", err)
+	}
+
+	if _, err := svc.AddList("bob", models.List{UserId: "alice", Name: "Mine now"}); !forbidden(err) {
+		t.Errorf("Expected: ForbiddenError, Got: %v", err)
+	}
+	if err := svc.DeleteList("carol", "alice", shared.Id); !forbidden(err) {
+		t.Errorf("Expected an editor not to delete the list, Got: %v", err)
+	}
+	if _, err := svc.Lists("bob", "alice"); !forbidden(err) {
+		t.Errorf("Expected: ForbiddenError, Got: %v", err)
+	}
+	if lists, err := svc.Lists("bob", "bob"); err != nil || len(lists) != 2 {
+		t.Errorf("Expected the default list and the shared list, Got: %+v (%v)", lists, err)
+	}
+}
+
+func TestServiceKeepsCascadesInTheCheckedList(t *testing.T) {
+	svc := service.New(datastores.NewInMemDataStore())
+	invalid := func(err error) bool { return errors.As(err, new(*todoerrors.ValidationError)) }
+
+	shared, _ := svc.AddList("alice", models.List{UserId: "alice", Name: "Groceries", Members: []models.Member{
+		{UserId: "carol", Role: models.RoleEditor},
+	}})
+	milk, _ := svc.AddItem("alice", models.ToDo{UserId: "alice", Title: "Milk", Priority: "Low", ListId: shared.Id})
+	private, _ := svc.AddItem("alice", models.ToDo{UserId: "alice", Title: "Diary", Priority: "Low"})
+
+	// The owner cannot link a private ToDo to a shared one, so deleting or
+	// closing the shared one never reaches it.
+	underMilk := func(current models.ToDo) (models.ToDo, error) {
+		current.ParentId = &milk.Id
+		return current, nil
+	}
+	if _, err := svc.ModifyItem("alice", "alice", private.Id, underMilk); !invalid(err) {
+		t.Errorf("Expected: ValidationError for a parent in another list, Got: %v", err)
+	}
+	blockedByMilk := func(current models.ToDo) (models.ToDo, error) {
+		current.BlockedBy = []uuid.UUID{milk.Id}
+		return current, nil
+	}
+	if _, err := svc.ModifyItem("alice", "alice", private.Id, blockedByMilk); !invalid(err) {
+		t.Errorf("Expected: ValidationError for a blocker in another list, Got: %v", err)
+	}
+	if err := svc.DeleteItem("carol", "alice", milk.Id); err != nil {
+		t.Fatalf("Error deleting item: %s", err)
+	}
+	if _, err := svc.GetItem("alice", "alice", private.Id); err != nil {
+		t.Errorf("Expected %s to survive, Got: %v", private.Id, err)
+	}
+
+	// An editor cannot hang ToDos under private ones, and cannot tell a
+	// private id from one that does not exist.
+	for _, id := range []uuid.UUID{private.Id, uuid.New()} {
+		_, err := svc.AddItem("carol", models.ToDo{UserId: "alice", Title: "Eggs", Priority: "Low", ListId: shared.Id, Complete: true, ParentId: &id})
+		expected := "parent " + id.String() + " is not in list " + shared.Id.String()
+		if !invalid(err) || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected: %s, Got: %v", expected, err)
+		}
+		_, err = svc.AddItem("carol", models.ToDo{UserId: "alice", Title: "Eggs", Priority: "Low", ListId: shared.Id, BlockedBy: []uuid.UUID{id}})
+		expected = "blocker " + id.String() + " is not in list " + shared.Id.String()
+		if !invalid(err) || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected: %s, Got: %v", expected, err)
+		}
+	}
+	if got, _ := svc.GetItem("alice", "alice", private.Id); got.Revision != private.Revision {
+		t.Errorf("Expected %s to be left as it was, Got: %+v", private.Id, got)
+	}
+}
+
+// movingStore moves every item to the default list just before deleting it,
+// as a concurrent ModifyItem could.
+type movingStore struct {
+	datastores.DataStore
+}
+
+func (ds movingStore) DeleteItemIf(userId string, itemId uuid.UUID, check func(current models.ToDo) error) error {
+	_, err := ds.ModifyItem(userId, itemId, func(current models.ToDo) (models.ToDo, error) {
+		current.ListId = models.DefaultListId
+		return current, nil
+	})
+	if err != nil {
+		return err
+	}
+	return ds.DataStore.DeleteItemIf(userId, itemId, check)
+}
+
+func TestServiceChecksTheListAnItemIsDeletedFrom(t *testing.T) {
+	svc := service.New(movingStore{datastores.NewInMemDataStore()})
+
+	shared, _ := svc.AddList("alice", models.List{UserId: "alice", Name: "Groceries", Members: []models.Member{
+		{UserId: "carol", Role: models.RoleEditor},
+	}})
+	milk, _ := svc.AddItem("alice", models.ToDo{UserId: "alice", Title: "Milk", Priority: "Low", ListId: shared.Id})
+	if _, err := svc.AddItem("alice", models.ToDo{UserId: "alice", Title: "Oat milk", Priority: "Low", ListId: shared.Id, ParentId: &milk.Id}); err != nil {
+		t.Fatalf("Error adding subtask: %s", err)
+	}
+
+	if err := svc.DeleteItem("carol", "alice", milk.Id); !errors.As(err, new(*todoerrors.NotFoundError)) {
+		t.Errorf("Expected: NotFoundError once the item left the list, Got: %v", err)
+	}
+	if page, err := svc.ListItems("alice", "alice", datastores.ListOptions{}); err != nil || len(page.Items) != 2 {
+		t.Errorf("Expected the item and its subtask to survive, Got: %+v (%v)", page.Items, err)
+	}
+}
@@ -0,0 +1,23 @@
+package server
+
+import "net/http"
+
+// CallerHeader names the user making a request when the server does not
+// require API keys or tokens. Requests without it act as the user whose ToDos
+// they address, as every request did before lists could be shared. Like
+// user_id, the header is trusted as sent, so anyone can act as anyone: it is
+// for development only, and servers others can reach should set Keys or
+// Tokens.
+const CallerHeader = "X-User-Id"
+
+// caller returns the user making r: the user of its API key or token, or else
+// the user in CallerHeader, or else owner.
+func caller(r *http.Request, owner string) string {
+	if id, ok := authenticated(r); ok {
+		return id.userId
+	}
+	if c := r.Header.Get(CallerHeader); c != "" {
+		return c
+	}
+	return owner
+}
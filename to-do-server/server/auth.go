@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-to-do-app/to-do-lib/auth"
+	todoerrors "go-to-do-app/to-do-lib/errors"
+
+	"github.com/google/uuid"
+)
+
+// Options configures the optional parts of a ToDoServer.
+type Options struct {
+	// Keys, when set, makes every API request authenticate with one of its
+	// keys. The user a key was issued to is the caller of the request, and
+	// admin keys can issue and revoke keys at /admin/keys. Without Keys or
+	// Tokens the caller is taken from CallerHeader, as before keys existed.
+	Keys *auth.KeyStore
+	// Tokens, when set, makes every API request authenticate with a bearer
+	// token signed by one of its keys, or with an API key if Keys is set too.
+	// The token's subject is the caller and its scopes limit what it can do.
+	Tokens *auth.KeySet
+	// Accounts, when set, makes users log in to the web UI with a username
+	// and password. Their username is the user_id of the forms they send.
+	Accounts *auth.AccountStore
+	// SessionTTL is how long a web UI login lasts, DefaultSessionTTL if 0.
+	SessionTTL time.Duration
+	// IdempotencyWindow is how long the response to a POST with an
+	// Idempotency-Key is replayed for, DefaultIdempotencyWindow if 0. Keys
+	// are kept in memory, so a restart forgets them.
+	IdempotencyWindow time.Duration
+}
+
+// AuthRequired reports whether API requests must authenticate. Without it
+// the server trusts the user_id and CallerHeader of every request.
+func (o Options) AuthRequired() bool {
+	return o.Keys != nil || o.Tokens != nil
+}
+
+// unavailableWithAuth answers the routes of ver, a version whose ToDos do
+// not belong to a user, on a server that requires authentication.
+func unavailableWithAuth(ver *apiVersion) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeErrorResponse(w, r, http.StatusNotImplemented, fmt.Sprintf(
+			"%s is unavailable with authentication, as its ToDos do not belong to a user; use %s", ver.name, ver.successor))
+	}
+}
+
+type authContextKey string
+
+const identityContextKey = authContextKey("identity")
+
+// identity is who authenticated a request and what they may do.
+type identity struct {
+	userId string
+	admin  bool
+	// scopes limits a token to reading or changing ToDos and lists. It is
+	// nil for API keys, which can do both.
+	scopes []string
+}
+
+// authenticated returns who r was authenticated as, if anyone.
+func authenticated(r *http.Request) (identity, bool) {
+	id, ok := r.Context().Value(identityContextKey).(identity)
+	return id, ok
+}
+
+func withIdentity(r *http.Request, id identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey, id))
+}
+
+// identify checks the bearer token or API key of r.
+func (o Options) identify(r *http.Request) (identity, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && o.Tokens != nil {
+		claims, err := o.Tokens.Verify(token, time.Now())
+		if err != nil {
+			return identity{}, err
+		}
+		return identity{userId: claims.Subject, scopes: append([]string{}, claims.Scopes()...)}, nil
+	}
+	if secret := r.Header.Get(auth.APIKeyHeader); secret != "" && o.Keys != nil {
+		key, err := o.Keys.Authenticate(secret)
+		if err != nil {
+			return identity{}, err
+		}
+		return identity{userId: key.UserId, admin: key.Admin}, nil
+	}
+	var accepted []string
+	if o.Keys != nil {
+		accepted = append(accepted, auth.APIKeyHeader+" header")
+	}
+	if o.Tokens != nil {
+		accepted = append(accepted, "bearer token")
+	}
+	return identity{}, &todoerrors.UnauthorizedError{Message: "missing " + strings.Join(accepted, " or ")}
+}
+
+// requireAuth rejects requests that do not authenticate with 401
+// Unauthorized and passes the others on with their identity in the context.
+func (o Options) requireAuth(h http.HandlerFunc) http.HandlerFunc {
+	if !o.AuthRequired() {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := o.identify(r)
+		if err != nil {
+			handleDataStoreError(w, r, err)
+			return
+		}
+		h(w, withIdentity(r, id))
+	}
+}
+
+// authenticate is requireAuth for the API routes. Reads need the todo:read
+// scope and changes todo:write. Requests that do not name a user_id address
+// the ToDos and lists of the caller when defaultUser is set.
+func (o Options) authenticate(h http.HandlerFunc, defaultUser bool) http.HandlerFunc {
+	return o.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := authenticated(r)
+		if !ok {
+			h(w, r)
+			return
+		}
+		need := auth.ScopeWrite
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			need = auth.ScopeRead
+		}
+		if id.scopes != nil && !auth.HasScope(id.scopes, need) {
+			handleDataStoreError(w, r, &todoerrors.ForbiddenError{Message: fmt.Sprintf("the token needs the %s scope", need)})
+			return
+		}
+		if defaultUser && !r.URL.Query().Has("user_id") {
+			q := r.URL.Query()
+			q.Set("user_id", id.userId)
+			r.URL.RawQuery = q.Encode()
+		}
+		h(w, r)
+	})
+}
+
+// issuedKey is the response body of POST /admin/keys, the only time the
+// secret of a key is shown.
+type issuedKey struct {
+	auth.Key
+	Secret string `json:"key"`
+}
+
+type keysDTO struct {
+	Items []auth.Key `json:"items"`
+}
+
+// keysHTTPHandler serves /admin/keys, where admin keys list (GET, optionally
+// for one user_id), issue (POST {"user_id", "admin"}) and revoke (DELETE ?id=)
+// keys.
+func keysHTTPHandler(keys *auth.KeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id, _ := authenticated(r); !id.admin {
+			handleDataStoreError(w, r, &todoerrors.ForbiddenError{Message: "only admin keys can manage keys"})
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			items := keys.Keys(r.URL.Query().Get("user_id"))
+			for i := range items {
+				items[i].Hash = ""
+			}
+			MarshalAndWrite(w, r, keysDTO{Items: items})
+		case http.MethodPost:
+			defer r.Body.Close()
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeErrorResponse(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			var req struct {
+				UserId string `json:"user_id"`
+				Admin  bool   `json:"admin"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil {
+				writeErrorResponse(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid body: %s", err.Error()))
+				return
+			}
+			key, secret, err := keys.Issue(req.UserId, req.Admin)
+			if err != nil {
+				handleDataStoreError(w, r, err)
+				return
+			}
+			key.Hash = ""
+			MarshalAndWrite(w, r, issuedKey{Key: key, Secret: secret})
+		case http.MethodDelete:
+			id, err := uuid.Parse(r.URL.Query().Get("id"))
+			if err != nil {
+				writeErrorResponse(w, r, http.StatusBadRequest, "missing 'id' query paramater")
+				return
+			}
+			if err := keys.Revoke(id); err != nil {
+				handleDataStoreError(w, r, err)
+				return
+			}
+			writeNoContentResponse(w, r)
+		default:
+			w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodDelete}, ", "))
+			writeErrorResponse(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
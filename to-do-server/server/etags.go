@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+)
+
+// ToDo entity tags are the item's revision as a strong tag, e.g. "3".
+
+func etag(item models.ToDo) string {
+	return fmt.Sprintf(`"%d"`, item.Revision)
+}
+
+func splitETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// etagMatches reports whether an If-None-Match header lists the item's
+// current tag. It uses the weak comparison RFC 9110 requires for
+// If-None-Match, so W/"3" matches "3".
+func etagMatches(header string, item models.ToDo) bool {
+	current := etag(item)
+	for _, tag := range splitETags(header) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == current {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchRevision converts an If-Match header into the revision an update is
+// conditional on. An absent header or "*" yields 0, meaning unconditional.
+// Weak or foreign tags can never match a ToDo and are reported as a
+// ConflictError.
+func ifMatchRevision(header string) (int, error) {
+	tags := splitETags(header)
+	switch {
+	case len(tags) == 0:
+		return 0, nil
+	case len(tags) == 1 && tags[0] == "*":
+		return 0, nil
+	case len(tags) > 1:
+		return 0, &todoerrors.ValidationError{Field: "If-Match", Err: errors.New("only a single entity tag is supported")}
+	}
+	unquoted, err := strconv.Unquote(tags[0])
+	if err != nil || strings.HasPrefix(tags[0], "W/") {
+		return 0, &todoerrors.ConflictError{Message: fmt.Sprintf("If-Match %s does not match the current revision", tags[0])}
+	}
+	rev, err := strconv.Atoi(unquoted)
+	if err != nil || rev < 1 {
+		return 0, &todoerrors.ConflictError{Message: fmt.Sprintf("If-Match %s does not match the current revision", tags[0])}
+	}
+	return rev, nil
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader lets a client retry a POST without repeating it.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// DefaultIdempotencyWindow is how long idempotency keys are remembered when
+// Options does not say.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// maxIdempotencyKey is the longest idempotency key accepted, in bytes.
+const maxIdempotencyKey = 255
+
+// pendingIdempotencyTimeout is how long the first request with a key may be
+// in progress before a repeat of it is handled again rather than refused, in
+// case the first one never finishes.
+const pendingIdempotencyTimeout = time.Minute
+
+// minIdempotencySweep is the fewest saved responses at which expired ones are
+// swept out.
+const minIdempotencySweep = 1024
+
+// savedResponse is the response to the first request with an idempotency key.
+type savedResponse struct {
+	// fingerprint is the hash of the request body, so a key reused for a
+	// different request is noticed.
+	fingerprint [sha256.Size]byte
+	// done is false while the first request is still being handled.
+	done   bool
+	status int
+	header http.Header
+	body   []byte
+	// expiresAt is when the response is forgotten, or for a pending one when
+	// its request is given up on.
+	expiresAt time.Time
+}
+
+// idempotencyStore keeps responses to POSTs with an idempotency key in
+// memory, by caller, path and key, for window after they were made. Nothing
+// is written to disk, so a restart forgets every key: a POST applied just
+// before a restart is applied again if it is retried after it.
+type idempotencyStore struct {
+	mu        sync.Mutex
+	window    time.Duration
+	responses map[string]*savedResponse
+	// sweepAt is how many responses there are when expired ones, other than
+	// those looked up, are next swept out. It is twice as many as a sweep
+	// leaves, so sweeps cost each request O(1) on average.
+	sweepAt int
+}
+
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	if window == 0 {
+		window = DefaultIdempotencyWindow
+	}
+	return &idempotencyStore{window: window, responses: make(map[string]*savedResponse), sweepAt: minIdempotencySweep}
+}
+
+// responseRecorder passes a response on while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent makes a POST with an Idempotency-Key header happen once for each
+// caller and key: repeating it within the window replays the first response,
+// marked with an Idempotent-Replayed header, instead of handling it again.
+// Reusing a key for a different body fails with 422 Unprocessable Entity, and
+// repeating a request that is still being handled with 409 Conflict.
+// Responses with a 5xx status are not kept, so the request can be retried,
+// and neither is anything of a request whose handler panics.
+func (s *idempotencyStore) idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeErrorResponse(w, r, http.StatusBadRequest, fmt.Sprintf("%s is longer than %d bytes", IdempotencyKeyHeader, maxIdempotencyKey))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeErrorResponse(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// The caller defaults to the user in the body, as it does for the
+		// handler, so keys are kept apart per user.
+		var owner struct {
+			UserId string `json:"user_id"`
+		}
+		json.Unmarshal(body, &owner)
+		scope := strings.Join([]string{caller(r, owner.UserId), r.URL.Path, key}, "\x00")
+		saved, first := s.begin(scope, sha256.Sum256(body), time.Now())
+		switch {
+		case first:
+		case saved == nil:
+			writeErrorResponse(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("%s was used for a different request", IdempotencyKeyHeader))
+			return
+		case !saved.done:
+			writeErrorResponse(w, r, http.StatusConflict, fmt.Sprintf("a request with this %s is still in progress", IdempotencyKeyHeader))
+			return
+		default:
+			for name, values := range saved.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(saved.status)
+			w.Write(saved.body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			if p := recover(); p != nil {
+				s.forget(scope, saved)
+				panic(p)
+			}
+		}()
+		h(rec, r)
+		s.finish(scope, saved, rec)
+	}
+}
+
+// begin returns the response saved for scope, or saves and returns a pending
+// one and reports that this is the first request. A saved response whose
+// request had another fingerprint is returned as nil.
+func (s *idempotencyStore) begin(scope string, fingerprint [sha256.Size]byte, now time.Time) (*savedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if saved, exists := s.responses[scope]; exists && now.Before(saved.expiresAt) {
+		if saved.fingerprint != fingerprint {
+			return nil, false
+		}
+		return saved, false
+	}
+	if len(s.responses) >= s.sweepAt {
+		s.sweep(now)
+	}
+	pending := &savedResponse{fingerprint: fingerprint, expiresAt: now.Add(pendingIdempotencyTimeout)}
+	s.responses[scope] = pending
+	return pending, true
+}
+
+// sweep removes the responses that have expired by now.
+func (s *idempotencyStore) sweep(now time.Time) {
+	for scope, saved := range s.responses {
+		if !now.Before(saved.expiresAt) {
+			delete(s.responses, scope)
+		}
+	}
+	s.sweepAt = max(2*len(s.responses), minIdempotencySweep)
+}
+
+// finish saves the response recorded for the pending entry saved, or forgets
+// the key if the request failed on the server's side.
+func (s *idempotencyStore) finish(scope string, saved *savedResponse, rec *responseRecorder) {
+	if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+		s.forget(scope, saved)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A request that outlived pendingIdempotencyTimeout may have been
+	// retried under the same key since; the retry's entry is kept.
+	if s.responses[scope] != saved {
+		return
+	}
+	saved.done = true
+	saved.status = rec.status
+	saved.header = rec.Header().Clone()
+	saved.body = rec.body.Bytes()
+	saved.expiresAt = time.Now().Add(s.window)
+}
+
+// forget removes the pending entry saved, unless it has been replaced.
+func (s *idempotencyStore) forget(scope string, saved *savedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.responses[scope] == saved {
+		delete(s.responses, scope)
+	}
+}
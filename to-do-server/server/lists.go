@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+	"go-to-do-app/to-do-lib/service"
+
+	"github.com/google/uuid"
+)
+
+// Lists only exist from v3 on, so requests and responses use models.List as
+// it is rather than a DTO per version. The service checks the caller's role
+// on each list.
+
+// listsDTO is the response body of /lists.
+type listsDTO struct {
+	Items []models.List `json:"items"`
+}
+
+func listHTTPHandler(svc *service.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			getList(svc, w, r)
+		case http.MethodPost:
+			postputList(w, r, svc.AddList)
+		case http.MethodPut:
+			postputList(w, r, svc.UpdateList)
+		case http.MethodDelete:
+			deleteList(svc, w, r)
+		default:
+			w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}, ", "))
+			writeErrorResponse(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+func listsHTTPHandler(svc *service.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeErrorResponse(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		userId := r.URL.Query().Get("user_id")
+		if userId == "" {
+			writeErrorResponse(w, r, http.StatusBadRequest, "missing 'user_id' query paramater")
+			return
+		}
+		lists, err := svc.Lists(caller(r, userId), userId)
+		if err != nil {
+			handleDataStoreError(w, r, err)
+			return
+		}
+		MarshalAndWrite(w, r, listsDTO{Items: lists})
+	}
+}
+
+// listQuery reads the user_id and id query parameters that identify a list.
+func listQuery(w http.ResponseWriter, r *http.Request) (string, uuid.UUID, bool) {
+	userId := r.URL.Query().Get("user_id")
+	listId, err := uuid.Parse(r.URL.Query().Get("id"))
+	if userId == "" || err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, "missing 'id' or 'user_id' query paramater")
+		return "", uuid.Nil, false
+	}
+	return userId, listId, true
+}
+
+func getList(svc *service.Service, w http.ResponseWriter, r *http.Request) {
+	userId, listId, ok := listQuery(w, r)
+	if !ok {
+		return
+	}
+	list, err := svc.GetList(caller(r, userId), userId, listId)
+	if err != nil {
+		handleDataStoreError(w, r, err)
+		return
+	}
+	MarshalAndWrite(w, r, list)
+}
+
+// postputList creates or changes the list in the request body with save.
+func postputList(w http.ResponseWriter, r *http.Request, save func(caller string, list models.List) (models.List, error)) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	var list models.List
+	if err := json.Unmarshal(body, &list); err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid body: %s", err.Error()))
+		return
+	}
+	if list.UserId == "" {
+		err = &todoerrors.ValidationError{Field: "user_id", Err: errors.New("invalid user_id")}
+	} else {
+		err = list.Validate()
+	}
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid body: %s", err.Error()))
+		return
+	}
+	if list, err = save(caller(r, list.UserId), list); err != nil {
+		handleDataStoreError(w, r, err)
+		return
+	}
+	MarshalAndWrite(w, r, list)
+}
+
+func deleteList(svc *service.Service, w http.ResponseWriter, r *http.Request) {
+	userId, listId, ok := listQuery(w, r)
+	if !ok {
+		return
+	}
+	if err := svc.DeleteList(caller(r, userId), userId, listId); err != nil {
+		handleDataStoreError(w, r, err)
+		return
+	}
+	writeNoContentResponse(w, r)
+}
@@ -3,17 +3,24 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
-	"go-to-do-app/to-do-lib/apiclient"
 	"go-to-do-app/to-do-lib/datastores"
 	todoerrors "go-to-do-app/to-do-lib/errors"
 	"go-to-do-app/to-do-lib/logging"
+	"go-to-do-app/to-do-lib/mergepatch"
 	"go-to-do-app/to-do-lib/models"
+	"go-to-do-app/to-do-lib/query"
+	"go-to-do-app/to-do-lib/service"
 
 	"github.com/google/uuid"
 )
@@ -24,12 +31,20 @@ type ToDoServer struct {
 }
 
 func NewToDoServer(address string, shutdownChannel chan bool, datastore datastores.DataStore) ToDoServer {
+	return NewToDoServerWithOptions(address, shutdownChannel, datastore, Options{})
+}
+
+func NewToDoServerWithOptions(address string, shutdownChannel chan bool, datastore datastores.DataStore, opts Options) ToDoServer {
 	return ToDoServer{
-		server:       &http.Server{Addr: address, Handler: wiredMux(datastore)},
+		server:       &http.Server{Addr: address, Handler: wiredMux(datastore, opts)},
 		shutdownChan: shutdownChannel,
 	}
 }
 
+func (s *ToDoServer) Handler() http.Handler {
+	return s.server.Handler
+}
+
 func (s *ToDoServer) Shutdown() {
 	s.shutdownChan <- true
 }
@@ -38,20 +53,51 @@ func (s *ToDoServer) AwaitShutdown() {
 	<-s.shutdownChan
 }
 
-func wiredMux(datastore datastores.DataStore) *http.ServeMux {
+func wiredMux(datastore datastores.DataStore, opts Options) *http.ServeMux {
+	svc := service.New(datastore)
+	web := newWebAuth(opts)
+	ui := &webUI{svc: svc, auth: web, opts: opts}
+	idempotency := newIdempotencyStore(opts.IdempotencyWindow)
 	routes := map[string]http.HandlerFunc{
-		"/":                serveTemplate("./templates/home.html", nil),
-		"/styles.css":      serveFile("./templates/styles.css"),
-		"/v1/swagger.yaml": serveFile("./api-specs/to-do-app-api-v1.yaml"),
-		"/v2/swagger.yaml": serveFile("./api-specs/to-do-app-api-v2.yaml"),
-		"/v1/swagger-ui":   serveTemplate("./templates/swagger-ui-template.html", "v1"),
-		"/v2/swagger-ui":   serveTemplate("./templates/swagger-ui-template.html", "v2"),
-		"/v1/todo":         toDoHTTPHandler(datastore),
-		"/v2/todo":         toDoHTTPHandler(datastore),
-		"/search":          serveTemplate("./templates/todoform.html", "GET"),
-		"/update":          serveTemplate("./templates/todoform.html", "PUT"),
-		"/add":             serveTemplate("./templates/todoform.html", "POST"),
-		"/item":            handleWebForm,
+		"/":           web.requireSession(serveTemplate("./templates/home.html", nil)),
+		"/styles.css": serveFile("./templates/styles.css"),
+		"/search":     ui.serveForm("GET"),
+		"/update":     ui.serveForm("PUT"),
+		"/add":        ui.serveForm("POST"),
+		"/delete":     ui.serveForm("DELETE"),
+		"/item":       web.requireSession(ui.handleWebForm),
+	}
+	if web != nil {
+		routes["/login"] = web.loginHandler()
+		routes["/logout"] = web.logoutHandler()
+	}
+	if opts.Keys != nil {
+		routes["/admin/keys"] = opts.requireAuth(keysHTTPHandler(opts.Keys))
+	}
+	for _, ver := range apiVersions {
+		prefix := "/" + ver.name
+		api := func(h http.HandlerFunc) http.HandlerFunc {
+			if !ver.userScoped && opts.AuthRequired() {
+				return ver.withHeaders(unavailableWithAuth(ver))
+			}
+			return ver.withHeaders(opts.authenticate(idempotency.idempotent(h), ver.userScoped))
+		}
+		routes[prefix+"/swagger.yaml"] = ver.withHeaders(serveFile(fmt.Sprintf("./api-specs/to-do-app-api-%s.yaml", ver.name)))
+		routes[prefix+"/swagger-ui"] = ver.withHeaders(serveTemplate("./templates/swagger-ui-template.html", ver.name))
+		routes[prefix+"/todo"] = api(toDoHTTPHandler(svc, ver))
+		if ver.list {
+			routes[prefix+"/todos"] = api(toDosHTTPHandler(svc, ver))
+		}
+		if ver.subtasks {
+			routes[prefix+"/todo/subtasks"] = api(subtasksHTTPHandler(svc, ver))
+		}
+		if ver.next {
+			routes[prefix+"/todos/next"] = api(nextHTTPHandler(svc, ver))
+		}
+		if ver.lists {
+			routes[prefix+"/list"] = api(listHTTPHandler(svc))
+			routes[prefix+"/lists"] = api(listsHTTPHandler(svc))
+		}
 	}
 
 	mux := http.NewServeMux()
@@ -84,9 +130,42 @@ func serveFile(filePath string) http.HandlerFunc {
 	}
 }
 
-func toDoHTTPHandler(datastore datastores.DataStore) http.HandlerFunc {
+func toDoHTTPHandler(svc *service.Service, ver *apiVersion) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		toDoHandler(svc, ver, w, r)
+	}
+}
+
+func toDosHTTPHandler(svc *service.Service, ver *apiVersion) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeErrorResponse(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		listToDos(svc, ver, w, r)
+	}
+}
+
+func subtasksHTTPHandler(svc *service.Service, ver *apiVersion) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeErrorResponse(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		listSubtasks(svc, ver, w, r)
+	}
+}
+
+func nextHTTPHandler(svc *service.Service, ver *apiVersion) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		toDoHandler(datastore, w, r)
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeErrorResponse(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		nextToDos(svc, ver, w, r)
 	}
 }
 
@@ -104,32 +183,6 @@ func serveTemplate(path string, data interface{}) http.HandlerFunc {
 	}
 }
 
-func handleWebForm(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Error parsing form data", http.StatusBadRequest)
-		return
-	}
-	method := r.FormValue("form_method")
-	fmt.Println(method)
-	args := map[string]string{
-		"user-id":  r.FormValue("user_id"),
-		"id":       r.FormValue("id"),
-		"version":  r.FormValue("api_version"),
-		"title":    r.FormValue("title"),
-		"priority": r.FormValue("priority"),
-		"complete": r.FormValue("complete"),
-	}
-	var itemIn models.ToDo
-	ctx := logging.AddTraceID(r.Context())
-	client := apiclient.NewAPIClient("http://localhost:8081/")
-	if item, err := client.Req(ctx, method, itemIn, args); err != nil {
-		writeErrorResponse(w, r, http.StatusBadRequest, err.Error())
-	} else {
-		temp := serveTemplate("./templates/todoitem.html", item)
-		temp(w, r)
-	}
-}
-
 func WriteJSONResponse(w http.ResponseWriter, r *http.Request, statusCode int, data []byte) {
 	ctx := logging.AddTraceID(r.Context())
 	w.Header().Set("Content-Type", "application/json")
@@ -142,58 +195,318 @@ func WriteJSONResponse(w http.ResponseWriter, r *http.Request, statusCode int, d
 	logging.LogWithTrace(ctx, logData, "Json response Written")
 }
 
+func writeNoContentResponse(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.AddTraceID(r.Context())
+	w.WriteHeader(http.StatusNoContent)
+	logData := map[string]interface{}{
+		"statusCode": http.StatusNoContent,
+	}
+	logging.LogWithTrace(ctx, logData, "No content response Written")
+}
+
 func writeErrorResponse(w http.ResponseWriter, r *http.Request, statusCode int, message string) {
-	WriteJSONResponse(w, r, statusCode, []byte(fmt.Sprintf(`{"error": "%s"}`, message)))
+	body, _ := json.Marshal(map[string]string{"error": message})
+	WriteJSONResponse(w, r, statusCode, body)
 }
 
-func handleDataStoreError(w http.ResponseWriter, r *http.Request, err error) {
-	switch e := err.(type) {
-	case *todoerrors.NotFoundError:
-		writeErrorResponse(w, r, http.StatusNotFound, e.Message)
-	case *todoerrors.ValidationError:
-		writeErrorResponse(w, r, http.StatusBadRequest, e.Error())
+// errorStatus returns the HTTP status code of an error from the service.
+func errorStatus(err error) int {
+	switch {
+	case errors.As(err, new(*todoerrors.NotFoundError)):
+		return http.StatusNotFound
+	case errors.As(err, new(*todoerrors.ValidationError)):
+		return http.StatusBadRequest
+	case errors.As(err, new(*todoerrors.ConflictError)):
+		return http.StatusPreconditionFailed
+	case errors.As(err, new(*todoerrors.ForbiddenError)):
+		return http.StatusForbidden
+	case errors.As(err, new(*todoerrors.UnauthorizedError)):
+		return http.StatusUnauthorized
 	default:
-		writeErrorResponse(w, r, http.StatusInternalServerError, "Internal server error")
+		return http.StatusInternalServerError
 	}
 }
 
-func PostputToDo(w http.ResponseWriter, r *http.Request, f func(item models.ToDo) (models.ToDo, error)) {
+func handleDataStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+	message := err.Error()
+	switch status {
+	case http.StatusUnauthorized:
+		w.Header().Set("WWW-Authenticate", `ApiKey realm="to-do"`)
+	case http.StatusInternalServerError:
+		message = "Internal server error"
+	}
+	writeErrorResponse(w, r, status, message)
+}
+
+func PostputToDo(w http.ResponseWriter, r *http.Request, ver *apiVersion, save func(caller string, dto toDoDTO, item models.ToDo) (models.ToDo, error)) {
 	w.Header().Set("Content-Type", "application/json")
 	defer r.Body.Close()
-	var item models.ToDo
-	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
 		writeErrorResponse(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	pathparts := strings.Split(r.URL.Path, "/")
-	err := item.Validate(pathparts[1])
+	dto, item, err := ver.decode(body)
 	if err != nil {
 		writeErrorResponse(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid body: %s", err.Error()))
 		return
 	}
-	item, err = f(item)
+	// Revisions in the body are ignored; updates are only conditional when the
+	// client sends If-Match.
+	item.Revision = 0
+	if r.Method == http.MethodPut {
+		if item.Revision, err = ifMatchRevision(r.Header.Get("If-Match")); err != nil {
+			handleDataStoreError(w, r, err)
+			return
+		}
+	}
+	item, err = save(caller(r, item.UserId), dto, item)
 	if err != nil {
 		handleDataStoreError(w, r, err)
 		return
 	}
-	MarshalAndWrite(w, r, item)
+	w.Header().Set("ETag", etag(item))
+	MarshalAndWrite(w, r, ver.fromModel(item))
+}
+
+func addToDo(svc *service.Service) func(caller string, dto toDoDTO, item models.ToDo) (models.ToDo, error) {
+	return func(caller string, _ toDoDTO, item models.ToDo) (models.ToDo, error) {
+		return svc.AddItem(caller, item)
+	}
 }
 
-func getToDo(datastore datastores.DataStore, w http.ResponseWriter, r *http.Request) {
+// updateToDo applies dto to the stored item, so fields that the version cannot
+// express keep their stored values. item.Revision is the If-Match revision.
+func updateToDo(svc *service.Service) func(caller string, dto toDoDTO, item models.ToDo) (models.ToDo, error) {
+	return func(caller string, dto toDoDTO, item models.ToDo) (models.ToDo, error) {
+		return svc.ModifyItem(caller, item.UserId, item.Id, func(current models.ToDo) (models.ToDo, error) {
+			update := dto.toModel(current)
+			update.Revision = item.Revision
+			return update, update.Validate()
+		})
+	}
+}
+
+func getToDo(svc *service.Service, ver *apiVersion, w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	userId := r.URL.Query().Get("user_id")
-	ver := strings.Split(r.URL.Path, "/")[1]
 	uuid, err := uuid.Parse(id)
-	if id == "" || (userId == "" && ver == "v2") || err != nil {
+	if id == "" || (userId == "" && ver.userScoped) || err != nil {
 		writeErrorResponse(w, r, http.StatusBadRequest, "missing 'id' query paramater")
 		return
 	}
-	var item models.ToDo
-	if item, err = datastore.GetItem(userId, uuid); err != nil {
+	item, err := svc.GetItem(caller(r, userId), userId, uuid)
+	if err != nil {
 		handleDataStoreError(w, r, err)
 		return
 	}
-	MarshalAndWrite(w, r, item)
+	w.Header().Set("ETag", etag(item))
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, item) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	MarshalAndWrite(w, r, ver.fromModel(item))
+}
+
+func parseListOptions(values url.Values) (datastores.ListOptions, error) {
+	opts := datastores.ListOptions{Cursor: values.Get("cursor")}
+	var err error
+	if limit := values.Get("limit"); limit != "" {
+		if opts.Limit, err = strconv.Atoi(limit); err != nil {
+			return opts, &todoerrors.ValidationError{Field: "limit", Err: err}
+		}
+	}
+	if complete := values.Get("complete"); complete != "" {
+		c, err := strconv.ParseBool(complete)
+		if err != nil {
+			return opts, &todoerrors.ValidationError{Field: "complete", Err: err}
+		}
+		opts.Filter.Complete = &c
+	}
+	for _, param := range values["priority"] {
+		for _, p := range strings.Split(param, ",") {
+			priority, err := models.ParsePriority(p)
+			if err != nil {
+				return opts, &todoerrors.ValidationError{Field: "priority", Err: err}
+			}
+			opts.Filter.Priorities = append(opts.Filter.Priorities, priority)
+		}
+	}
+	for _, param := range values["status"] {
+		for _, s := range strings.Split(param, ",") {
+			status, err := models.ParseStatus(s)
+			if err != nil {
+				return opts, err
+			}
+			opts.Filter.Statuses = append(opts.Filter.Statuses, status)
+		}
+	}
+	if parentId := values.Get("parent_id"); parentId != "" {
+		id, err := uuid.Parse(parentId)
+		if err != nil {
+			return opts, &todoerrors.ValidationError{Field: "parent_id", Err: err}
+		}
+		opts.Filter.ParentId = &id
+	}
+	if listId := values.Get("list_id"); listId != "" {
+		id, err := uuid.Parse(listId)
+		if err != nil {
+			return opts, &todoerrors.ValidationError{Field: "list_id", Err: err}
+		}
+		opts.Filter.ListId = &id
+	}
+	opts.Filter.TitleContains = values.Get("title")
+	if q := values.Get("q"); q != "" {
+		if opts.Filter.Query, err = query.Parse(q); err != nil {
+			return opts, err
+		}
+	}
+	if opts.Sort, err = datastores.ParseSort(values.Get("sort")); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func listToDos(svc *service.Service, ver *apiVersion, w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	userId := values.Get("user_id")
+	if userId == "" {
+		writeErrorResponse(w, r, http.StatusBadRequest, "missing 'user_id' query paramater")
+		return
+	}
+	opts, err := parseListOptions(values)
+	if err != nil {
+		handleDataStoreError(w, r, err)
+		return
+	}
+	page, err := svc.ListItems(caller(r, userId), userId, opts)
+	if err != nil {
+		handleDataStoreError(w, r, err)
+		return
+	}
+	MarshalAndWrite(w, r, ver.fromPage(page))
+}
+
+// listSubtasks lists the direct subtasks of the ToDo given by id, accepting the
+// same options as listToDos.
+func listSubtasks(svc *service.Service, ver *apiVersion, w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	userId := values.Get("user_id")
+	parentId, err := uuid.Parse(values.Get("id"))
+	if userId == "" || err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, "missing 'id' or 'user_id' query paramater")
+		return
+	}
+	opts, err := parseListOptions(values)
+	if err != nil {
+		handleDataStoreError(w, r, err)
+		return
+	}
+	page, err := svc.Subtasks(caller(r, userId), userId, parentId, opts)
+	if err != nil {
+		handleDataStoreError(w, r, err)
+		return
+	}
+	MarshalAndWrite(w, r, ver.fromPage(page))
+}
+
+// nextToDos lists the user's open ToDos in the order they can be worked on:
+// every ToDo comes after the ToDos blocking it, and otherwise higher
+// priorities come first. limit cuts the list short.
+func nextToDos(svc *service.Service, ver *apiVersion, w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	userId := values.Get("user_id")
+	if userId == "" {
+		writeErrorResponse(w, r, http.StatusBadRequest, "missing 'user_id' query paramater")
+		return
+	}
+	limit := 0
+	if l := values.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			handleDataStoreError(w, r, &todoerrors.ValidationError{Field: "limit", Err: errors.New("limit must be a positive integer")})
+			return
+		}
+	}
+	plan, err := svc.Next(caller(r, userId), userId, limit)
+	if err != nil {
+		handleDataStoreError(w, r, err)
+		return
+	}
+	MarshalAndWrite(w, r, ver.fromPage(datastores.ItemPage{Items: plan}))
+}
+
+func deleteToDo(svc *service.Service, ver *apiVersion, w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	userId := r.URL.Query().Get("user_id")
+	uuid, err := uuid.Parse(id)
+	if id == "" || (userId == "" && ver.userScoped) || err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, "missing 'id' query paramater")
+		return
+	}
+	if err := svc.DeleteItem(caller(r, userId), userId, uuid); err != nil {
+		handleDataStoreError(w, r, err)
+		return
+	}
+	writeNoContentResponse(w, r)
+}
+
+func patchToDo(svc *service.Service, ver *apiVersion, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != mergepatch.ContentType {
+		writeErrorResponse(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("PATCH requires Content-Type: %s", mergepatch.ContentType))
+		return
+	}
+	id := r.URL.Query().Get("id")
+	userId := r.URL.Query().Get("user_id")
+	itemId, err := uuid.Parse(id)
+	if id == "" || userId == "" || err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, "missing 'id' or 'user_id' query paramater")
+		return
+	}
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	ifMatch, err := ifMatchRevision(r.Header.Get("If-Match"))
+	if err != nil {
+		handleDataStoreError(w, r, err)
+		return
+	}
+	item, err := svc.ModifyItem(caller(r, userId), userId, itemId, func(current models.ToDo) (models.ToDo, error) {
+		return applyPatch(current, ver, ifMatch, patch)
+	})
+	if err != nil {
+		handleDataStoreError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", etag(item))
+	MarshalAndWrite(w, r, ver.fromModel(item))
+}
+
+// applyPatch merges patch into current as seen by the API version ver. A
+// non-zero ifMatch makes the update conditional on current's revision.
+func applyPatch(current models.ToDo, ver *apiVersion, ifMatch int, patch []byte) (models.ToDo, error) {
+	doc, err := json.Marshal(ver.fromModel(current))
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	merged, err := mergepatch.Apply(doc, patch)
+	if err != nil {
+		return models.ToDo{}, &todoerrors.ValidationError{Field: "body", Err: err}
+	}
+	dto, _, err := ver.decode(merged)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	item := dto.toModel(current)
+	if item.Id != current.Id || item.UserId != current.UserId {
+		return models.ToDo{}, &todoerrors.ValidationError{Field: "id, user_id", Err: errors.New("id and user_id cannot be patched")}
+	}
+	item.Revision = ifMatch
+	return item, item.Validate()
 }
 
 func MarshalAndWrite(w http.ResponseWriter, r *http.Request, b interface{}) {
@@ -205,13 +518,20 @@ func MarshalAndWrite(w http.ResponseWriter, r *http.Request, b interface{}) {
 	WriteJSONResponse(w, r, http.StatusOK, resp)
 }
 
-func toDoHandler(datastore datastores.DataStore, w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		getToDo(datastore, w, r)
-	case http.MethodPost:
-		PostputToDo(w, r, datastore.AddItem)
-	case http.MethodPut:
-		PostputToDo(w, r, datastore.UpdateItem)
+func toDoHandler(svc *service.Service, ver *apiVersion, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet:
+		getToDo(svc, ver, w, r)
+	case r.Method == http.MethodPost:
+		PostputToDo(w, r, ver, addToDo(svc))
+	case r.Method == http.MethodPut:
+		PostputToDo(w, r, ver, updateToDo(svc))
+	case r.Method == http.MethodDelete:
+		deleteToDo(svc, ver, w, r)
+	case r.Method == http.MethodPatch && ver.patch:
+		patchToDo(svc, ver, w, r)
+	default:
+		w.Header().Set("Allow", strings.Join(ver.methods(), ", "))
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, "method not allowed")
 	}
 }
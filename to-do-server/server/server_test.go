@@ -2,15 +2,33 @@ package server_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"math/rand/v2"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"go-to-do-app/to-do-lib/apiclient"
+	"go-to-do-app/to-do-lib/auth"
 	"go-to-do-app/to-do-lib/datastores"
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/mergepatch"
 	"go-to-do-app/to-do-lib/models"
 	"go-to-do-app/to-do-server/server"
 
@@ -18,9 +36,13 @@ import (
 )
 
 func TestConcurrentPutRequests(t *testing.T) {
+	jsonStore, err := datastores.NewJsonDatastore(filepath.Join(t.TempDir(), "store.json"), datastores.JsonOptions{})
+	if err != nil {
+		t.Fatalf("failed to open json datastore: %s", err)
+	}
 	stores := []datastores.DataStore{
 		datastores.NewInMemDataStore(),
-		datastores.NewJsonDatastore("store.json"),
+		jsonStore,
 	}
 	statuses := []bool{true, false}
 	priorities := []string{models.PriorityLow, models.PriorityMedium, models.PriorityHigh}
@@ -30,8 +52,14 @@ func TestConcurrentPutRequests(t *testing.T) {
 	for _, datastore := range stores {
 		expectedV1, _ := datastore.AddItem(itmev1)
 		expectedV2, _ := datastore.AddItem(itemv2)
-		versions["v1"] = expectedV1
-		versions["v2"] = expectedV2
+		// v1 and v2 responses do not include the status, the timestamps or
+		// the revision, which is only in the ETag.
+		for version, item := range map[string]models.ToDo{"v1": expectedV1, "v2": expectedV2} {
+			item.Status = ""
+			item.CreatedAt, item.UpdatedAt = time.Time{}, time.Time{}
+			item.Revision = 0
+			versions[version] = item
+		}
 		shutdownChan := make(chan bool)
 		srv := server.NewToDoServer(":8081", shutdownChan, datastore)
 		go srv.Start()
@@ -73,7 +101,10 @@ func TestConcurrentPutRequests(t *testing.T) {
 					if err != nil {
 						t.Errorf("Error unmarshalling response from server")
 					}
-					if actual != expected {
+					if revision, _ := strconv.Atoi(strings.Trim(resp.Header.Get("ETag"), `"`)); revision <= 1 {
+						t.Errorf("Expected an ETag after revision 1, Got: %s", resp.Header.Get("ETag"))
+					}
+					if !reflect.DeepEqual(actual, expected) {
 						t.Errorf("Expected : %+v, Got: %+v", expected, actual)
 					}
 				}(i)
@@ -84,3 +115,1089 @@ func TestConcurrentPutRequests(t *testing.T) {
 		srv.Shutdown()
 	}
 }
+
+func TestDeleteToDo(t *testing.T) {
+	datastore := datastores.NewInMemDataStore()
+	item, _ := datastore.AddItem(models.ToDo{Title: "test", Priority: "High", UserId: "TestToDoUser"})
+	srv := server.NewToDoServer(":0", make(chan bool), datastore)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	endpoint := fmt.Sprintf("%s/v2/todo?user_id=%s&id=%s", ts.URL, item.UserId, item.Id)
+	for _, expected := range []int{http.StatusNoContent, http.StatusNotFound} {
+		req, _ := http.NewRequest(http.MethodDelete, endpoint, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error performing DELETE request: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected status: %d, Got: %d", expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestListToDos(t *testing.T) {
+	datastore := datastores.NewInMemDataStore()
+	for i := 0; i < 3; i++ {
+		datastore.AddItem(models.ToDo{Title: "test", Priority: "High", UserId: "TestToDoUser"})
+	}
+	srv := server.NewToDoServer(":0", make(chan bool), datastore)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/v2/todos?user_id=TestToDoUser&limit=2", ts.URL))
+	if err != nil {
+		t.Fatalf("Error performing GET request: %s", err)
+	}
+	defer resp.Body.Close()
+	var page datastores.ItemPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("Error unmarshalling response from server: %s", err)
+	}
+	if len(page.Items) != 2 || page.NextCursor == "" {
+		t.Errorf("Expected: 2 items and a next cursor, Got: %d items and cursor %q", len(page.Items), page.NextCursor)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("%s/v2/todos", ts.URL))
+	if err != nil {
+		t.Fatalf("Error performing GET request: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status: %d, Got: %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestListToDosWithQuery(t *testing.T) {
+	datastore := datastores.NewInMemDataStore()
+	datastore.AddItem(models.ToDo{Title: "release notes", Priority: "High", UserId: "TestToDoUser"})
+	datastore.AddItem(models.ToDo{Title: "release notes", Priority: "High", Complete: true, UserId: "TestToDoUser"})
+	datastore.AddItem(models.ToDo{Title: "tidy desk", Priority: "Low", UserId: "TestToDoUser"})
+	srv := server.NewToDoServer(":0", make(chan bool), datastore)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	params := url.Values{"user_id": {"TestToDoUser"}, "q": {`priority:high -complete title:"release notes"`}}
+	resp, err := http.Get(fmt.Sprintf("%s/v2/todos?%s", ts.URL, params.Encode()))
+	if err != nil {
+		t.Fatalf("Error performing GET request: %s", err)
+	}
+	defer resp.Body.Close()
+	var page datastores.ItemPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("Error unmarshalling response from server: %s", err)
+	}
+	if len(page.Items) != 1 || page.Items[0].Complete {
+		t.Errorf("Expected: 1 incomplete item, Got: %+v", page.Items)
+	}
+
+	params.Set("q", `priority:urgent`)
+	resp, err = http.Get(fmt.Sprintf("%s/v2/todos?%s", ts.URL, params.Encode()))
+	if err != nil {
+		t.Fatalf("Error performing GET request: %s", err)
+	}
+	defer resp.Body.Close()
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Error unmarshalling error response from server: %s", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body["error"], "position 9") {
+		t.Errorf("Expected: 400 with parse position, Got: %d %+v", resp.StatusCode, body)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	datastore := datastores.NewInMemDataStore()
+	item, _ := datastore.AddItem(models.ToDo{Title: "test", Priority: "High", UserId: "TestToDoUser"})
+	srv := server.NewToDoServer(":0", make(chan bool), datastore)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	endpoint := fmt.Sprintf("%s/v2/todo?user_id=%s&id=%s", ts.URL, item.UserId, item.Id)
+
+	do := func(method string, header string, value string) *http.Response {
+		t.Helper()
+		b, _ := json.Marshal(item)
+		req, _ := http.NewRequest(method, endpoint, bytes.NewBuffer(b))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error performing %s request: %s", method, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	steps := []struct {
+		method   string
+		header   string
+		value    string
+		status   int
+		expected string
+	}{
+		{http.MethodGet, "", "", http.StatusOK, `"1"`},
+		{http.MethodGet, "If-None-Match", `"1"`, http.StatusNotModified, `"1"`},
+		{http.MethodPut, "If-Match", `"1"`, http.StatusOK, `"2"`},
+		{http.MethodPut, "If-Match", `"1"`, http.StatusPreconditionFailed, ""},
+		{http.MethodGet, "If-None-Match", `W/"1"`, http.StatusOK, `"2"`},
+		{http.MethodGet, "If-None-Match", `"1", W/"2"`, http.StatusNotModified, `"2"`},
+		{http.MethodPut, "", "", http.StatusOK, `"3"`},
+	}
+	for _, step := range steps {
+		resp := do(step.method, step.header, step.value)
+		if resp.StatusCode != step.status || resp.Header.Get("ETag") != step.expected {
+			t.Errorf("%s %s: %s Expected: %d %s, Got: %d %s",
+				step.method, step.header, step.value, step.status, step.expected, resp.StatusCode, resp.Header.Get("ETag"))
+		}
+	}
+}
+
+func TestPatchToDo(t *testing.T) {
+	datastore := datastores.NewInMemDataStore()
+	item, _ := datastore.AddItem(models.ToDo{Title: "test", Priority: "High", UserId: "TestToDoUser"})
+	srv := server.NewToDoServer(":0", make(chan bool), datastore)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	patch := func(version string, contentType string, body string) *http.Response {
+		t.Helper()
+		endpoint := fmt.Sprintf("%s/%s/todo?user_id=%s&id=%s", ts.URL, version, item.UserId, item.Id)
+		req, _ := http.NewRequest(http.MethodPatch, endpoint, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error performing PATCH request: %s", err)
+		}
+		return resp
+	}
+
+	resp := patch("v2", mergepatch.ContentType, `{"complete": true}`)
+	var got models.ToDo
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	expected := models.ToDo{Id: item.Id, Title: "test", Priority: "High", Complete: true, UserId: item.UserId}
+	if resp.StatusCode != http.StatusOK || !reflect.DeepEqual(got, expected) || resp.Header.Get("ETag") != `"2"` {
+		t.Errorf("Expected: 200 %+v with ETag \"2\", Got: %d %+v with ETag %s", expected, resp.StatusCode, got, resp.Header.Get("ETag"))
+	}
+	expected.Revision = 2
+
+	failures := []struct {
+		version     string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"v2", "application/json", `{"complete": false}`, http.StatusUnsupportedMediaType},
+		{"v1", mergepatch.ContentType, `{"complete": false}`, http.StatusMethodNotAllowed},
+		{"v2", mergepatch.ContentType, `{"id": "` + uuid.NewString() + `"}`, http.StatusBadRequest},
+		{"v2", mergepatch.ContentType, `{"priority": "Urgent"}`, http.StatusBadRequest},
+		{"v2", mergepatch.ContentType, `not json`, http.StatusBadRequest},
+	}
+	for _, f := range failures {
+		resp := patch(f.version, f.contentType, f.body)
+		resp.Body.Close()
+		if resp.StatusCode != f.status {
+			t.Errorf("%s %s %s Expected: %d, Got: %d", f.version, f.contentType, f.body, f.status, resp.StatusCode)
+		}
+	}
+	stored, _ := datastore.GetItem(item.UserId, item.Id)
+	if stored.Title != expected.Title || !stored.Complete || stored.Revision != expected.Revision {
+		t.Errorf("Expected: %+v, Got: %+v", expected, stored)
+	}
+}
+
+func TestRichFieldsOnlyInV3(t *testing.T) {
+	datastore := datastores.NewInMemDataStore()
+	srv := server.NewToDoServer(":0", make(chan bool), datastore)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	do := func(method string, version string, query string, contentType string, body string) map[string]interface{} {
+		t.Helper()
+		req, _ := http.NewRequest(method, fmt.Sprintf("%s/%s/todo%s", ts.URL, version, query), strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error performing %s request: %s", method, err)
+		}
+		defer resp.Body.Close()
+		var got map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&got)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s Expected: 200, Got: %d %+v", method, version, resp.StatusCode, got)
+		}
+		return got
+	}
+
+	added := do(http.MethodPost, "v3", "", "application/json",
+		`{"title": "test", "priority": "High", "user_id": "user", "description": "details",
+		  "due_date": "2024-03-01T17:00:00+02:00", "tags": ["Home", "work"]}`)
+	if added["due_date"] != "2024-03-01T17:00:00+02:00" || fmt.Sprint(added["tags"]) != "[home work]" || added["created_at"] == nil {
+		t.Errorf("Expected rich fields to be stored, Got: %+v", added)
+	}
+	query := fmt.Sprintf("?user_id=user&id=%s", added["id"])
+
+	v2 := do(http.MethodGet, "v2", query, "", "")
+	for _, field := range []string{"description", "due_date", "tags", "created_at", "updated_at"} {
+		if _, ok := v2[field]; ok {
+			t.Errorf("Expected v2 to omit %s, Got: %+v", field, v2)
+		}
+	}
+	do(http.MethodPut, "v2", "", "application/json",
+		fmt.Sprintf(`{"id": "%s", "title": "renamed", "priority": "Low", "user_id": "user", "description": "ignored"}`, added["id"]))
+	do(http.MethodPatch, "v2", query, mergepatch.ContentType, `{"complete": true, "tags": null}`)
+
+	got := do(http.MethodGet, "v3", query, "", "")
+	if got["title"] != "renamed" || got["description"] != "details" || fmt.Sprint(got["tags"]) != "[home work]" ||
+		got["completed_at"] == nil || got["created_at"] != added["created_at"] {
+		t.Errorf("Expected v2 updates to keep the v3 fields, Got: %+v", got)
+	}
+
+	got = do(http.MethodPatch, "v3", query, mergepatch.ContentType, `{"tags": null, "due_date": null, "complete": false}`)
+	if _, ok := got["tags"]; ok || got["due_date"] != nil || got["completed_at"] != nil || got["description"] != "details" {
+		t.Errorf("Expected tags, due date and completion to be cleared, Got: %+v", got)
+	}
+}
+
+func TestDeprecatedVersionsSendSunsetHeaders(t *testing.T) {
+	srv := server.NewToDoServer(":0", make(chan bool), datastores.NewInMemDataStore())
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	for _, version := range []string{"v1", "v2", "v3"} {
+		resp, err := http.Get(fmt.Sprintf("%s/%s/todo?user_id=user&id=%s", ts.URL, version, uuid.NewString()))
+		if err != nil {
+			t.Fatalf("Error performing GET request: %s", err)
+		}
+		resp.Body.Close()
+		deprecation, sunset := resp.Header.Get("Deprecation"), resp.Header.Get("Sunset")
+		if version == "v3" {
+			if deprecation != "" || sunset != "" {
+				t.Errorf("%s Expected no deprecation headers, Got: %q %q", version, deprecation, sunset)
+			}
+			continue
+		}
+		if !strings.HasPrefix(deprecation, "@") {
+			t.Errorf("%s Expected: Deprecation: @<unix time>, Got: %q", version, deprecation)
+		}
+		if _, err := http.ParseTime(sunset); err != nil {
+			t.Errorf("%s Expected an HTTP-date Sunset, Got: %q", version, sunset)
+		}
+		if link := resp.Header.Get("Link"); !strings.Contains(link, `</v3/swagger-ui>; rel="successor-version"`) {
+			t.Errorf("%s Expected a successor-version link, Got: %q", version, link)
+		}
+	}
+}
+
+func TestStatusTransitions(t *testing.T) {
+	datastore := datastores.WithWorkflow(datastores.NewInMemDataStore(), models.DefaultWorkflow())
+	item, _ := datastore.AddItem(models.ToDo{Title: "test", Priority: "High", UserId: "user"})
+	srv := server.NewToDoServer(":0", make(chan bool), datastore)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	patch := func(version string, body string) (int, map[string]interface{}) {
+		t.Helper()
+		endpoint := fmt.Sprintf("%s/%s/todo?user_id=user&id=%s", ts.URL, version, item.Id)
+		req, _ := http.NewRequest(http.MethodPatch, endpoint, strings.NewReader(body))
+		req.Header.Set("Content-Type", mergepatch.ContentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error performing PATCH request: %s", err)
+		}
+		defer resp.Body.Close()
+		var got map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&got)
+		return resp.StatusCode, got
+	}
+
+	steps := []struct {
+		version  string
+		body     string
+		status   int
+		expected string
+		complete bool
+	}{
+		{"v3", `{"status": "In Progress"}`, http.StatusOK, models.StatusInProgress, false},
+		{"v2", `{"complete": true}`, http.StatusOK, "", true},
+		{"v3", `{"status": "cancelled"}`, http.StatusBadRequest, "", false},
+		{"v3", `{"complete": false}`, http.StatusOK, models.StatusTodo, false},
+		{"v3", `{"status": "cancelled"}`, http.StatusOK, models.StatusCancelled, false},
+		{"v3", `{"status": "in-progress"}`, http.StatusBadRequest, "", false},
+		{"v3", `{"status": "waiting"}`, http.StatusBadRequest, "", false},
+	}
+	for _, step := range steps {
+		status, got := patch(step.version, step.body)
+		if status != step.status {
+			t.Errorf("%s %s Expected: %d, Got: %d %+v", step.version, step.body, step.status, status, got)
+			continue
+		}
+		if status == http.StatusOK && (got["status"] != nil) != (step.version == "v3") {
+			t.Errorf("%s %s Expected status only in v3, Got: %+v", step.version, step.body, got)
+		}
+		if status == http.StatusOK && (step.expected != "" && got["status"] != step.expected || got["complete"] != step.complete) {
+			t.Errorf("%s %s Expected: %s/%t, Got: %+v", step.version, step.body, step.expected, step.complete, got)
+		}
+	}
+	if stored, _ := datastore.GetItem("user", item.Id); stored.Status != models.StatusCancelled {
+		t.Errorf("Expected: %s, Got: %s", models.StatusCancelled, stored.Status)
+	}
+}
+
+func TestSubtasks(t *testing.T) {
+	datastore := datastores.NewInMemDataStore()
+	parent, _ := datastore.AddItem(models.ToDo{Title: "parent", Priority: "High", UserId: "user"})
+	srv := server.NewToDoServer(":0", make(chan bool), datastore)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	body := fmt.Sprintf(`{"title": "step", "priority": "Low", "user_id": "user", "parent_id": "%s"}`, parent.Id)
+	resp, err := http.Post(ts.URL+"/v3/todo", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error performing POST request: %s", err)
+	}
+	var step models.ToDo
+	json.NewDecoder(resp.Body).Decode(&step)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || step.ParentId == nil || *step.ParentId != parent.Id {
+		t.Fatalf("Expected: 200 with parent_id %s, Got: %d %+v", parent.Id, resp.StatusCode, step)
+	}
+
+	listSubtasks := func(id uuid.UUID) (int, []models.ToDo) {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("%s/v3/todo/subtasks?user_id=user&id=%s", ts.URL, id))
+		if err != nil {
+			t.Fatalf("Error performing GET request: %s", err)
+		}
+		defer resp.Body.Close()
+		var page struct{ Items []models.ToDo }
+		json.NewDecoder(resp.Body).Decode(&page)
+		return resp.StatusCode, page.Items
+	}
+	if status, items := listSubtasks(parent.Id); status != http.StatusOK || len(items) != 1 || items[0].Id != step.Id {
+		t.Errorf("Expected: 200 [%s], Got: %d %+v", step.Id, status, items)
+	}
+	if status, _ := listSubtasks(uuid.New()); status != http.StatusNotFound {
+		t.Errorf("Expected: %d, Got: %d", http.StatusNotFound, status)
+	}
+
+	req, _ := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/v3/todo?user_id=user&id=%s", ts.URL, step.Id), strings.NewReader(`{"status": "done"}`))
+	req.Header.Set("Content-Type", mergepatch.ContentType)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+	resp, err = http.Get(fmt.Sprintf("%s/v3/todo?user_id=user&id=%s", ts.URL, parent.Id))
+	if err != nil {
+		t.Fatalf("Error performing GET request: %s", err)
+	}
+	var got map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if got["progress"] != float64(100) {
+		t.Errorf("Expected progress: 100, Got: %+v", got)
+	}
+
+	// v2 does not show the parent.
+	resp, _ = http.Get(fmt.Sprintf("%s/v2/todo?user_id=user&id=%s", ts.URL, step.Id))
+	got = nil
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if _, ok := got["parent_id"]; ok {
+		t.Errorf("Expected no parent_id in v2, Got: %+v", got)
+	}
+}
+
+func TestNextToDos(t *testing.T) {
+	datastore := datastores.NewInMemDataStore()
+	blocker, _ := datastore.AddItem(models.ToDo{Title: "blocker", Priority: "Low", UserId: "user"})
+	datastore.AddItem(models.ToDo{Title: "blocked", Priority: "High", UserId: "user", BlockedBy: []uuid.UUID{blocker.Id}})
+	datastore.AddItem(models.ToDo{Title: "free", Priority: "Medium", UserId: "user"})
+	datastore.AddItem(models.ToDo{Title: "done", Priority: "High", UserId: "user", Complete: true})
+	srv := server.NewToDoServer(":0", make(chan bool), datastore)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/v3/todos/next?user_id=user")
+	if err != nil {
+		t.Fatalf("Error performing GET request: %s", err)
+	}
+	defer resp.Body.Close()
+	var page struct{ Items []models.ToDo }
+	json.NewDecoder(resp.Body).Decode(&page)
+	var got []string
+	for _, item := range page.Items {
+		got = append(got, item.Title)
+	}
+	expected := []string{"free", "blocker", "blocked"}
+	if resp.StatusCode != http.StatusOK || !slices.Equal(got, expected) {
+		t.Errorf("Expected: 200 %v, Got: %d %v", expected, resp.StatusCode, got)
+	}
+
+	body := fmt.Sprintf(`{"title": "cycle", "priority": "Low", "user_id": "user", "blocked_by": ["%s"]}`, blocker.Id)
+	resp, _ = http.Post(ts.URL+"/v3/todo", "application/json", strings.NewReader(body))
+	var cycle models.ToDo
+	json.NewDecoder(resp.Body).Decode(&cycle)
+	resp.Body.Close()
+	req, _ := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/v3/todo?user_id=user&id=%s", ts.URL, blocker.Id), strings.NewReader(fmt.Sprintf(`{"blocked_by": ["%s"]}`, cycle.Id)))
+	req.Header.Set("Content-Type", mergepatch.ContentType)
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected cycle to be rejected with: %d, Got: %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestRecurringToDo(t *testing.T) {
+	now := time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)
+	datastore := datastores.WithRecurrence(datastores.NewInMemDataStore(), func() time.Time { return now })
+	srv := server.NewToDoServer(":0", make(chan bool), datastore)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	post := func(recurrence string) (int, map[string]interface{}) {
+		t.Helper()
+		body := fmt.Sprintf(`{"title": "weekly report", "priority": "Low", "user_id": "user", "due_date": "2024-03-04T09:00:00Z", "recurrence": %s}`, recurrence)
+		resp, err := http.Post(ts.URL+"/v3/todo", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error performing POST request: %s", err)
+		}
+		defer resp.Body.Close()
+		var got map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&got)
+		return resp.StatusCode, got
+	}
+	if status, got := post(`{"frequency": "hourly"}`); status != http.StatusBadRequest {
+		t.Errorf("Expected: %d, Got: %d %+v", http.StatusBadRequest, status, got)
+	}
+	status, created := post(`{"frequency": "weekly", "weekdays": ["mo"]}`)
+	if status != http.StatusOK {
+		t.Fatalf("Expected: %d, Got: %d %+v", http.StatusOK, status, created)
+	}
+
+	// Completing through v2, which knows nothing about recurrence, still
+	// schedules the next occurrence.
+	endpoint := fmt.Sprintf("%s/v2/todo?user_id=user&id=%s", ts.URL, created["id"])
+	req, _ := http.NewRequest(http.MethodPatch, endpoint, strings.NewReader(`{"complete": true}`))
+	req.Header.Set("Content-Type", mergepatch.ContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Error performing PATCH request: %v %v", err, resp)
+	}
+	resp.Body.Close()
+
+	page, _ := datastore.ListItems("user", datastores.ListOptions{Filter: datastores.Filter{Statuses: models.OpenStatuses}})
+	expected := &models.Recurrence{Frequency: models.Weekly, Interval: 1, Weekdays: []string{"MO"}}
+	if len(page.Items) != 1 || !reflect.DeepEqual(page.Items[0].Recurrence, expected) ||
+		page.Items[0].DueDate.Format(time.RFC3339) != "2024-03-11T09:00:00Z" {
+		t.Errorf("Expected: one occurrence due 2024-03-11T09:00:00Z repeating %s, Got: %+v", expected, page.Items)
+	}
+}
+
+func TestLists(t *testing.T) {
+	datastore := datastores.NewInMemDataStore()
+	item, _ := datastore.AddItem(models.ToDo{Title: "report", Priority: "High", UserId: "user"})
+	srv := server.NewToDoServer(":0", make(chan bool), datastore)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	do := func(method string, path string, contentType string, body string, out interface{}) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error performing %s request: %s", method, err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	var work models.List
+	if status := do(http.MethodPost, "/v3/list", "application/json", `{"user_id": "user", "name": " Work "}`, &work); status != http.StatusOK || work.Name != "Work" {
+		t.Fatalf("Expected: 200 Work, Got: %d %+v", status, work)
+	}
+	if status := do(http.MethodPost, "/v3/list", "application/json", `{"user_id": "user", "name": ""}`, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected: %d, Got: %d", http.StatusBadRequest, status)
+	}
+	var got map[string]interface{}
+	patch := fmt.Sprintf(`{"list_id": "%s"}`, work.Id)
+	if status := do(http.MethodPatch, fmt.Sprintf("/v3/todo?user_id=user&id=%s", item.Id), mergepatch.ContentType, patch, &got); status != http.StatusOK || got["list_id"] != work.Id.String() {
+		t.Errorf("Expected the item to move to %s, Got: %d %+v", work.Id, status, got)
+	}
+	patch = fmt.Sprintf(`{"list_id": "%s"}`, uuid.New())
+	if status := do(http.MethodPatch, fmt.Sprintf("/v3/todo?user_id=user&id=%s", item.Id), mergepatch.ContentType, patch, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected: %d moving to an unknown list, Got: %d", http.StatusBadRequest, status)
+	}
+
+	var page struct{ Items []models.ToDo }
+	do(http.MethodGet, fmt.Sprintf("/v3/todos?user_id=user&list_id=%s", models.DefaultListId), "", "", &page)
+	if len(page.Items) != 0 {
+		t.Errorf("Expected the default list to be empty, Got: %+v", page.Items)
+	}
+	var lists struct{ Items []models.List }
+	if status := do(http.MethodGet, "/v3/lists?user_id=user", "", "", &lists); status != http.StatusOK || len(lists.Items) != 2 || lists.Items[1].Id != work.Id {
+		t.Errorf("Expected: the default list and %s, Got: %d %+v", work.Id, status, lists.Items)
+	}
+
+	if status := do(http.MethodDelete, fmt.Sprintf("/v3/list?user_id=user&id=%s", work.Id), "", "", nil); status != http.StatusNoContent {
+		t.Errorf("Expected: %d, Got: %d", http.StatusNoContent, status)
+	}
+	if status := do(http.MethodGet, fmt.Sprintf("/v3/list?user_id=user&id=%s", work.Id), "", "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected: %d, Got: %d", http.StatusNotFound, status)
+	}
+	if _, err := datastore.GetItem("user", item.Id); err == nil {
+		t.Errorf("Expected the item to be deleted with its list")
+	}
+}
+
+func TestSharedListRoles(t *testing.T) {
+	datastore := datastores.NewInMemDataStore()
+	team, _ := datastore.AddList(models.List{UserId: "alice", Name: "Team", Members: []models.Member{
+		{UserId: "bob", Role: models.RoleEditor},
+		{UserId: "carol", Role: models.RoleViewer},
+	}})
+	private, _ := datastore.AddItem(models.ToDo{Title: "private", Priority: "Low", UserId: "alice"})
+	srv := server.NewToDoServer(":0", make(chan bool), datastore)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	do := func(caller string, method string, path string, body string, out interface{}) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set(server.CallerHeader, caller)
+		if method == http.MethodPatch {
+			req.Header.Set("Content-Type", mergepatch.ContentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error performing %s request: %s", method, err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	body := fmt.Sprintf(`{"title": "shared", "priority": "Low", "user_id": "alice", "list_id": "%s"}`, team.Id)
+	var item models.ToDo
+	if status := do("bob", http.MethodPost, "/v3/todo", body, &item); status != http.StatusOK {
+		t.Fatalf("Expected the editor to add an item, Got: %d", status)
+	}
+	itemPath := fmt.Sprintf("/v3/todo?user_id=alice&id=%s", item.Id)
+	steps := []struct {
+		caller string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"carol", http.MethodPost, "/v3/todo", body, http.StatusForbidden},
+		{"carol", http.MethodGet, itemPath, "", http.StatusOK},
+		{"carol", http.MethodPatch, itemPath, `{"title": "mine"}`, http.StatusForbidden},
+		{"carol", http.MethodDelete, itemPath, "", http.StatusForbidden},
+		{"dave", http.MethodGet, itemPath, "", http.StatusNotFound},
+		{"bob", http.MethodGet, fmt.Sprintf("/v3/todo?user_id=alice&id=%s", private.Id), "", http.StatusNotFound},
+		{"bob", http.MethodPatch, itemPath, fmt.Sprintf(`{"list_id": "%s"}`, models.DefaultListId), http.StatusForbidden},
+		{"bob", http.MethodPatch, itemPath, `{"status": "in-progress"}`, http.StatusOK},
+		{"dave", http.MethodGet, "/v3/todos?user_id=alice", "", http.StatusForbidden},
+		{"bob", http.MethodGet, fmt.Sprintf("/v3/list?user_id=alice&id=%s", team.Id), "", http.StatusOK},
+		{"bob", http.MethodDelete, fmt.Sprintf("/v3/list?user_id=alice&id=%s", team.Id), "", http.StatusForbidden},
+		{"bob", http.MethodPut, "/v3/list", fmt.Sprintf(`{"id": "%s", "user_id": "alice", "name": "Mine"}`, team.Id), http.StatusForbidden},
+		{"bob", http.MethodPost, "/v3/list", `{"user_id": "alice", "name": "Mine"}`, http.StatusForbidden},
+		{"bob", http.MethodGet, "/v3/lists?user_id=alice", "", http.StatusForbidden},
+		{"alice", http.MethodGet, itemPath, "", http.StatusOK},
+	}
+	for _, step := range steps {
+		if status := do(step.caller, step.method, step.path, step.body, nil); status != step.status {
+			t.Errorf("%s %s %s Expected: %d, Got: %d", step.caller, step.method, step.path, step.status, status)
+		}
+	}
+
+	// Other users only see the items in the lists shared with them.
+	var page struct{ Items []models.ToDo }
+	do("carol", http.MethodGet, "/v3/todos?user_id=alice", "", &page)
+	if len(page.Items) != 1 || page.Items[0].Id != item.Id {
+		t.Errorf("Expected: [%s], Got: %+v", item.Id, page.Items)
+	}
+	var lists struct{ Items []models.List }
+	do("bob", http.MethodGet, "/v3/lists?user_id=bob", "", &lists)
+	if len(lists.Items) != 2 || lists.Items[1].Id != team.Id {
+		t.Errorf("Expected bob's default list and %s, Got: %+v", team.Id, lists.Items)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	datastore := datastores.NewInMemDataStore()
+	item, _ := datastore.AddItem(models.ToDo{Title: "secret", Priority: "Low", UserId: "alice"})
+	keys := auth.NewKeyStore()
+	_, root, _ := keys.Issue("root", true)
+	_, alice, _ := keys.Issue("alice", false)
+	srv := server.NewToDoServerWithOptions(":0", make(chan bool), datastore, server.Options{Keys: keys})
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	do := func(key string, method string, path string, body string, out interface{}) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(auth.APIKeyHeader, key)
+		}
+		// The caller header is ignored once keys are required.
+		req.Header.Set(server.CallerHeader, "alice")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error performing %s request: %s", method, err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	var issued struct {
+		Id   string `json:"id"`
+		Key  string `json:"key"`
+		Hash string `json:"hash"`
+	}
+	if status := do(root, http.MethodPost, "/admin/keys", `{"user_id": "bob"}`, &issued); status != http.StatusOK || issued.Key == "" || issued.Hash != "" {
+		t.Fatalf("Expected a new key without its hash, Got: %d %+v", status, issued)
+	}
+	bob := issued.Key
+	itemPath := fmt.Sprintf("/v3/todo?user_id=alice&id=%s", item.Id)
+	steps := []struct {
+		key    string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"", http.MethodGet, itemPath, "", http.StatusUnauthorized},
+		{"tdk_wrong", http.MethodGet, itemPath, "", http.StatusUnauthorized},
+		{alice, http.MethodGet, itemPath, "", http.StatusOK},
+		{alice, http.MethodGet, fmt.Sprintf("/v3/todo?id=%s", item.Id), "", http.StatusOK},
+		{bob, http.MethodGet, itemPath, "", http.StatusNotFound},
+		{bob, http.MethodPost, "/v3/todo", `{"title": "spoofed", "priority": "Low", "user_id": "alice"}`, http.StatusForbidden},
+		{bob, http.MethodPost, "/v3/todo", `{"title": "mine", "priority": "Low", "user_id": "bob"}`, http.StatusOK},
+		{alice, http.MethodPost, "/admin/keys", `{"user_id": "alice", "admin": true}`, http.StatusForbidden},
+		{root, http.MethodDelete, "/admin/keys?id=" + issued.Id, "", http.StatusNoContent},
+		{bob, http.MethodGet, "/v3/todos", "", http.StatusUnauthorized},
+		{alice, http.MethodGet, fmt.Sprintf("/v1/todo?id=%s", item.Id), "", http.StatusNotImplemented},
+	}
+	for _, step := range steps {
+		if status := do(step.key, step.method, step.path, step.body, nil); status != step.status {
+			t.Errorf("%s %s Expected: %d, Got: %d", step.method, step.path, step.status, status)
+		}
+	}
+
+	var unavailable struct {
+		Error string `json:"error"`
+	}
+	do(alice, http.MethodPost, "/v1/todo", `{"title": "anonymous", "priority": "Low"}`, &unavailable)
+	if !strings.HasPrefix(unavailable.Error, "v1 is unavailable with authentication") {
+		t.Errorf("Expected v1 to explain why it is unavailable, Got: %q", unavailable.Error)
+	}
+
+	var listed struct {
+		Items []auth.Key `json:"items"`
+	}
+	do(root, http.MethodGet, "/admin/keys", "", &listed)
+	if len(listed.Items) != 2 || listed.Items[0].Hash != "" {
+		t.Errorf("Expected the root and alice keys without hashes, Got: %+v", listed.Items)
+	}
+}
+
+func TestBearerTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	key, _ := auth.GenerateJWK(auth.AlgEdDSA)
+	auth.SaveJWKS(path, auth.JWKS{Keys: []auth.JWK{key}})
+	tokens, err := auth.OpenKeySet(path)
+	if err != nil {
+		t.Fatalf("failed to open keys: %s", err)
+	}
+	mint := func(subject string, scope string, ttl time.Duration) string {
+		token, _ := tokens.Sign(auth.Claims{Subject: subject, Scope: scope, ExpiresAt: time.Now().Add(ttl).Unix()})
+		return token
+	}
+	datastore := datastores.NewInMemDataStore()
+	item, _ := datastore.AddItem(models.ToDo{Title: "secret", Priority: "Low", UserId: "alice"})
+	srv := server.NewToDoServerWithOptions(":0", make(chan bool), datastore, server.Options{Tokens: tokens})
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	reader := mint("alice", auth.ScopeRead, time.Hour)
+	writer := mint("alice", auth.ScopeRead+" "+auth.ScopeWrite, time.Hour)
+	itemPath := fmt.Sprintf("/v3/todo?id=%s", item.Id)
+	steps := []struct {
+		token  string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"", http.MethodGet, itemPath, "", http.StatusUnauthorized},
+		{mint("alice", auth.ScopeRead, -time.Hour), http.MethodGet, itemPath, "", http.StatusUnauthorized},
+		{reader, http.MethodGet, itemPath, "", http.StatusOK},
+		{reader, http.MethodDelete, itemPath, "", http.StatusForbidden},
+		{mint("bob", auth.ScopeRead, time.Hour), http.MethodGet, itemPath + "&user_id=alice", "", http.StatusNotFound},
+		{writer, http.MethodPost, "/v3/todo", `{"title": "new", "priority": "Low", "user_id": "alice"}`, http.StatusOK},
+		{writer, http.MethodDelete, itemPath, "", http.StatusNoContent},
+	}
+	for _, step := range steps {
+		req, _ := http.NewRequest(step.method, ts.URL+step.path, strings.NewReader(step.body))
+		if step.token != "" {
+			req.Header.Set("Authorization", "Bearer "+step.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error performing %s request: %s", step.method, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != step.status {
+			t.Errorf("%s %s Expected: %d, Got: %d", step.method, step.path, step.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestWebLogin(t *testing.T) {
+	accounts := auth.NewAccountStore()
+	accounts.SetPassword("alice", "correct horse")
+	srv := server.NewToDoServerWithOptions(":0", make(chan bool), datastores.NewInMemDataStore(), server.Options{Accounts: accounts})
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	post := func(path string, form url.Values, cookies ...*http.Cookie) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error performing POST request: %s", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	cookie := func(resp *http.Response, name string) *http.Cookie {
+		for _, c := range resp.Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+		return nil
+	}
+
+	resp, _ := client.Get(ts.URL + "/search")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/login" {
+		t.Errorf("Expected visitors to be sent to /login, Got: %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	resp, _ = client.Get(ts.URL + "/login")
+	loginCSRF := cookie(resp, "todo_login_csrf")
+	if loginCSRF == nil || !loginCSRF.HttpOnly || !loginCSRF.Secure {
+		t.Fatalf("Expected a secure login CSRF cookie, Got: %+v", loginCSRF)
+	}
+
+	if resp := post("/login", url.Values{"username": {"alice"}, "password": {"correct horse"}}, loginCSRF); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a login without the CSRF token to be refused, Got: %d", resp.StatusCode)
+	}
+	if resp := post("/login", url.Values{"username": {"alice"}, "password": {"wrong"}, "csrf_token": {loginCSRF.Value}}, loginCSRF); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password to be refused, Got: %d", resp.StatusCode)
+	}
+	resp = post("/login", url.Values{"username": {"alice"}, "password": {"correct horse"}, "csrf_token": {loginCSRF.Value}}, loginCSRF)
+	session := cookie(resp, server.SessionCookie)
+	if resp.StatusCode != http.StatusSeeOther || session == nil || !session.HttpOnly || !session.Secure || session.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Expected a secure session cookie, Got: %d %+v", resp.StatusCode, session)
+	}
+
+	form := url.Values{"form_method": {"GET"}, "api_version": {"v3"}, "user_id": {"bob"}, "id": {uuid.NewString()}}
+	if resp := post("/item", form, session); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a form without the CSRF token to be refused, Got: %d", resp.StatusCode)
+	}
+	if resp := post("/logout", url.Values{}, session); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a logout without the CSRF token to be refused, Got: %d", resp.StatusCode)
+	}
+	if resp := post("/logout", url.Values{"csrf_token": {"guess"}}, session); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a wrong CSRF token to be refused, Got: %d", resp.StatusCode)
+	}
+
+	// The CSRF token is in the rendered form, and the templates are found
+	// relative to the server's directory.
+	wd, _ := os.Getwd()
+	os.Chdir("..")
+	defer os.Chdir(wd)
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/search", nil)
+	req.AddCookie(session)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Error performing GET request: %s", err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	match := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindSubmatch(page)
+	if match == nil || strings.Contains(string(page), `name="user_id"`) {
+		t.Fatalf("Expected a form with a CSRF token and without a user ID field, Got: %s", page)
+	}
+	if resp := post("/logout", url.Values{"csrf_token": {string(match[1])}}, session); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("Expected to log out, Got: %d", resp.StatusCode)
+	}
+	if resp, _ := client.Do(req); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("Expected the session to end, Got: %d", resp.StatusCode)
+	}
+}
+
+func TestWebForms(t *testing.T) {
+	ds := datastores.NewInMemDataStore()
+	srv := server.NewToDoServer(":0", make(chan bool), ds)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	wd, _ := os.Getwd()
+	os.Chdir("..")
+	defer os.Chdir(wd)
+
+	post := func(form url.Values) (int, string) {
+		t.Helper()
+		resp, err := http.PostForm(ts.URL+"/item", form)
+		if err != nil {
+			t.Fatalf("Error performing POST request: %s", err)
+		}
+		defer resp.Body.Close()
+		page, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(page)
+	}
+
+	id := uuid.New()
+	form := url.Values{
+		"form_method": {"POST"}, "api_version": {"v3"}, "user_id": {"alice"}, "id": {id.String()},
+		"title": {"Water the plants"}, "priority": {"urgent"}, "time_zone": {"UTC"},
+	}
+	status, page := post(form)
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected: %d, Got: %d", http.StatusBadRequest, status)
+	}
+	invalid := regexp.MustCompile(`name="priority" value="urgent"[^>]*class="invalid"`)
+	if !invalid.MatchString(page) || !strings.Contains(page, `value="Water the plants"`) {
+		t.Errorf("Expected the form again with the priority highlighted, Got: %s", page)
+	}
+	if page, _ := ds.ListItems("alice", datastores.ListOptions{}); len(page.Items) != 0 {
+		t.Errorf("Expected the invalid item not to be saved, Got: %+v", page.Items)
+	}
+
+	form.Set("priority", "high")
+	if status, page := post(form); status != http.StatusOK || !strings.Contains(page, "Water the plants") {
+		t.Errorf("Expected the added item, Got: %d %s", status, page)
+	}
+	items, _ := ds.ListItems("alice", datastores.ListOptions{})
+	if len(items.Items) != 1 || items.Items[0].Title != "Water the plants" {
+		t.Fatalf("Expected: %+v, Got: %+v", "Water the plants", items.Items)
+	}
+	id = items.Items[0].Id
+
+	search := url.Values{"form_method": {"LIST"}, "api_version": {"v2"}, "user_id": {"alice"}, "q": {"priority:high"}}
+	if status, page := post(search); status != http.StatusOK || !strings.Contains(page, id.String()) {
+		t.Errorf("Expected the item in the results, Got: %d %s", status, page)
+	}
+	if status, _ := post(url.Values{"form_method": {"GET"}, "api_version": {"v3"}, "user_id": {"bob"}, "id": {id.String()}}); status != http.StatusNotFound {
+		t.Errorf("Expected: %d, Got: %d", http.StatusNotFound, status)
+	}
+}
+
+func TestAPIClient(t *testing.T) {
+	srv := server.NewToDoServer(":0", make(chan bool), datastores.NewInMemDataStore())
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	client := apiclient.NewAPIClient(ts.URL)
+	ctx := context.Background()
+
+	item, err := client.Create(ctx, models.ToDo{UserId: "alice", Title: "Pay rent", Priority: "High"})
+	if err != nil || item.Id == uuid.Nil || item.Title != "Pay rent" {
+		t.Fatalf("Expected the created item, Got: %+v (%v)", item, err)
+	}
+	if got, err := client.Get(ctx, "alice", item.Id); err != nil || got.Title != item.Title {
+		t.Errorf("Expected: %+v, Got: %+v (%v)", item, got, err)
+	}
+
+	item.Title = "Pay the rent"
+	updated, err := client.Update(ctx, item)
+	if err != nil || updated.Title != "Pay the rent" || updated.Revision != item.Revision+1 {
+		t.Errorf("Expected the updated item, Got: %+v (%v)", updated, err)
+	}
+	if _, err := client.Update(ctx, item); !errors.As(err, new(*todoerrors.ConflictError)) {
+		t.Errorf("Expected: ConflictError updating a stale revision, Got: %v", err)
+	}
+	v2 := client
+	v2.Version = "v2"
+	if got, err := v2.Get(ctx, "alice", item.Id); err != nil || got.Revision != updated.Revision {
+		t.Errorf("Expected revision %d from the v2 ETag, Got: %+v (%v)", updated.Revision, got, err)
+	}
+	var invalid *todoerrors.ValidationError
+	if _, err := client.Create(ctx, models.ToDo{UserId: "alice", Title: "Pay rent", Priority: "Whenever"}); !errors.As(err, &invalid) || invalid.Field != "priority" {
+		t.Errorf("Expected: ValidationError on priority, Got: %v", err)
+	}
+
+	if _, err := client.Create(ctx, models.ToDo{UserId: "alice", Title: "Buy stamps", Priority: "Low"}); err != nil {
+		t.Fatalf("Error creating item: %s", err)
+	}
+	page, err := client.List(ctx, "alice", apiclient.ListOptions{Query: "priority:high"})
+	if err != nil || len(page.Items) != 1 || page.Items[0].Id != item.Id {
+		t.Errorf("Expected: only %s, Got: %+v (%v)", item.Id, page.Items, err)
+	}
+
+	if err := client.Delete(ctx, "alice", item.Id); err != nil {
+		t.Errorf("Error deleting item: %s", err)
+	}
+	if _, err := client.Get(ctx, "alice", item.Id); !errors.As(err, new(*todoerrors.NotFoundError)) {
+		t.Errorf("Expected: NotFoundError, Got: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := client.Get(cancelled, "alice", item.Id); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected: %v, Got: %v", context.Canceled, err)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	ds := datastores.NewInMemDataStore()
+	srv := server.NewToDoServer(":0", make(chan bool), ds)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	post := func(key string, body string) (*http.Response, models.ToDo) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/v2/todo", strings.NewReader(body))
+		req.Header.Set(server.IdempotencyKeyHeader, key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error performing POST request: %s", err)
+		}
+		defer resp.Body.Close()
+		var item models.ToDo
+		json.NewDecoder(resp.Body).Decode(&item)
+		return resp, item
+	}
+
+	body := `{"id": "` + uuid.NewString() + `", "user_id": "alice", "title": "Book flights", "priority": "High"}`
+	resp, first := post("trip-1", body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("Expected the item to be created, Got: %d %+v", resp.StatusCode, first)
+	}
+	resp, again := post("trip-1", body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "true" || again.Id != first.Id {
+		t.Errorf("Expected: %+v replayed, Got: %d %+v", first, resp.StatusCode, again)
+	}
+	if page, _ := ds.ListItems("alice", datastores.ListOptions{}); len(page.Items) != 1 {
+		t.Errorf("Expected: 1 item, Got: %+v", page.Items)
+	}
+
+	if resp, _ := post("trip-1", strings.Replace(body, "flights", "trains", 1)); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected: %d, Got: %d", http.StatusUnprocessableEntity, resp.StatusCode)
+	}
+	bob := strings.Replace(body, "alice", "bob", 1)
+	if resp, item := post("trip-1", bob); resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" || item.UserId != "bob" {
+		t.Errorf("Expected keys to be kept per user, Got: %d %+v", resp.StatusCode, item)
+	}
+	if resp, second := post("trip-2", body); resp.StatusCode != http.StatusOK || second.Id == first.Id {
+		t.Errorf("Expected a new key to create another item, Got: %d %+v", resp.StatusCode, second)
+	}
+}
+
+// panickingStore panics on the first AddItem, like a handler with a bug.
+type panickingStore struct {
+	datastores.DataStore
+	panicked atomic.Bool
+}
+
+func (ds *panickingStore) AddItem(item models.ToDo) (models.ToDo, error) {
+	if !ds.panicked.Swap(true) {
+		panic("store failure")
+	}
+	return ds.DataStore.AddItem(item)
+}
+
+func TestIdempotencyKeysSurvivePanics(t *testing.T) {
+	ds := &panickingStore{DataStore: datastores.NewInMemDataStore()}
+	srv := server.NewToDoServer(":0", make(chan bool), ds)
+	ts := httptest.NewUnstartedServer(srv.Handler())
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.Start()
+	defer ts.Close()
+
+	body := `{"id": "` + uuid.NewString() + `", "user_id": "alice", "title": "Book flights", "priority": "High"}`
+	post := func() (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/v2/todo", strings.NewReader(body))
+		req.Header.Set(server.IdempotencyKeyHeader, "trip-1")
+		return http.DefaultClient.Do(req)
+	}
+	if resp, err := post(); err == nil {
+		resp.Body.Close()
+		t.Fatalf("Expected the panic to abort the response, Got: %d", resp.StatusCode)
+	}
+	resp, err := post()
+	if err != nil {
+		t.Fatalf("Error performing POST request: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the retry to be handled, Got: %d", resp.StatusCode)
+	}
+}
+
+func TestAPIClientRetries(t *testing.T) {
+	ds := datastores.NewInMemDataStore()
+	srv := server.NewToDoServer(":0", make(chan bool), ds)
+	var mu sync.Mutex
+	var attempts int
+	// The first attempt of every request is handled but its response is lost,
+	// as if the server restarted before answering.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		lost := attempts%2 == 1
+		mu.Unlock()
+		if lost {
+			srv.Handler().ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		srv.Handler().ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	client := apiclient.NewAPIClient(ts.URL)
+	client.Retry = apiclient.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	ctx := context.Background()
+
+	item, err := client.Create(ctx, models.ToDo{UserId: "alice", Title: "Renew passport", Priority: "High"})
+	if err != nil {
+		t.Fatalf("Error creating item: %s", err)
+	}
+	page, _ := ds.ListItems("alice", datastores.ListOptions{})
+	if len(page.Items) != 1 || page.Items[0].Id != item.Id {
+		t.Errorf("Expected: only %+v, Got: %+v", item, page.Items)
+	}
+	if got, err := client.Get(ctx, "alice", item.Id); err != nil || got.Id != item.Id {
+		t.Errorf("Expected: %+v, Got: %+v (%v)", item, got, err)
+	}
+
+	item.Title = "Renew passports"
+	var unavailable *apiclient.StatusError
+	if _, err := client.Update(ctx, item); !errors.As(err, &unavailable) || unavailable.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected a PUT not to be retried, Got: %v", err)
+	}
+
+	client.Retry.MaxAttempts = 0
+	mu.Lock()
+	attempts = 0
+	mu.Unlock()
+	if _, err := client.Get(ctx, "alice", item.Id); !errors.As(err, &unavailable) {
+		t.Errorf("Expected retries to be disabled, Got: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// v1 is the original API, where ToDos do not belong to a user.
+var v1 = apiVersion{
+	name:       "v1",
+	newDTO:     func() toDoDTO { return &toDoV1{} },
+	fromModel:  func(item models.ToDo) interface{} { return newToDoV1(item) },
+	deprecated: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+	sunset:     time.Date(2027, 4, 1, 0, 0, 0, 0, time.UTC),
+	successor:  "v3",
+}
+
+type toDoV1 struct {
+	Id       uuid.UUID `json:"id"`
+	Title    string    `json:"title"`
+	Priority string    `json:"priority"`
+	Complete bool      `json:"complete"`
+	UserId   string    `json:"user_id,omitempty"`
+}
+
+func newToDoV1(item models.ToDo) toDoV1 {
+	return toDoV1{
+		Id:       item.Id,
+		Title:    item.Title,
+		Priority: item.Priority,
+		Complete: item.Complete,
+		UserId:   item.UserId,
+	}
+}
+
+func (t *toDoV1) validate() error {
+	if t.UserId != "" {
+		return &todoerrors.ValidationError{Field: fmt.Sprintf("user_id: %s", t.UserId), Err: errors.New("v1 todo api does not allow user_id")}
+	}
+	return nil
+}
+
+func (t *toDoV1) toModel(item models.ToDo) models.ToDo {
+	item.Id = t.Id
+	item.Title = t.Title
+	item.Priority = t.Priority
+	item.Complete = t.Complete
+	item.UserId = t.UserId
+	return item
+}
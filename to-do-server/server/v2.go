@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// v2 scopes ToDos to a user and adds listing and PATCH.
+var v2 = apiVersion{
+	name:       "v2",
+	newDTO:     func() toDoDTO { return &toDoV2{} },
+	fromModel:  func(item models.ToDo) interface{} { return newToDoV2(item) },
+	userScoped: true,
+	patch:      true,
+	list:       true,
+	deprecated: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+	sunset:     time.Date(2027, 10, 1, 0, 0, 0, 0, time.UTC),
+	successor:  "v3",
+}
+
+type toDoV2 struct {
+	Id       uuid.UUID `json:"id"`
+	Title    string    `json:"title"`
+	Priority string    `json:"priority"`
+	Complete bool      `json:"complete"`
+	UserId   string    `json:"user_id,omitempty"`
+}
+
+func newToDoV2(item models.ToDo) toDoV2 {
+	return toDoV2{
+		Id:       item.Id,
+		Title:    item.Title,
+		Priority: item.Priority,
+		Complete: item.Complete,
+		UserId:   item.UserId,
+	}
+}
+
+func (t *toDoV2) validate() error {
+	if t.UserId == "" {
+		return &todoerrors.ValidationError{Field: fmt.Sprintf("user_id: %s", t.UserId), Err: errors.New("invalid user_id")}
+	}
+	return nil
+}
+
+func (t *toDoV2) toModel(item models.ToDo) models.ToDo {
+	item.Id = t.Id
+	item.Title = t.Title
+	item.Priority = t.Priority
+	item.Complete = t.Complete
+	item.UserId = t.UserId
+	return item
+}
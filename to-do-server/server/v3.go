@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+
+	"github.com/google/uuid"
+)
+
+// v3 adds lists, workflow statuses, subtasks, dependencies, recurrence,
+// descriptions, due dates, tags and timestamps.
+var v3 = apiVersion{
+	name:       "v3",
+	newDTO:     func() toDoDTO { return &toDoV3{} },
+	fromModel:  func(item models.ToDo) interface{} { return newToDoV3(item) },
+	userScoped: true,
+	patch:      true,
+	list:       true,
+	subtasks:   true,
+	next:       true,
+	lists:      true,
+}
+
+// toDoV3 is also the response body. The timestamps and progress are
+// maintained by the datastores, so they are ignored in requests. Complete is derived from
+// Status, but still accepted on its own as a shorthand for done or todo.
+type toDoV3 struct {
+	Id          uuid.UUID          `json:"id"`
+	Title       string             `json:"title"`
+	Priority    string             `json:"priority"`
+	Complete    bool               `json:"complete"`
+	Status      string             `json:"status"`
+	UserId      string             `json:"user_id"`
+	Revision    int                `json:"revision"`
+	Description string             `json:"description,omitempty"`
+	DueDate     *time.Time         `json:"due_date,omitempty"`
+	Tags        []string           `json:"tags,omitempty"`
+	CreatedAt   time.Time          `json:"created_at"`
+	UpdatedAt   time.Time          `json:"updated_at"`
+	CompletedAt *time.Time         `json:"completed_at,omitempty"`
+	ParentId    *uuid.UUID         `json:"parent_id,omitempty"`
+	Progress    *int               `json:"progress,omitempty"`
+	BlockedBy   []uuid.UUID        `json:"blocked_by,omitempty"`
+	Recurrence  *models.Recurrence `json:"recurrence,omitempty"`
+	ListId      uuid.UUID          `json:"list_id"`
+}
+
+func newToDoV3(item models.ToDo) toDoV3 {
+	return toDoV3{
+		Id:          item.Id,
+		Title:       item.Title,
+		Priority:    item.Priority,
+		Complete:    item.Complete,
+		Status:      item.EffectiveStatus(),
+		UserId:      item.UserId,
+		Revision:    item.Revision,
+		Description: item.Description,
+		DueDate:     item.DueDate,
+		Tags:        item.Tags,
+		CreatedAt:   item.CreatedAt,
+		UpdatedAt:   item.UpdatedAt,
+		CompletedAt: item.CompletedAt,
+		ParentId:    item.ParentId,
+		Progress:    item.Progress,
+		BlockedBy:   item.BlockedBy,
+		Recurrence:  item.Recurrence,
+		ListId:      item.ListId,
+	}
+}
+
+func (t *toDoV3) validate() error {
+	if t.UserId == "" {
+		return &todoerrors.ValidationError{Field: fmt.Sprintf("user_id: %s", t.UserId), Err: errors.New("invalid user_id")}
+	}
+	return nil
+}
+
+func (t *toDoV3) toModel(item models.ToDo) models.ToDo {
+	item.Id = t.Id
+	item.Title = t.Title
+	item.Priority = t.Priority
+	item.Complete = t.Complete
+	if t.Status != "" {
+		item.Status = t.Status
+	}
+	item.UserId = t.UserId
+	item.Revision = t.Revision
+	item.Description = t.Description
+	item.DueDate = t.DueDate
+	item.Tags = t.Tags
+	item.ParentId = t.ParentId
+	item.BlockedBy = t.BlockedBy
+	item.Recurrence = t.Recurrence
+	item.ListId = t.ListId
+	return item
+}
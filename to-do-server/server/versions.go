@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go-to-do-app/to-do-lib/datastores"
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+)
+
+// toDoDTO is the request body of one API version.
+type toDoDTO interface {
+	// validate checks the rules specific to the version. Rules that hold for
+	// every version are checked by models.ToDo.Validate.
+	validate() error
+	// toModel sets the fields the version can express on item and returns
+	// it. Other fields are left as they are, so an update through an older
+	// version does not clear fields it has never heard of.
+	toModel(item models.ToDo) models.ToDo
+}
+
+// apiVersion is everything the handlers need to know about one version of the
+// API. Each version lives in its own file and is listed in apiVersions.
+type apiVersion struct {
+	name string
+	// newDTO returns a pointer to an empty request body.
+	newDTO func() toDoDTO
+	// fromModel converts an item to the version's response body.
+	fromModel func(item models.ToDo) interface{}
+	// userScoped versions identify a ToDo by user_id and id; the others only
+	// by id.
+	userScoped bool
+	patch      bool
+	list       bool
+	// subtasks versions serve /todo/subtasks, next versions /todos/next and
+	// lists versions /list and /lists.
+	subtasks bool
+	next     bool
+	lists    bool
+	// deprecated and sunset are zero for versions that are not deprecated.
+	// successor names the version clients should move to.
+	deprecated time.Time
+	sunset     time.Time
+	successor  string
+}
+
+var apiVersions = []*apiVersion{&v1, &v2, &v3}
+
+// pageDTO is a page of ListItems in the shape of a version's ToDos.
+type pageDTO struct {
+	Items      []interface{} `json:"items"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// decode reads and validates a request body, returning the item it describes
+// on its own.
+func (v *apiVersion) decode(body []byte) (toDoDTO, models.ToDo, error) {
+	dto := v.newDTO()
+	if err := json.Unmarshal(body, dto); err != nil {
+		return nil, models.ToDo{}, &todoerrors.ValidationError{Field: "body", Err: err}
+	}
+	if err := dto.validate(); err != nil {
+		return nil, models.ToDo{}, err
+	}
+	item := dto.toModel(models.ToDo{})
+	return dto, item, item.Validate()
+}
+
+func (v *apiVersion) fromPage(page datastores.ItemPage) pageDTO {
+	items := make([]interface{}, len(page.Items))
+	for i, item := range page.Items {
+		items[i] = v.fromModel(item)
+	}
+	return pageDTO{Items: items, NextCursor: page.NextCursor}
+}
+
+func (v *apiVersion) methods() []string {
+	methods := []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}
+	if v.patch {
+		methods = append(methods, http.MethodPatch)
+	}
+	return methods
+}
+
+// withHeaders announces a deprecated version on every response, using the
+// Deprecation (RFC 9745) and Sunset (RFC 8594) headers.
+func (v *apiVersion) withHeaders(h http.HandlerFunc) http.HandlerFunc {
+	if v.deprecated.IsZero() {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", v.deprecated.Unix()))
+		if !v.sunset.IsZero() {
+			w.Header().Set("Sunset", v.sunset.UTC().Format(http.TimeFormat))
+		}
+		if v.successor != "" {
+			w.Header().Add("Link", fmt.Sprintf(`</%s/swagger-ui>; rel="successor-version"`, v.successor))
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"go-to-do-app/to-do-lib/auth"
+	todoerrors "go-to-do-app/to-do-lib/errors"
+)
+
+// SessionCookie holds the session of a user logged in to the web UI.
+const SessionCookie = "todo_session"
+
+// loginCSRFCookie holds the CSRF token of the login form, which is sent
+// before there is a session to keep it in.
+const loginCSRFCookie = "todo_login_csrf"
+
+// DefaultSessionTTL is how long a web UI session lasts when Options does not
+// say.
+const DefaultSessionTTL = 12 * time.Hour
+
+const sessionContextKey = authContextKey("session")
+
+// webAuth logs users in to the web UI. A nil *webAuth leaves the UI open, with
+// the user ID typed into each form, as it was before accounts existed.
+type webAuth struct {
+	accounts *auth.AccountStore
+	sessions *auth.Sessions
+}
+
+func newWebAuth(opts Options) *webAuth {
+	if opts.Accounts == nil {
+		return nil
+	}
+	ttl := opts.SessionTTL
+	if ttl == 0 {
+		ttl = DefaultSessionTTL
+	}
+	return &webAuth{accounts: opts.Accounts, sessions: auth.NewSessions(ttl)}
+}
+
+type loginData struct {
+	CSRF  string
+	Error string
+}
+
+// currentSession returns the session requireSession found for r.
+func currentSession(r *http.Request) (auth.Session, bool) {
+	session, ok := r.Context().Value(sessionContextKey).(auth.Session)
+	return session, ok
+}
+
+// setCookie sets a cookie that scripts cannot read, that is only sent over
+// HTTPS (browsers treat http://localhost as secure too) and that other sites
+// cannot make the browser send. maxAge < 0 deletes the cookie.
+func setCookie(w http.ResponseWriter, name string, value string, path string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// requireSession sends visitors who are not logged in to /login and passes
+// the others on with their session in the context.
+func (web *webAuth) requireSession(h http.HandlerFunc) http.HandlerFunc {
+	if web == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(SessionCookie)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		session, ok := web.sessions.Get(cookie.Value, time.Now())
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey, session)))
+	}
+}
+
+// checkCSRF returns a ForbiddenError unless the form of r carries the CSRF
+// token of its session. Requests without a session have nothing to check.
+func checkCSRF(r *http.Request) error {
+	session, ok := currentSession(r)
+	if !ok || session.CheckCSRF(r.FormValue("csrf_token")) {
+		return nil
+	}
+	return &todoerrors.ForbiddenError{Message: "missing or invalid CSRF token"}
+}
+
+// loginHandler shows the login form on GET and starts a session on POST. The
+// form is protected by a CSRF token kept in a cookie of its own, so another
+// site cannot log a visitor in as someone else.
+func (web *webAuth) loginHandler() http.HandlerFunc {
+	showForm := func(w http.ResponseWriter, r *http.Request, status int, message string) {
+		csrf, err := auth.RandomToken()
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		setCookie(w, loginCSRFCookie, csrf, "/login", 0)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+		}
+		serveTemplate("./templates/login.html", loginData{CSRF: csrf, Error: message})(w, r)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			showForm(w, r, http.StatusOK, "")
+			return
+		case http.MethodPost:
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form data", http.StatusBadRequest)
+			return
+		}
+		cookie, err := r.Cookie(loginCSRFCookie)
+		if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostFormValue("csrf_token"))) != 1 {
+			showForm(w, r, http.StatusForbidden, "Your login form expired, please try again.")
+			return
+		}
+		username := r.PostFormValue("username")
+		if err := web.accounts.Login(username, r.PostFormValue("password")); err != nil {
+			showForm(w, r, http.StatusUnauthorized, "Wrong username or password.")
+			return
+		}
+		session, err := web.sessions.Start(username, time.Now())
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		setCookie(w, loginCSRFCookie, "", "/login", -1)
+		setCookie(w, SessionCookie, session.Id, "/", int(time.Until(session.ExpiresAt).Seconds()))
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// logoutHandler ends the session. It only accepts POST with the session's
+// CSRF token, so other sites cannot log users out.
+func (web *webAuth) logoutHandler() http.HandlerFunc {
+	return web.requireSession(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := checkCSRF(r); err != nil {
+			handleDataStoreError(w, r, err)
+			return
+		}
+		session, _ := currentSession(r)
+		web.sessions.End(session.Id)
+		setCookie(w, SessionCookie, "", "/", -1)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	})
+}
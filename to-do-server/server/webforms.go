@@ -0,0 +1,277 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go-to-do-app/to-do-lib/auth"
+	todoerrors "go-to-do-app/to-do-lib/errors"
+	"go-to-do-app/to-do-lib/models"
+	"go-to-do-app/to-do-lib/service"
+
+	"github.com/google/uuid"
+)
+
+// webUI serves the forms of the web UI. It calls the service the API handlers
+// use rather than the API itself, so it works whatever address the server
+// listens on, and a form that fails is shown again with its errors next to
+// the fields that caused them.
+type webUI struct {
+	svc  *service.Service
+	auth *webAuth
+	opts Options
+}
+
+// formData is what todoform.html is rendered with. UserId and CSRF are empty
+// when the web UI has no accounts.
+type formData struct {
+	Method string
+	UserId string
+	CSRF   string
+	// Version is the form shown first: v1, v2, v3 or query. Empty means v1.
+	Version string
+	// Values holds what a failed form sent and Errors what is wrong with
+	// it, both keyed by input name. Error sums the problem up.
+	Values map[string]string
+	Errors map[string]string
+	Error  string
+}
+
+type searchResults struct {
+	UserId string
+	Query  string
+	Items  []models.ToDo
+}
+
+// formFields are the inputs of todoform.html that a failed form is filled in
+// with again. API keys and tokens are left out so they are not echoed.
+var formFields = []string{
+	"user_id", "id", "title", "priority", "complete", "status", "description", "due_date",
+	"time_zone", "tags", "list_id", "parent_id", "blocked_by", "repeat", "q",
+}
+
+// errorFields maps the Field of validation errors to the input of
+// todoform.html it came from, where their names differ.
+var errorFields = map[string]string{
+	"time zone":  "time_zone",
+	"recurrence": "repeat",
+}
+
+// serveForm renders todoform.html for method, with the user and CSRF token of
+// the session, if there is one.
+func (ui *webUI) serveForm(method string) http.HandlerFunc {
+	return ui.auth.requireSession(func(w http.ResponseWriter, r *http.Request) {
+		serveTemplate("./templates/todoform.html", newFormData(r, method))(w, r)
+	})
+}
+
+func newFormData(r *http.Request, method string) formData {
+	data := formData{Method: method}
+	if session, ok := currentSession(r); ok {
+		data.UserId, data.CSRF = session.UserId, session.CSRF
+	}
+	return data
+}
+
+// handleWebForm serves the forms of the web UI. When users log in, every form
+// must carry the CSRF token of the session and acts as the session's user,
+// whatever user_id it sends. Otherwise, when the server requires API keys or
+// tokens, the form authenticates with the one in its api_key field.
+func (ui *webUI) handleWebForm(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form data", http.StatusBadRequest)
+		return
+	}
+	if err := checkCSRF(r); err != nil {
+		handleDataStoreError(w, r, err)
+		return
+	}
+	method := r.PostFormValue("form_method")
+	r, err := ui.identify(r, method)
+	if err != nil {
+		ui.showErrors(w, r, method, err)
+		return
+	}
+	owner := r.PostFormValue("user_id")
+	if session, ok := currentSession(r); ok {
+		owner = session.UserId
+	} else if id, ok := authenticated(r); ok && owner == "" {
+		owner = id.userId
+	}
+
+	if method == "LIST" {
+		q := r.PostFormValue("q")
+		opts, err := parseListOptions(url.Values{"q": {q}})
+		if err != nil {
+			ui.showErrors(w, r, method, err)
+			return
+		}
+		page, err := ui.svc.ListItems(caller(r, owner), owner, opts)
+		if err != nil {
+			ui.showErrors(w, r, method, err)
+			return
+		}
+		serveTemplate("./templates/todolist.html", searchResults{UserId: owner, Query: q, Items: page.Items})(w, r)
+		return
+	}
+
+	ver := findVersion(r.PostFormValue("api_version"))
+	if ver == nil {
+		ui.showErrors(w, r, method, &todoerrors.ValidationError{Field: "api_version", Err: fmt.Errorf("unknown version %q", r.PostFormValue("api_version"))})
+		return
+	}
+	if !ver.userScoped {
+		owner = ""
+	}
+	id, err := uuid.Parse(r.PostFormValue("id"))
+	if err != nil {
+		ui.showErrors(w, r, method, &todoerrors.ValidationError{Field: "id", Err: err})
+		return
+	}
+	switch method {
+	case http.MethodGet:
+		item, err := ui.svc.GetItem(caller(r, owner), owner, id)
+		if err != nil {
+			ui.showErrors(w, r, method, err)
+			return
+		}
+		serveTemplate("./templates/todoitem.html", item)(w, r)
+	case http.MethodDelete:
+		if err := ui.svc.DeleteItem(caller(r, owner), owner, id); err != nil {
+			ui.showErrors(w, r, method, err)
+			return
+		}
+		serveTemplate("./templates/itemdeleted.html", id.String())(w, r)
+	case http.MethodPost, http.MethodPut:
+		save := addToDo(ui.svc)
+		if method == http.MethodPut {
+			save = updateToDo(ui.svc)
+		}
+		item, err := saveForm(r.PostForm, ver, owner, func(dto toDoDTO, item models.ToDo) (models.ToDo, error) {
+			return save(caller(r, owner), dto, item)
+		})
+		if err != nil {
+			ui.showErrors(w, r, method, err)
+			return
+		}
+		serveTemplate("./templates/todoitem.html", item)(w, r)
+	default:
+		ui.showErrors(w, r, method, &todoerrors.ValidationError{Field: "form_method", Err: fmt.Errorf("unknown form method %q", method)})
+	}
+}
+
+// identify returns r with the identity of whoever sent its form in the
+// context: the user of the session, or the user of the API key or token in
+// the api_key field when the server requires them. Like the API, searches
+// need the todo:read scope and everything else todo:write.
+func (ui *webUI) identify(r *http.Request, method string) (*http.Request, error) {
+	if session, ok := currentSession(r); ok {
+		return withIdentity(r, identity{userId: session.UserId}), nil
+	}
+	if ui.opts.Keys == nil && ui.opts.Tokens == nil {
+		return r, nil
+	}
+	credential := r.PostFormValue("api_key")
+	if strings.HasPrefix(credential, auth.KeyPrefix) {
+		r.Header.Set(auth.APIKeyHeader, credential)
+	} else if credential != "" {
+		r.Header.Set("Authorization", "Bearer "+credential)
+	}
+	id, err := ui.opts.identify(r)
+	if err != nil {
+		return r, err
+	}
+	need := auth.ScopeWrite
+	if method == http.MethodGet || method == "LIST" {
+		need = auth.ScopeRead
+	}
+	if id.scopes != nil && !auth.HasScope(id.scopes, need) {
+		return r, &todoerrors.ForbiddenError{Message: fmt.Sprintf("the token needs the %s scope", need)}
+	}
+	return withIdentity(r, id), nil
+}
+
+// saveForm builds the ToDo a form describes, reads it as ver would read it
+// from a request body and passes it to save.
+func saveForm(form url.Values, ver *apiVersion, owner string, save func(dto toDoDTO, item models.ToDo) (models.ToDo, error)) (models.ToDo, error) {
+	id, title, priority := form.Get("id"), form.Get("title"), form.Get("priority")
+	complete := form.Get("complete") == "true"
+	item, err := models.NewToDo(&owner, &id, &title, &priority, &complete)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	// Only v3 reads these; older versions ignore them.
+	item.Status = form.Get("status")
+	item.Description = form.Get("description")
+	item.Tags = models.ParseTags(form.Get("tags"))
+	if item.DueDate, err = models.ParseDueDate(form.Get("due_date"), form.Get("time_zone")); err != nil {
+		return models.ToDo{}, err
+	}
+	if parent := form.Get("parent_id"); parent != "" {
+		parentId, err := uuid.Parse(parent)
+		if err != nil {
+			return models.ToDo{}, &todoerrors.ValidationError{Field: "parent_id", Err: err}
+		}
+		item.ParentId = &parentId
+	}
+	if item.BlockedBy, err = models.ParseBlockers(form.Get("blocked_by")); err != nil {
+		return models.ToDo{}, err
+	}
+	if item.Recurrence, err = models.ParseRecurrence(form.Get("repeat")); err != nil {
+		return models.ToDo{}, err
+	}
+	if list := form.Get("list_id"); list != "" {
+		if item.ListId, err = uuid.Parse(list); err != nil {
+			return models.ToDo{}, &todoerrors.ValidationError{Field: "list_id", Err: err}
+		}
+	}
+	body, err := json.Marshal(item)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	dto, item, err := ver.decode(body)
+	if err != nil {
+		return models.ToDo{}, err
+	}
+	return save(dto, item)
+}
+
+// showErrors renders the form that failed again with what it sent, and err
+// next to the field it is about.
+func (ui *webUI) showErrors(w http.ResponseWriter, r *http.Request, method string, err error) {
+	status := errorStatus(err)
+	data := newFormData(r, method)
+	data.Version = r.PostFormValue("api_version")
+	if method == "LIST" {
+		data.Method, data.Version = http.MethodGet, "query"
+	}
+	data.Values = make(map[string]string)
+	for _, field := range formFields {
+		data.Values[field] = r.PostFormValue(field)
+	}
+	data.Error = err.Error()
+	if status == http.StatusInternalServerError {
+		data.Error = "Internal server error"
+	}
+	if e, ok := err.(*todoerrors.ValidationError); ok {
+		field, _, _ := strings.Cut(e.Field, ":")
+		if name, ok := errorFields[field]; ok {
+			field = name
+		}
+		data.Errors = map[string]string{field: e.Err.Error()}
+	}
+	w.WriteHeader(status)
+	serveTemplate("./templates/todoform.html", data)(w, r)
+}
+
+func findVersion(name string) *apiVersion {
+	for _, ver := range apiVersions {
+		if ver.name == name {
+			return ver
+		}
+	}
+	return nil
+}
@@ -8,15 +8,36 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"go-to-do-app/to-do-lib/auth"
 	"go-to-do-app/to-do-lib/datastores"
 	"go-to-do-app/to-do-lib/logging"
+	"go-to-do-app/to-do-lib/models"
 	"go-to-do-app/to-do-server/server"
+
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite"
 )
 
 var (
-	mode         = flag.String("mode", "", "set the mode the application should run in (in-mem, json-store, pgdb)")
+	mode         = flag.String("mode", "", "set the mode the application should run in (in-mem, json-store, sqlite, pgdb)")
 	jsonPath     = flag.String("json", "", "filepath of json file to use as datastore")
+	jsonRecover  = flag.Bool("json-recover", false, "open the newest readable backup if the json file cannot be parsed")
+	dsn          = flag.String("dsn", "", "data source name of the sql database to use as datastore, e.g. todo.db")
+	workflowPath = flag.String("workflow", "", "json file of allowed status transitions, replacing the default workflow")
+	keysPath     = flag.String("keys", "", "json file of API keys; when set, every API request needs a key")
+	issueKey     = flag.String("issue-key", "", "issue an API key for this user in the -keys file, print it and exit")
+	admin        = flag.Bool("admin", false, "with -issue-key, issue an admin key that can manage keys at /admin/keys")
+	revokeKey    = flag.String("revoke-key", "", "revoke the API key with this id in the -keys file and exit")
+	jwksPath     = flag.String("jwks", "", "JWKS file of the keys that sign bearer tokens; when set, every API request needs a token or key")
+	newJWK       = flag.String("new-jwk", "", "add a new HS256 or EdDSA signing key to the -jwks file and exit")
+	mintToken    = flag.String("mint-token", "", "print a token for this user signed with the newest -jwks key and exit, for development")
+	scopes       = flag.String("scopes", "todo:read todo:write", "with -mint-token, the space separated scopes of the token")
+	ttl          = flag.Duration("ttl", time.Hour, "with -mint-token, how long the token is valid for")
+	accountsPath = flag.String("accounts", "", "json file of web UI accounts; when set, users log in to the web UI")
+	addAccount   = flag.String("add-account", "", "create this web UI account in the -accounts file, or change its password, reading the password from stdin, and exit")
+	idemWindow   = flag.Duration("idempotency-window", server.DefaultIdempotencyWindow, "how long the response to a POST with an Idempotency-Key header is replayed for")
 	shutdownChan = make(chan bool)
 )
 
@@ -35,9 +56,166 @@ func listenForShutdownCommand(server server.ToDoServer) {
 	}
 }
 
+// manageKeys issues or revokes a key in the -keys file, so the first admin key
+// can be made before the server is running.
+func manageKeys() {
+	if *keysPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: -issue-key and -revoke-key need -keys")
+		os.Exit(1)
+	}
+	keys, err := auth.OpenKeyStore(*keysPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to open keys: %s\n", err)
+		os.Exit(1)
+	}
+	if *issueKey != "" {
+		key, secret, err := keys.Issue(*issueKey, *admin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("id:  %s\nkey: %s\n", key.Id, secret)
+		return
+	}
+	id, err := uuid.Parse(*revokeKey)
+	if err == nil {
+		err = keys.Revoke(id)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// manageTokens adds signing keys to the -jwks file and mints tokens with
+// them.
+func manageTokens() {
+	if *jwksPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: -new-jwk and -mint-token need -jwks")
+		os.Exit(1)
+	}
+	if *newJWK != "" {
+		set, err := auth.LoadJWKS(*jwksPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to read keys: %s\n", err)
+			os.Exit(1)
+		}
+		key, err := auth.GenerateJWK(*newJWK)
+		if err == nil {
+			set.Keys = append(set.Keys, key)
+			err = auth.SaveJWKS(*jwksPath, set)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("kid: %s\n", key.Kid)
+		return
+	}
+	keys, err := auth.OpenKeySet(*jwksPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to open keys: %s\n", err)
+		os.Exit(1)
+	}
+	now := time.Now()
+	token, err := keys.Sign(auth.Claims{
+		Subject:   *mintToken,
+		Scope:     *scopes,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(*ttl).Unix(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(token)
+}
+
+// manageAccounts sets the password of an account in the -accounts file.
+func manageAccounts() {
+	if *accountsPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: -add-account needs -accounts")
+		os.Exit(1)
+	}
+	accounts, err := auth.OpenAccountStore(*accountsPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to open accounts: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Password for %s: ", *addAccount)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err == nil || password != "" {
+		err = accounts.SetPassword(*addAccount, strings.TrimRight(password, "\r\n"))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
 func run() {
 	flag.Parse()
 
+	if *issueKey != "" || *revokeKey != "" {
+		manageKeys()
+		return
+	}
+	if *newJWK != "" || *mintToken != "" {
+		manageTokens()
+		return
+	}
+	if *addAccount != "" {
+		manageAccounts()
+		return
+	}
+
+	opts := server.Options{IdempotencyWindow: *idemWindow}
+	if *keysPath != "" {
+		var err error
+		if opts.Keys, err = auth.OpenKeyStore(*keysPath); err != nil {
+			logging.LogWithTrace(
+				context.Background(),
+				map[string]interface{}{"path": *keysPath},
+				fmt.Sprintf("failed to open keys: %s", err),
+			)
+			os.Exit(1)
+		}
+	}
+	if *jwksPath != "" {
+		var err error
+		if opts.Tokens, err = auth.OpenKeySet(*jwksPath); err != nil {
+			logging.LogWithTrace(
+				context.Background(),
+				map[string]interface{}{"path": *jwksPath},
+				fmt.Sprintf("failed to open jwks: %s", err),
+			)
+			os.Exit(1)
+		}
+	}
+
+	if !opts.AuthRequired() {
+		fmt.Fprintf(os.Stderr, "WARNING: authentication is off; any request can act as any user with user_id or %s. Set -keys or -jwks unless this is a development server.\n", server.CallerHeader)
+		logging.LogWithTrace(
+			context.Background(),
+			map[string]interface{}{},
+			"WARNING: authentication is off. Without -keys or -jwks the server trusts the user_id and "+
+				server.CallerHeader+" of every request, so anyone who can reach it can act as any user. Use this for development only.",
+		)
+	}
+
+	if *accountsPath != "" {
+		var err error
+		if opts.Accounts, err = auth.OpenAccountStore(*accountsPath); err != nil {
+			logging.LogWithTrace(
+				context.Background(),
+				map[string]interface{}{"path": *accountsPath},
+				fmt.Sprintf("failed to open accounts: %s", err),
+			)
+			os.Exit(1)
+		}
+	}
+
 	var store datastores.DataStore
 	if *mode == "" {
 		logging.LogWithTrace(
@@ -63,10 +241,55 @@ func run() {
 			)
 			os.Exit(1)
 		}
-		store = datastores.NewJsonDatastore(*jsonPath)
+		var err error
+		if store, err = datastores.NewJsonDatastore(*jsonPath, datastores.JsonOptions{RecoverFromBackup: *jsonRecover}); err != nil {
+			logging.LogWithTrace(
+				context.Background(),
+				map[string]interface{}{"path": *jsonPath},
+				fmt.Sprintf("failed to open json datastore: %s", err),
+			)
+			os.Exit(1)
+		}
+	}
+	if *mode == "sqlite" {
+		if *dsn == "" {
+			logging.LogWithTrace(
+				context.Background(),
+				map[string]interface{}{},
+				"no dsn provided for sql datastore",
+			)
+			os.Exit(1)
+		}
+		var err error
+		if store, err = datastores.NewSQLDatastore("sqlite", *dsn); err != nil {
+			logging.LogWithTrace(
+				context.Background(),
+				map[string]interface{}{"dsn": *dsn},
+				fmt.Sprintf("failed to open sql datastore: %s", err),
+			)
+			os.Exit(1)
+		}
+	}
+	if store == nil {
+		fmt.Fprintf(os.Stderr, "Error: unknown mode '%s'\n", *mode)
+		os.Exit(1)
+	}
+	defer store.Close()
+	workflow := models.DefaultWorkflow()
+	if *workflowPath != "" {
+		var err error
+		if workflow, err = models.LoadWorkflow(*workflowPath); err != nil {
+			logging.LogWithTrace(
+				context.Background(),
+				map[string]interface{}{"path": *workflowPath},
+				fmt.Sprintf("failed to load workflow: %s", err),
+			)
+			os.Exit(1)
+		}
 	}
+	store = datastores.WithRecurrence(datastores.WithWorkflow(store, workflow), time.Now)
 
-	srv := server.NewToDoServer(":8081", shutdownChan, store)
+	srv := server.NewToDoServerWithOptions(":8081", shutdownChan, store, opts)
 	go srv.Start()
 	listenForShutdownCommand(srv)
 	srv.AwaitShutdown()